@@ -17,18 +17,21 @@ import (
 
 // Attachment struct for attachments
 type Attachment struct {
-	ID          bson.ObjectId     `json:"id" bson:"_id,omitempty"`
-	GridID      bson.ObjectId     `json:"gridID" bson:"gridID,omitempty"`
-	Owner       string            `json:"owner" bson:"owner,omitempty"`
-	AttachID    string            `json:"attachID" bson:"attachID,omitempty"`
-	MsgID       string            `json:"msgID" bson:"msgID,omitempty"`
-	ThreadID    string            `json:"threadID" bson:"threadID,omitempty"`
-	Filename    string            `json:"filename" bson:"filename,omitempty"`
-	Size        int64             `json:"size" bson:"size,omitempty"`
-	MimeType    string            `json:"mimeType" bson:"mimeType,omitempty"`
-	ContentType string            `json:"contentType" bson:"contentType,omitempty"`
-	Headers     map[string]string `json:"headers" bson:"headers,omitempty"`
-	Data        string            `json:"data" bson:"data,omitempty"`
+	ID          bson.ObjectId  `json:"id" bson:"_id,omitempty"`
+	GridID      bson.ObjectId  `json:"gridID" bson:"gridID,omitempty"`
+	Owner       string         `json:"owner" bson:"owner,omitempty"`
+	AttachID    string         `json:"attachID" bson:"attachID,omitempty"`
+	MsgID       string         `json:"msgID" bson:"msgID,omitempty"`
+	ThreadID    string         `json:"threadID" bson:"threadID,omitempty"`
+	Filename    string         `json:"filename" bson:"filename,omitempty"`
+	Size        int64          `json:"size" bson:"size,omitempty"`
+	MimeType    string         `json:"mimeType" bson:"mimeType,omitempty"`
+	ContentType string         `json:"contentType" bson:"contentType,omitempty"`
+	ContentID   string         `json:"contentID" bson:"contentID,omitempty"`
+	Headers     MessageHeaders `json:"headers" bson:"headers,omitempty"`
+	Data        string         `json:"data" bson:"data,omitempty"`
+	Text        string         `json:"text" bson:"text,omitempty"`
+	TextStatus  string         `json:"textStatus" bson:"textStatus,omitempty"`
 }
 
 // SaveAttachments save attachments
@@ -158,13 +161,25 @@ func GetAttachmentsDetails(attachments *[]Attachment, att MessageAttachment, use
 	defer SaveLog(proc)
 
 	a := Attachment{
-		Owner:    user.Email,
-		MsgID:    att.MsgID,
-		ThreadID: att.ThreadID,
-		AttachID: att.AttacID,
-		Filename: att.Filename,
-		MimeType: att.MimeType,
-		Headers:  att.Headers,
+		Owner:     user.Email,
+		MsgID:     att.MsgID,
+		ThreadID:  att.ThreadID,
+		AttachID:  att.AttacID,
+		Filename:  att.Filename,
+		MimeType:  att.MimeType,
+		ContentID: att.ContentID,
+		Headers:   att.Headers,
+	}
+
+	// inline attachment already have data
+	if att.Data != "" {
+
+		a.Data = att.Data
+		a.Size = att.Size
+
+		(*attachments) = append((*attachments), a)
+		wgi.Done()
+		return
 	}
 
 	attachment, err := svc.Users.Messages.Attachments.Get(a.Owner, a.MsgID, a.AttachID).Do()
@@ -249,8 +264,8 @@ func ProccessAttachments(svc *gmail.Service, user User, attach []MessageAttachme
 	return attachments
 }
 
-// GetAttachment return attachment
-func GetAttachment(attachID string) Attachment {
+// GetAttachment return attachment of owner
+func GetAttachment(owner, attachID string) Attachment {
 
 	proc := ServiceLog{
 		Start:   time.Now(),
@@ -269,7 +284,7 @@ func GetAttachment(attachID string) Attachment {
 
 	// group tredids
 
-	err := DBC.Find(bson.M{"attachID": attachID}).One(&attach)
+	err := DBC.Find(bson.M{"owner": owner, "attachID": attachID}).One(&attach)
 	if err != nil {
 		HandleError(proc, "get attachment", err, true)
 		return attach
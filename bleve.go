@@ -0,0 +1,825 @@
+package main
+
+import (
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/blevesearch/bleve"
+	"github.com/blevesearch/bleve/mapping"
+	"github.com/blevesearch/bleve/search/query"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// BleveSearchBackend embedded on-disk search index, one index per owner
+// use is read locked while index is used, rebuilt index is swapped with write lock
+type BleveSearchBackend struct {
+	Path      string
+	Fuzziness int
+	lock      sync.Mutex
+	use       sync.RWMutex
+	indexes   map[string]bleve.Index
+}
+
+// BleveMessage document indexed for message
+type BleveMessage struct {
+	Owner         string    `json:"owner"`
+	MsgID         string    `json:"msgID"`
+	ThreadID      string    `json:"threadID"`
+	Labels        []string  `json:"labels"`
+	From          string    `json:"from"`
+	To            string    `json:"to"`
+	CC            string    `json:"cc"`
+	BCC           string    `json:"bcc"`
+	FromDomain    string    `json:"fromDomain"`
+	Subject       string    `json:"subject"`
+	Text          string    `json:"text"`
+	Filenames     string    `json:"filenames"`
+	Attachments   string    `json:"attachments"`
+	MimeTypes     []string  `json:"mimeTypes"`
+	HasAttachment bool      `json:"hasAttachment"`
+	SizeEstimate  float64   `json:"sizeEstimate"`
+	InternalDate  time.Time `json:"internalDate"`
+}
+
+// bleveFacetFields facets counted by index, by facet key of emails page
+var bleveFacetFields = map[string]string{"label": "labels", "domain": "fromDomain"}
+
+// bleveTextFields fields searched by free text terms
+var bleveTextFields = []string{"subject", "from", "to", "text", "filenames", "attachments"}
+
+// NewBleveSearchBackend return backend storing indexes in path
+// SEARCH_FUZZINESS set edit distance for free text words, default 1
+func NewBleveSearchBackend(path string) *BleveSearchBackend {
+
+	fuzziness := 1
+	if f, err := strconv.Atoi(os.Getenv("SEARCH_FUZZINESS")); err == nil {
+		fuzziness = f
+	}
+
+	return &BleveSearchBackend{
+		Path:      path,
+		Fuzziness: fuzziness,
+		indexes:   make(map[string]bleve.Index),
+	}
+}
+
+// BleveMapping return index mapping of messages
+func BleveMapping() *mapping.IndexMappingImpl {
+
+	keyword := bleve.NewKeywordFieldMapping()
+	keyword.IncludeInAll = false
+
+	text := bleve.NewTextFieldMapping()
+	text.Store = false
+
+	number := bleve.NewNumericFieldMapping()
+	number.IncludeInAll = false
+
+	date := bleve.NewDateTimeFieldMapping()
+	date.IncludeInAll = false
+
+	boolean := bleve.NewBooleanFieldMapping()
+	boolean.IncludeInAll = false
+
+	doc := bleve.NewDocumentStaticMapping()
+	doc.AddFieldMappingsAt("owner", keyword)
+	doc.AddFieldMappingsAt("msgID", keyword)
+	doc.AddFieldMappingsAt("threadID", keyword)
+	doc.AddFieldMappingsAt("labels", keyword)
+	doc.AddFieldMappingsAt("fromDomain", keyword)
+	doc.AddFieldMappingsAt("from", text)
+	doc.AddFieldMappingsAt("to", text)
+	doc.AddFieldMappingsAt("cc", text)
+	doc.AddFieldMappingsAt("bcc", text)
+	doc.AddFieldMappingsAt("subject", text)
+	doc.AddFieldMappingsAt("text", text)
+	doc.AddFieldMappingsAt("filenames", text)
+	doc.AddFieldMappingsAt("attachments", text)
+	doc.AddFieldMappingsAt("mimeTypes", keyword)
+	doc.AddFieldMappingsAt("hasAttachment", boolean)
+	doc.AddFieldMappingsAt("sizeEstimate", number)
+	doc.AddFieldMappingsAt("internalDate", date)
+
+	m := bleve.NewIndexMapping()
+	m.DefaultMapping = doc
+
+	return m
+}
+
+// Index return opened index of owner, created if missing
+func (b *BleveSearchBackend) Index(owner string) (bleve.Index, error) {
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	if idx, ok := b.indexes[owner]; ok {
+		return idx, nil
+	}
+
+	path := b.IndexPath(owner)
+
+	idx, err := bleve.Open(path)
+	if err == bleve.ErrorIndexPathDoesNotExist {
+
+		err = os.MkdirAll(b.Path, 0755)
+		if err != nil {
+			return nil, err
+		}
+
+		idx, err = bleve.New(path, BleveMapping())
+
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	b.indexes[owner] = idx
+
+	return idx, nil
+}
+
+// IndexPath return directory of owner index
+func (b *BleveSearchBackend) IndexPath(owner string) string {
+
+	sum := sha1.Sum([]byte(strings.ToLower(owner)))
+
+	return filepath.Join(b.Path, hex.EncodeToString(sum[:])+".bleve")
+}
+
+// BleveDocID return document ID of message
+func BleveDocID(msg Message) string {
+
+	return msg.ThreadID + "/" + msg.MsgID
+}
+
+// NewBleveMessage return indexed document of message
+func NewBleveMessage(msg Message) BleveMessage {
+
+	doc := BleveMessage{
+		Owner:        msg.Owner,
+		MsgID:        msg.MsgID,
+		ThreadID:     msg.ThreadID,
+		Labels:       msg.Labels,
+		From:         msg.From,
+		To:           msg.To,
+		CC:           msg.CC,
+		BCC:          msg.BCC,
+		Subject:      msg.Subject,
+		Text:         msg.Text,
+		SizeEstimate: float64(msg.SizeEstimate),
+		InternalDate: msg.InternalDate,
+	}
+
+	if doc.Text == "" {
+		doc.Text = msg.HTMLText
+	}
+
+	if doc.Text == "" && msg.HTML != "" {
+		doc.Text = StripHTML(string(msg.HTML))
+	}
+
+	if i := strings.LastIndex(msg.FromEmails, "@"); i != -1 {
+		doc.FromDomain = strings.ToLower(strings.Trim(msg.FromEmails[i+1:], " ,>"))
+	}
+
+	var filenames []string
+	for _, a := range msg.Attachments {
+
+		if a.Filename != "" {
+			filenames = append(filenames, a.Filename)
+		}
+
+		if a.MimeType != "" {
+			doc.MimeTypes = append(doc.MimeTypes, strings.ToLower(a.MimeType))
+		}
+
+	}
+
+	doc.Filenames = strings.Join(filenames, " ")
+	doc.Attachments = msg.AttachmentText
+	doc.HasAttachment = len(msg.Attachments) != 0
+
+	return doc
+}
+
+// IndexMessages add or replace messages in owner indexes
+func (b *BleveSearchBackend) IndexMessages(messages []Message) error {
+
+	b.use.RLock()
+	defer b.use.RUnlock()
+
+	batches := make(map[string]*bleve.Batch)
+
+	for _, msg := range messages {
+
+		idx, err := b.Index(msg.Owner)
+		if err != nil {
+			return err
+		}
+
+		batch, ok := batches[msg.Owner]
+		if !ok {
+			batch = idx.NewBatch()
+			batches[msg.Owner] = batch
+		}
+
+		err = batch.Index(BleveDocID(msg), NewBleveMessage(msg))
+		if err != nil {
+			return err
+		}
+
+	}
+
+	for owner, batch := range batches {
+
+		idx, err := b.Index(owner)
+		if err != nil {
+			return err
+		}
+
+		err = idx.Batch(batch)
+		if err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+}
+
+// DeleteThreads remove messages of threads from owner index
+func (b *BleveSearchBackend) DeleteThreads(owner string, threadIDs []string) error {
+
+	if len(threadIDs) == 0 {
+		return nil
+	}
+
+	b.use.RLock()
+	defer b.use.RUnlock()
+
+	idx, err := b.Index(owner)
+	if err != nil {
+		return err
+	}
+
+	var threads []query.Query
+	for _, tID := range threadIDs {
+		threads = append(threads, bleveTerm("threadID", tID))
+	}
+
+	for {
+
+		req := bleve.NewSearchRequestOptions(bleve.NewDisjunctionQuery(threads...), 500, 0, false)
+
+		res, err := idx.Search(req)
+		if err != nil {
+			return err
+		}
+
+		if len(res.Hits) == 0 {
+			return nil
+		}
+
+		batch := idx.NewBatch()
+		for _, hit := range res.Hits {
+			batch.Delete(hit.ID)
+		}
+
+		err = idx.Batch(batch)
+		if err != nil {
+			return err
+		}
+
+	}
+
+}
+
+// SearchQuery return owner index & query of label & search
+func (b *BleveSearchBackend) SearchQuery(DB *mgo.Session, user User, label string, s ESearch) (bleve.Index, query.Query, SearchNode, error) {
+
+	node, err := ParseSearchQuery(s.QueryString())
+	if err != nil {
+		return nil, nil, node, err
+	}
+
+	idx, err := b.Index(user.Email)
+	if err != nil {
+		return nil, nil, node, err
+	}
+
+	compiler := SearchCompiler{
+		Owner: user.Email,
+		DB:    DB.DB(os.Getenv("MONGO_DB")),
+	}
+
+	q, err := b.Query(&compiler, node)
+	if err != nil {
+		return nil, nil, node, err
+	}
+
+	must := []query.Query{bleveTerm("owner", user.Email), q}
+	if label != "" {
+		must = append(must, bleveTerm("labels", label))
+	}
+
+	return idx, bleve.NewConjunctionQuery(must...), node, nil
+}
+
+// SearchThreads return threads with messages matching query, with facets of first page
+func (b *BleveSearchBackend) SearchThreads(user User, label string, page int, s ESearch) (SearchResult, error) {
+
+	var result SearchResult
+
+	b.use.RLock()
+	defer b.use.RUnlock()
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	idx, q, node, err := b.SearchQuery(DB, user, label, s)
+	if err != nil {
+		return result, err
+	}
+
+	order := []string{"-_score", "-internalDate"}
+	if s.Sort == "date" {
+		order = []string{"-internalDate"}
+	}
+
+	// messages are grouped to threads in order of hits
+	// scan stop after threads of requested page
+	var tIDs []string
+	seen := make(map[string]bool)
+
+	limit := (page + 1) * 50
+
+	for from := 0; ; from += limit {
+
+		req := bleve.NewSearchRequestOptions(q, limit, from, false)
+		req.Fields = []string{"threadID"}
+		req.SortBy(order)
+
+		if from == 0 {
+			AddBleveFacets(req)
+		}
+
+		res, err := idx.Search(req)
+		if err != nil {
+			return result, err
+		}
+
+		if from == 0 {
+			result.Facets = BleveFacets(res)
+		}
+
+		for _, hit := range res.Hits {
+
+			tID, _ := hit.Fields["threadID"].(string)
+			if tID != "" && !seen[tID] {
+				seen[tID] = true
+				tIDs = append(tIDs, tID)
+			}
+
+		}
+
+		result.Total = len(tIDs)
+
+		if len(res.Hits) < limit {
+			break
+		}
+
+		// each of not scanned hits can be in new thread, total is upper bound
+		if len(tIDs) >= limit {
+			result.Total = len(tIDs) + int(res.Total) - from - len(res.Hits)
+			break
+		}
+
+	}
+
+	start := page * 50
+	if start >= len(tIDs) {
+		return result, nil
+	}
+
+	end := start + 50
+	if end > len(tIDs) {
+		end = len(tIDs)
+	}
+
+	var found []Thread
+	err = DB.DB(os.Getenv("MONGO_DB")).C("threads").Find(bson.M{
+		"owner":    user.Email,
+		"threadID": bson.M{"$in": tIDs[start:end]},
+	}).All(&found)
+	if err != nil {
+		return result, err
+	}
+
+	byID := make(map[string]Thread)
+	for _, t := range found {
+		byID[t.ThreadID] = t
+	}
+
+	for _, tID := range tIDs[start:end] {
+		if t, ok := byID[tID]; ok {
+			result.Threads = append(result.Threads, t)
+		}
+	}
+
+	_, _, terms := SplitTextSearch(node)
+
+	AddThreadHighlights(DB, bson.M{"owner": user.Email}, result.Threads, terms)
+
+	return result, nil
+}
+
+// Query return bleve query of parsed search query
+func (b *BleveSearchBackend) Query(c *SearchCompiler, node SearchNode) (query.Query, error) {
+
+	switch node.Op {
+	case "and", "or":
+
+		var children []query.Query
+
+		for _, child := range node.Children {
+
+			q, err := b.Query(c, child)
+			if err != nil {
+				return nil, err
+			}
+
+			children = append(children, q)
+
+		}
+
+		if node.Op == "or" {
+			return bleve.NewDisjunctionQuery(children...), nil
+		}
+
+		return bleve.NewConjunctionQuery(children...), nil
+
+	case "not":
+
+		q, err := b.Query(c, node.Children[0])
+		if err != nil {
+			return nil, err
+		}
+
+		not := bleve.NewBooleanQuery()
+		not.AddMust(bleve.NewMatchAllQuery())
+		not.AddMustNot(q)
+
+		return not, nil
+
+	}
+
+	return b.QueryTerm(c, node.Field, node.Value)
+}
+
+// QueryTerm return bleve query for single term
+func (b *BleveSearchBackend) QueryTerm(c *SearchCompiler, field, value string) (query.Query, error) {
+
+	switch field {
+	case "":
+
+		var fields []query.Query
+		for _, f := range bleveTextFields {
+			fields = append(fields, b.Match(f, value))
+		}
+
+		return bleve.NewDisjunctionQuery(fields...), nil
+
+	case "from", "to", "cc", "bcc", "subject", "filename":
+
+		if field == "filename" {
+			field = "filenames"
+		}
+
+		if field != "subject" && strings.ToLower(value) == "me" {
+			value = c.Owner
+		}
+
+		return b.Match(field, value), nil
+
+	case "mimetype":
+
+		return bleveTerm("mimeTypes", strings.ToLower(value)), nil
+
+	case "label", "in":
+
+		if strings.ToLower(value) == "anywhere" {
+			return bleve.NewMatchAllQuery(), nil
+		}
+
+		return bleveTerm("labels", c.LabelID(value)), nil
+
+	case "is":
+
+		switch strings.ToLower(value) {
+		case "read":
+
+			read := bleve.NewBooleanQuery()
+			read.AddMust(bleve.NewMatchAllQuery())
+			read.AddMustNot(bleveTerm("labels", "UNREAD"))
+
+			return read, nil
+
+		}
+
+		if labelID, ok := searchLabels[strings.ToLower(value)]; ok {
+			return bleveTerm("labels", labelID), nil
+		}
+
+	case "has":
+
+		switch strings.ToLower(value) {
+		case "attachment":
+
+			q := bleve.NewBoolFieldQuery(true)
+			q.SetField("hasAttachment")
+
+			return q, nil
+
+		}
+
+	case "larger", "size", "smaller":
+
+		size, err := ParseSearchSize(value)
+		if err != nil {
+			return nil, err
+		}
+
+		limit := float64(size)
+
+		var q *query.NumericRangeQuery
+		if field == "smaller" {
+			q = bleve.NewNumericRangeQuery(nil, &limit)
+		} else {
+			limit++
+			q = bleve.NewNumericRangeQuery(&limit, nil)
+		}
+
+		q.SetField("sizeEstimate")
+
+		return q, nil
+
+	case "after", "newer", "before", "older", "older_than", "newer_than":
+
+		var date time.Time
+		var err error
+
+		if field == "older_than" || field == "newer_than" {
+			date, err = ParseRelativeDate(value)
+		} else {
+			date, err = ParseSearchDate(value)
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		var q *query.DateRangeQuery
+		if field == "after" || field == "newer" || field == "newer_than" {
+			q = bleve.NewDateRangeQuery(date, time.Time{})
+		} else {
+			q = bleve.NewDateRangeQuery(time.Time{}, date)
+		}
+
+		q.SetField("internalDate")
+
+		return q, nil
+
+	}
+
+	return nil, errors.New("unsupported search " + field + ":" + value)
+}
+
+// Match return match query on field, phrase for quoted values, fuzzy for words
+func (b *BleveSearchBackend) Match(field, value string) query.Query {
+
+	if strings.Contains(value, " ") {
+
+		q := bleve.NewMatchPhraseQuery(value)
+		q.SetField(field)
+
+		return q
+
+	}
+
+	q := bleve.NewMatchQuery(value)
+	q.SetField(field)
+	q.SetOperator(query.MatchQueryOperatorAnd)
+
+	// short words have too many close matches
+	if len([]rune(value)) > 3 && !strings.Contains(value, "@") {
+		q.SetFuzziness(b.Fuzziness)
+	}
+
+	return q
+}
+
+// Facets return label & sender domain facets of messages matching label & search
+func (b *BleveSearchBackend) Facets(user User, label string, s ESearch) (map[string][]SearchFacet, error) {
+
+	b.use.RLock()
+	defer b.use.RUnlock()
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	idx, q, _, err := b.SearchQuery(DB, user, label, s)
+	if err != nil {
+		return nil, err
+	}
+
+	req := bleve.NewSearchRequestOptions(q, 0, 0, false)
+	AddBleveFacets(req)
+
+	res, err := idx.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	return BleveFacets(res), nil
+}
+
+// AddBleveFacets add facet requests of search request
+func AddBleveFacets(req *bleve.SearchRequest) {
+
+	for name, field := range bleveFacetFields {
+		req.AddFacet(name, bleve.NewFacetRequest(field, 10))
+	}
+
+}
+
+// BleveFacets return facets of search result
+func BleveFacets(res *bleve.SearchResult) map[string][]SearchFacet {
+
+	facets := make(map[string][]SearchFacet)
+
+	for name, f := range res.Facets {
+		for _, t := range f.Terms {
+			facets[name] = append(facets[name], SearchFacet{Term: t.Term, Count: t.Count})
+		}
+	}
+
+	return facets
+}
+
+// Rebuild recreate owner index from messages collection
+// new index is built next to used one & swapped when no request use index
+func (b *BleveSearchBackend) Rebuild(owner string) (int, error) {
+
+	start := time.Now()
+
+	path := b.IndexPath(owner)
+	tmp := path + ".rebuild"
+
+	err := os.RemoveAll(tmp)
+	if err != nil {
+		return 0, err
+	}
+
+	err = os.MkdirAll(b.Path, 0755)
+	if err != nil {
+		return 0, err
+	}
+
+	idx, err := bleve.New(tmp, BleveMapping())
+	if err != nil {
+		return 0, err
+	}
+
+	count, err := BleveIndexQuery(bson.M{"owner": owner}, func(messages []Message) error {
+
+		batch := idx.NewBatch()
+
+		for _, msg := range messages {
+			if err := batch.Index(BleveDocID(msg), NewBleveMessage(msg)); err != nil {
+				return err
+			}
+		}
+
+		return idx.Batch(batch)
+	})
+
+	if cerr := idx.Close(); err == nil {
+		err = cerr
+	}
+
+	if err != nil {
+		os.RemoveAll(tmp)
+		return count, err
+	}
+
+	b.use.Lock()
+	b.lock.Lock()
+
+	if old, ok := b.indexes[owner]; ok {
+		old.Close()
+		delete(b.indexes, owner)
+	}
+
+	err = os.RemoveAll(path)
+	if err == nil {
+		err = os.Rename(tmp, path)
+	}
+
+	b.lock.Unlock()
+	b.use.Unlock()
+
+	if err != nil {
+		return count, err
+	}
+
+	// messages saved while rebuilding were added to old index
+	_, err = BleveIndexQuery(bson.M{"owner": owner, "_id": bson.M{"$gte": bson.NewObjectIdWithTime(start)}}, b.IndexMessages)
+
+	return count, err
+}
+
+// BleveIndexQuery pass messages matching query to index func in batches, return count of indexed messages
+func BleveIndexQuery(query bson.M, index func(messages []Message) error) (int, error) {
+
+	count := 0
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	var messages []Message
+	var msg Message
+
+	iter := DBM.Find(query).Select(bson.M{
+		"owner":          1,
+		"msgID":          1,
+		"threadID":       1,
+		"labels":         1,
+		"from":           1,
+		"fromEmails":     1,
+		"to":             1,
+		"cc":             1,
+		"bcc":            1,
+		"subject":        1,
+		"text":           1,
+		"html":           1,
+		"htmlText":       1,
+		"attachments":    1,
+		"attachmentText": 1,
+		"sizeEstimate":   1,
+		"internalDate":   1,
+	}).Iter()
+
+	for iter.Next(&msg) {
+
+		messages = append(messages, msg)
+		msg = Message{}
+
+		if len(messages) == 200 {
+
+			err := index(messages)
+			if err != nil {
+				iter.Close()
+				return count, err
+			}
+
+			count += len(messages)
+			messages = nil
+
+		}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		return count, err
+	}
+
+	if len(messages) != 0 {
+
+		err := index(messages)
+		if err != nil {
+			return count, err
+		}
+
+		count += len(messages)
+
+	}
+
+	return count, nil
+}
+
+// bleveTerm return exact term query on keyword field
+func bleveTerm(field, value string) query.Query {
+
+	q := bleve.NewTermQuery(value)
+	q.SetField(field)
+
+	return q
+}
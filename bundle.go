@@ -0,0 +1,695 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// bundleFormat format name written to bundle.json
+const bundleFormat = "gapp-bundle"
+
+// bundleVersion version of bundle layout
+const bundleVersion = 1
+
+// BundleInfo bundle.json, describe owner & files of bundle
+type BundleInfo struct {
+	Format  string         `json:"format"`
+	Version int            `json:"version"`
+	Owner   string         `json:"owner"`
+	Created time.Time      `json:"created"`
+	Files   map[string]int `json:"files"`
+}
+
+// BundleRawMessage raw message with original source
+type BundleRawMessage struct {
+	RawMessage
+	Source []byte `json:"source,omitempty"`
+}
+
+// BundleAttachment attachment with content in blob file
+type BundleAttachment struct {
+	Attachment
+	Data string `json:"data,omitempty"`
+	Blob string `json:"blob,omitempty"`
+}
+
+// BundleWriter write files of bundle & collect checksums
+type BundleWriter struct {
+	zw   *zip.Writer
+	sums bytes.Buffer
+	info BundleInfo
+}
+
+// File write file to bundle with checksum
+func (b *BundleWriter) File(name string, fn func(w io.Writer) error) error {
+
+	f, err := b.zw.CreateHeader(&zip.FileHeader{
+		Name:     name,
+		Method:   zip.Deflate,
+		Modified: time.Now(),
+	})
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+
+	err = fn(io.MultiWriter(f, h))
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(&b.sums, "%x  %s\n", h.Sum(nil), name)
+
+	return nil
+}
+
+// Lines write documents of query as JSON Lines file
+func (b *BundleWriter) Lines(name string, query *mgo.Query, next func() interface{}, out func(doc interface{}) (interface{}, error)) error {
+
+	return b.File(name, func(w io.Writer) error {
+
+		enc := json.NewEncoder(w)
+		iter := query.Iter()
+
+		for {
+
+			doc := next()
+			if !iter.Next(doc) {
+				break
+			}
+
+			line, err := out(doc)
+			if err != nil {
+				iter.Close()
+				return err
+			}
+
+			if err := enc.Encode(line); err != nil {
+				iter.Close()
+				return err
+			}
+
+			b.info.Files[name]++
+
+		}
+
+		return iter.Close()
+	})
+}
+
+// BundleBlobName return blob file name of attachment
+func BundleBlobName(attachID string) string {
+
+	sum := sha1.Sum([]byte(attachID))
+
+	return "attachments/" + hex.EncodeToString(sum[:])
+}
+
+// BundlePhotoName return blob file name of contact photo
+func BundlePhotoName(gridID bson.ObjectId) string {
+
+	return "photos/" + gridID.Hex()
+}
+
+// ExportBundle write whole account of owner as bundle, secrets are not exported
+func ExportBundle(DB *mgo.Session, export *Export, w io.Writer) error {
+
+	db := DB.DB(os.Getenv("MONGO_DB"))
+	owner := bson.M{"owner": export.Owner}
+
+	b := &BundleWriter{
+		zw: zip.NewWriter(w),
+		info: BundleInfo{
+			Format:  bundleFormat,
+			Version: bundleVersion,
+			Owner:   export.Owner,
+			Created: time.Now(),
+			Files:   make(map[string]int),
+		},
+	}
+
+	same := func(doc interface{}) (interface{}, error) { return doc, nil }
+
+	err := b.Lines("users.jsonl", db.C("users").Find(bson.M{"email": export.Owner}), func() interface{} { return &User{} }, func(doc interface{}) (interface{}, error) {
+
+		u := doc.(*User)
+		u.Password = ""
+		u.Credentials = nil
+		u.Config = nil
+		u.Token = nil
+
+		return u, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// imap password is not in json
+	err = b.Lines("syncers.jsonl", db.C("syncers").Find(owner), func() interface{} { return &Syncer{} }, same)
+	if err != nil {
+		return err
+	}
+
+	err = b.Lines("labels.jsonl", db.C("labels").Find(owner), func() interface{} { return &Label{} }, same)
+	if err != nil {
+		return err
+	}
+
+	err = b.Lines("contactGroups.jsonl", db.C("contactGroups").Find(owner), func() interface{} { return &ContactGroup{} }, same)
+	if err != nil {
+		return err
+	}
+
+	err = b.Lines("contactDuplicates.jsonl", db.C("contactDuplicates").Find(owner), func() interface{} { return &ContactDuplicate{} }, same)
+	if err != nil {
+		return err
+	}
+
+	err = b.Lines("contactEdits.jsonl", db.C("contactEdits").Find(owner), func() interface{} { return &ContactEdit{} }, same)
+	if err != nil {
+		return err
+	}
+
+	var photos []bson.ObjectId
+
+	err = b.Lines("contacts.jsonl", db.C("contacts").Find(owner), func() interface{} { return &Contact{} }, func(doc interface{}) (interface{}, error) {
+
+		for _, p := range doc.(*Contact).Photos {
+			if p.GridID != "" {
+				photos = append(photos, p.GridID)
+			}
+		}
+
+		return doc, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range photos {
+
+		gridFile, err := db.GridFS("contactPhotos").OpenId(id)
+		if err != nil {
+			return err
+		}
+
+		err = b.File(BundlePhotoName(id), func(w io.Writer) error {
+			_, err := io.Copy(w, gridFile)
+			return err
+		})
+		gridFile.Close()
+		if err != nil {
+			return err
+		}
+
+	}
+
+	err = b.Lines("threads.jsonl", db.C("threads").Find(owner), func() interface{} { return &Thread{} }, same)
+	if err != nil {
+		return err
+	}
+
+	err = b.Lines("messages.jsonl", db.C("messages").Find(owner), func() interface{} { return &Message{} }, same)
+	if err != nil {
+		return err
+	}
+
+	export.Count = b.info.Files["messages.jsonl"]
+	CRUDExport(*export)
+
+	err = b.Lines("messagesRaw.jsonl", db.C("messagesRaw").Find(owner), func() interface{} { return &RawMessage{} }, func(doc interface{}) (interface{}, error) {
+
+		raw := doc.(*RawMessage)
+
+		return BundleRawMessage{RawMessage: *raw, Source: raw.Source}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	var blobs []Attachment
+
+	err = b.Lines("attachments.jsonl", db.C("attachments").Find(owner).Select(bson.M{"data": 0}), func() interface{} { return &Attachment{} }, func(doc interface{}) (interface{}, error) {
+
+		a := doc.(*Attachment)
+		blobs = append(blobs, Attachment{AttachID: a.AttachID, Owner: a.Owner})
+
+		return BundleAttachment{Attachment: *a, Blob: BundleBlobName(a.AttachID)}, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, blob := range blobs {
+
+		var a Attachment
+		err := db.C("attachments").Find(bson.M{"owner": blob.Owner, "attachID": blob.AttachID}).One(&a)
+		if err != nil {
+			return err
+		}
+
+		data, err := AttachmentData(a)
+		if err != nil {
+			export.Missing++
+			data = nil
+		}
+
+		err = b.File(BundleBlobName(a.AttachID), func(w io.Writer) error {
+			_, err := w.Write(data)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+
+	}
+
+	err = b.File("bundle.json", func(w io.Writer) error {
+
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+
+		return enc.Encode(b.info)
+	})
+	if err != nil {
+		return err
+	}
+
+	f, err := b.zw.Create("manifest.sha256")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b.sums.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return b.zw.Close()
+}
+
+// ValidateBundle check bundle info & checksums of all files in manifest
+func ValidateBundle(zr *zip.Reader) (BundleInfo, map[string]*zip.File, error) {
+
+	var info BundleInfo
+
+	files := make(map[string]*zip.File)
+	for _, f := range zr.File {
+		files[f.Name] = f
+	}
+
+	manifest, ok := files["manifest.sha256"]
+	if !ok {
+		return info, files, errors.New("missing manifest.sha256")
+	}
+
+	rc, err := manifest.Open()
+	if err != nil {
+		return info, files, err
+	}
+	defer rc.Close()
+
+	listed := map[string]bool{"manifest.sha256": true}
+
+	scanner := bufio.NewScanner(rc)
+	for scanner.Scan() {
+
+		fields := strings.SplitN(scanner.Text(), "  ", 2)
+		if len(fields) != 2 {
+			return info, files, errors.New("invalid manifest line: " + scanner.Text())
+		}
+
+		f, ok := files[fields[1]]
+		if !ok {
+			return info, files, errors.New("missing file " + fields[1])
+		}
+
+		frc, err := f.Open()
+		if err != nil {
+			return info, files, err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, frc)
+		frc.Close()
+		if err != nil {
+			return info, files, err
+		}
+
+		if hex.EncodeToString(h.Sum(nil)) != fields[0] {
+			return info, files, errors.New("checksum mismatch of " + fields[1])
+		}
+
+		listed[fields[1]] = true
+
+	}
+
+	if err := scanner.Err(); err != nil {
+		return info, files, err
+	}
+
+	for name := range files {
+		if !listed[name] {
+			return info, files, errors.New("file not in manifest " + name)
+		}
+	}
+
+	f, ok := files["bundle.json"]
+	if !ok {
+		return info, files, errors.New("missing bundle.json")
+	}
+
+	irc, err := f.Open()
+	if err != nil {
+		return info, files, err
+	}
+	defer irc.Close()
+
+	if err := json.NewDecoder(irc).Decode(&info); err != nil {
+		return info, files, err
+	}
+
+	if info.Format != bundleFormat || info.Version > bundleVersion {
+		return info, files, fmt.Errorf("unsupported bundle %s version %d", info.Format, info.Version)
+	}
+
+	for name := range info.Files {
+		if _, ok := files[name]; !ok {
+			return info, files, errors.New("missing file " + name)
+		}
+	}
+
+	return info, files, nil
+}
+
+// ReadBundleLines call save for each document of JSON Lines file
+func ReadBundleLines(files map[string]*zip.File, name string, next func() interface{}, save func(doc interface{}) error) (int, error) {
+
+	f, ok := files[name]
+	if !ok {
+		return 0, nil
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	dec := json.NewDecoder(rc)
+	count := 0
+
+	for {
+
+		doc := next()
+
+		err := dec.Decode(doc)
+		if err == io.EOF {
+			return count, nil
+		}
+		if err != nil {
+			return count, fmt.Errorf("%s line %d: %v", name, count+1, err)
+		}
+
+		if err := save(doc); err != nil {
+			return count, err
+		}
+
+		count++
+
+	}
+
+}
+
+// ReadBundleBlob return content of blob file
+func ReadBundleBlob(files map[string]*zip.File, name string) ([]byte, error) {
+
+	f, ok := files[name]
+	if !ok {
+		return nil, errors.New("missing blob " + name)
+	}
+
+	rc, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+
+	var buf bytes.Buffer
+	_, err = io.Copy(&buf, rc)
+
+	return buf.Bytes(), err
+}
+
+// ImportBundle validate bundle & load it to database, documents get new owner when set
+// user without password get random one, which is returned
+func ImportBundle(filename, owner, password string) (map[string]int, string, error) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "ImportBundle",
+	}
+
+	defer SaveLog(proc)
+
+	counts := make(map[string]int)
+
+	zf, err := zip.OpenReader(filename)
+	if err != nil {
+		return counts, "", err
+	}
+	defer zf.Close()
+
+	info, files, err := ValidateBundle(&zf.Reader)
+	if err != nil {
+		return counts, "", err
+	}
+
+	if owner == "" {
+		owner = info.Owner
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	upsert := func(c string, query bson.M, doc interface{}) error {
+		_, err := db.C(c).Upsert(query, doc)
+		return err
+	}
+
+	// users are created only when missing
+	_, err = ReadBundleLines(files, "users.jsonl", func() interface{} { return &User{} }, func(doc interface{}) error {
+
+		u := doc.(*User)
+
+		if GetUserByEmail(owner).Email != "" {
+			return nil
+		}
+
+		if password == "" {
+			password = RandStringBytes(16)
+		}
+
+		CreateUser(User{
+			Email:    owner,
+			Password: HashAndSalt(password),
+			Created:  u.Created,
+		})
+
+		counts["users.jsonl"]++
+
+		return nil
+	})
+	if err != nil {
+		return counts, "", err
+	}
+
+	loads := []struct {
+		name string
+		next func() interface{}
+		save func(doc interface{}) error
+	}{
+		{"labels.jsonl", func() interface{} { return &Label{} }, func(doc interface{}) error {
+			l := doc.(*Label)
+			l.ID = ""
+			l.Owner = owner
+			return upsert("labels", bson.M{"owner": owner, "labelID": l.LabelID}, l)
+		}},
+		{"syncers.jsonl", func() interface{} { return &Syncer{} }, func(doc interface{}) error {
+			s := doc.(*Syncer)
+			s.ID = ""
+			s.Owner = owner
+			return upsert("syncers", bson.M{"owner": owner, "query": s.Query, "start": s.Start}, s)
+		}},
+		{"contactGroups.jsonl", func() interface{} { return &ContactGroup{} }, func(doc interface{}) error {
+			g := doc.(*ContactGroup)
+			g.ID = ""
+			g.Owner = owner
+			return upsert("contactGroups", bson.M{"owner": owner, "gid": g.GID}, g)
+		}},
+		{"contactDuplicates.jsonl", func() interface{} { return &ContactDuplicate{} }, func(doc interface{}) error {
+			d := doc.(*ContactDuplicate)
+			d.ID = ""
+			d.Owner = owner
+			return upsert("contactDuplicates", bson.M{"owner": owner, "key": d.Key}, d)
+		}},
+		{"contacts.jsonl", func() interface{} { return &Contact{} }, func(doc interface{}) error {
+			c := doc.(*Contact)
+			c.ID = ""
+			c.Owner = owner
+			for k, p := range c.Photos {
+
+				if p.GridID == "" {
+					continue
+				}
+
+				data, err := ReadBundleBlob(files, BundlePhotoName(p.GridID))
+				if err != nil {
+					return err
+				}
+
+				c.Photos[k].GridID, err = SaveContactPhoto(db, c.GID, p.ContentType, data)
+				if err != nil {
+					return err
+				}
+
+			}
+			return upsert("contacts", bson.M{"owner": owner, "gid": c.GID}, c)
+		}},
+		{"contactEdits.jsonl", func() interface{} { return &ContactEdit{} }, func(doc interface{}) error {
+			e := doc.(*ContactEdit)
+			e.ID = ""
+			e.Owner = owner
+			e.Values.Owner = owner
+			// edit link to contact with id of imported contact
+			var c Contact
+			db.C("contacts").Find(bson.M{"owner": owner, "gid": e.GID}).Select(bson.M{"_id": 1}).One(&c)
+			e.Values.ID = c.ID
+			return upsert("contactEdits", bson.M{"owner": owner, "gid": e.GID}, e)
+		}},
+		{"threads.jsonl", func() interface{} { return &Thread{} }, func(doc interface{}) error {
+			t := doc.(*Thread)
+			t.ID = ""
+			t.Owner = owner
+			return upsert("threads", bson.M{"owner": owner, "threadID": t.ThreadID}, t)
+		}},
+		{"messages.jsonl", func() interface{} { return &Message{} }, func(doc interface{}) error {
+			m := doc.(*Message)
+			m.ID = ""
+			m.Owner = owner
+			for k := range m.Embedded {
+				m.Embedded[k].Owner = owner
+			}
+			return upsert("messages", bson.M{"owner": owner, "msgID": m.MsgID, "threadID": m.ThreadID}, m)
+		}},
+		{"messagesRaw.jsonl", func() interface{} { return &BundleRawMessage{} }, func(doc interface{}) error {
+			raw := doc.(*BundleRawMessage)
+			raw.RawMessage.ID = ""
+			raw.RawMessage.Owner = owner
+			raw.RawMessage.Source = raw.Source
+			return upsert("messagesRaw", bson.M{"owner": owner, "msgID": raw.MsgID, "threadID": raw.ThreadID}, raw.RawMessage)
+		}},
+		{"attachments.jsonl", func() interface{} { return &BundleAttachment{} }, func(doc interface{}) error {
+
+			ba := doc.(*BundleAttachment)
+
+			data, err := ReadBundleBlob(files, ba.Blob)
+			if err != nil {
+				return err
+			}
+
+			a := ba.Attachment
+			a.ID = ""
+			a.GridID = ""
+			a.Owner = owner
+			a.Data = base64.URLEncoding.EncodeToString(data)
+			a.Size = int64(len(data))
+
+			// big attachments are saved to GridFS like synced ones
+			var wg sync.WaitGroup
+			wg.Add(1)
+			CRUDAttachment(a, &wg)
+
+			return nil
+		}},
+	}
+
+	for _, l := range loads {
+
+		count, err := ReadBundleLines(files, l.name, l.next, l.save)
+		counts[l.name] = count
+		if err != nil {
+			return counts, "", err
+		}
+
+	}
+
+	if _, err := searchBackend.Rebuild(owner); err != nil {
+		HandleError(proc, "rebuild search index", err, true)
+	}
+
+	if counts["users.jsonl"] == 0 {
+		password = ""
+	}
+
+	return counts, password, nil
+}
+
+// ImportBundleCommand command line import of bundle to database set by MONGO_DB
+//
+//	app import-bundle -owner new@example.com bundle.zip
+func ImportBundleCommand(args []string) {
+
+	fs := flag.NewFlagSet("import-bundle", flag.ExitOnError)
+	owner := fs.String("owner", "", "owner of imported documents, default is bundle owner")
+	password := fs.String("password", "", "password of created user, default is random")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		log.Fatal("usage: import-bundle [-owner email] [-password password] bundle.zip")
+	}
+
+	counts, pwd, err := ImportBundle(fs.Arg(0), *owner, *password)
+
+	var names []string
+	for name := range counts {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		log.Println(name, counts[name])
+	}
+
+	if err != nil {
+		log.Fatal("import bundle: ", err)
+	}
+
+	if pwd != "" {
+		log.Println("created user password", pwd)
+	}
+
+}
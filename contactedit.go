@@ -0,0 +1,695 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"google.golang.org/api/googleapi"
+	people "google.golang.org/api/people/v1"
+)
+
+// ContactEdit contact change made in app, pending until it is pushed to Google
+// edit is conflict when contact was changed or deleted in Google after it was synced
+type ContactEdit struct {
+	ID       bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner    string        `json:"owner" bson:"owner,omitempty"`
+	GID      string        `json:"gid" bson:"gid,omitempty"`
+	Action   string        `json:"action" bson:"action,omitempty"`
+	Etag     string        `json:"etag" bson:"etag,omitempty"`
+	Values   Contact       `json:"values" bson:"values,omitempty"`
+	Edited   time.Time     `json:"edited" bson:"edited,omitempty"`
+	Error    string        `json:"error" bson:"error,omitempty"`
+	Conflict bool          `json:"conflict" bson:"conflict,omitempty"`
+	Remote   *Contact      `json:"remote" bson:"remote,omitempty"`
+}
+
+// contactEditFields person fields which can be edited in app
+const contactEditFields = "names,emailAddresses,phoneNumbers,organizations,urls,biographies,birthdays"
+
+// localContactPrefix GID prefix of contacts created in app, not yet created in Google
+const localContactPrefix = "local/"
+
+// EtagConflict check if api refused change because person was changed after etag
+// other failed preconditions, like read only fields, are errors of edit
+func EtagConflict(err error) bool {
+
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+
+	return gerr.Code == 412 || (gerr.Code == 400 && strings.Contains(strings.ToLower(gerr.Message), "etag"))
+}
+
+// ContactNotFound check if api didn't find person
+func ContactNotFound(err error) bool {
+
+	gerr, ok := err.(*googleapi.Error)
+
+	return ok && gerr.Code == 404
+}
+
+// ParseContactValues parse lines of "type: value" or "value"
+func ParseContactValues(text string) []ContactValue {
+
+	var values []ContactValue
+
+	for _, line := range strings.Split(text, "\n") {
+
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+
+		v := ContactValue{Value: line}
+
+		// value can contain colon, like url
+		if i := strings.Index(line, ": "); i > 0 && !strings.Contains(line[:i], " ") {
+			v.Type = line[:i]
+			v.Value = strings.TrimSpace(line[i+2:])
+		}
+
+		values = append(values, v)
+
+	}
+
+	if len(values) != 0 {
+		values[0].Primary = true
+	}
+
+	return values
+}
+
+// FormatContactValues return own values as lines of "type: value"
+func FormatContactValues(values []ContactValue) string {
+
+	var lines []string
+
+	for _, v := range values {
+
+		if v.From != "" {
+			continue
+		}
+
+		if v.Type != "" {
+			lines = append(lines, v.Type+": "+v.Value)
+		} else {
+			lines = append(lines, v.Value)
+		}
+
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// ContactEditValues return values of edit form
+func ContactEditValues(form func(string) string) Contact {
+
+	c := Contact{
+		FirstName:  strings.TrimSpace(form("firstName")),
+		MiddleName: strings.TrimSpace(form("middleName")),
+		LastName:   strings.TrimSpace(form("lastName")),
+		Prefix:     strings.TrimSpace(form("prefix")),
+		Suffix:     strings.TrimSpace(form("suffix")),
+		Emails:     ParseContactValues(form("emails")),
+		Phones:     ParseContactValues(form("phones")),
+		URLs:       ParseContactValues(form("urls")),
+		Biography:  strings.TrimSpace(form("biography")),
+	}
+
+	org := ContactOrganization{
+		Name:       strings.TrimSpace(form("company")),
+		Title:      strings.TrimSpace(form("title")),
+		Department: strings.TrimSpace(form("department")),
+	}
+	if org.Name != "" || org.Title != "" || org.Department != "" {
+		c.Organizations = []ContactOrganization{org}
+	}
+
+	if birthday := strings.TrimSpace(form("birthday")); birthday != "" {
+		c.Birthdays = []string{birthday}
+	}
+
+	return ContactPrimaryValues(c)
+}
+
+// ApplyContactEdit set edited values on contact, merged values are kept
+func ApplyContactEdit(c, values Contact) Contact {
+
+	merged := func(list []ContactValue) []ContactValue {
+		var kept []ContactValue
+		for _, v := range list {
+			if v.From != "" {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	}
+
+	c.FirstName, c.MiddleName, c.LastName, c.Prefix, c.Suffix = values.FirstName, values.MiddleName, values.LastName, values.Prefix, values.Suffix
+	c.Emails = append(values.Emails, merged(c.Emails)...)
+	c.Phones = append(values.Phones, merged(c.Phones)...)
+	c.URLs = append(values.URLs, merged(c.URLs)...)
+	c.Biography = values.Biography
+	c.Birthdays = values.Birthdays
+
+	// other organizations are not edited
+	organizations := values.Organizations
+	for i, o := range c.Organizations {
+		if i > 0 || o.From != "" {
+			organizations = append(organizations, o)
+		}
+	}
+	c.Organizations = organizations
+
+	for _, field := range []string{"name", "birthdays", "biography"} {
+		delete(c.Provenance, field)
+	}
+
+	return ContactPrimaryValues(c)
+}
+
+// ContactPerson return person with edited fields of contact, merged values are not sent
+func ContactPerson(c Contact) *people.Person {
+
+	person := &people.Person{
+		ResourceName: c.GID,
+		Etag:         c.Etag,
+	}
+
+	if c.FirstName != "" || c.LastName != "" || c.MiddleName != "" || c.Prefix != "" || c.Suffix != "" {
+		person.Names = []*people.Name{{
+			GivenName:       c.FirstName,
+			MiddleName:      c.MiddleName,
+			FamilyName:      c.LastName,
+			HonorificPrefix: c.Prefix,
+			HonorificSuffix: c.Suffix,
+		}}
+	}
+
+	for _, e := range c.Emails {
+		if e.From == "" {
+			person.EmailAddresses = append(person.EmailAddresses, &people.EmailAddress{Value: e.Value, Type: e.Type})
+		}
+	}
+
+	for _, p := range c.Phones {
+		if p.From == "" {
+			person.PhoneNumbers = append(person.PhoneNumbers, &people.PhoneNumber{Value: p.Value, Type: p.Type})
+		}
+	}
+
+	for _, o := range c.Organizations {
+		if o.From == "" {
+			person.Organizations = append(person.Organizations, &people.Organization{Name: o.Name, Title: o.Title, Department: o.Department, Type: o.Type})
+		}
+	}
+
+	for _, u := range c.URLs {
+		if u.From == "" {
+			person.Urls = append(person.Urls, &people.Url{Value: u.Value, Type: u.Type})
+		}
+	}
+
+	if c.Biography != "" {
+		person.Biographies = []*people.Biography{{Value: c.Biography, ContentType: "TEXT_PLAIN"}}
+	}
+
+	if len(c.Birthdays) != 0 {
+		person.Birthdays = []*people.Birthday{PersonBirthday(c.Birthdays[0])}
+	}
+
+	return person
+}
+
+// PersonBirthday return birthday of YYYY-MM-DD, --MM-DD or text value
+func PersonBirthday(value string) *people.Birthday {
+
+	if m := vcardBirthday.FindStringSubmatch(value); m != nil {
+
+		date := &people.Date{}
+		date.Month, _ = strconv.ParseInt(m[2], 10, 64)
+		date.Day, _ = strconv.ParseInt(m[3], 10, 64)
+		if m[1] != "-" {
+			date.Year, _ = strconv.ParseInt(m[1], 10, 64)
+		}
+
+		return &people.Birthday{Date: date}
+	}
+
+	return &people.Birthday{Text: value}
+}
+
+// GetContactEdit return pending edit of contact
+func GetContactEdit(owner, gid string) (ContactEdit, bool) {
+
+	var edit ContactEdit
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	err := DB.DB(os.Getenv("MONGO_DB")).C("contactEdits").Find(bson.M{"owner": owner, "gid": gid}).One(&edit)
+
+	return edit, err == nil
+}
+
+// GetContactEdits return pending edits of owner, conflicts first
+func GetContactEdits(owner string) []ContactEdit {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetContactEdits",
+	}
+
+	defer SaveLog(proc)
+
+	var edits []ContactEdit
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	err := DB.DB(os.Getenv("MONGO_DB")).C("contactEdits").Find(bson.M{"owner": owner}).Sort("-conflict", "edited").All(&edits)
+	if err != nil {
+		HandleError(proc, "get contact edits", err, true)
+	}
+
+	return edits
+}
+
+// SaveContactEdit save pending edit
+func SaveContactEdit(edit ContactEdit) error {
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	edit.ID = ""
+
+	_, err := DB.DB(os.Getenv("MONGO_DB")).C("contactEdits").Upsert(bson.M{"owner": edit.Owner, "gid": edit.GID}, edit)
+
+	return err
+}
+
+// RemoveContactEdit remove pushed or discarded edit
+func RemoveContactEdit(owner, gid string) error {
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	_, err := DB.DB(os.Getenv("MONGO_DB")).C("contactEdits").RemoveAll(bson.M{"owner": owner, "gid": gid})
+
+	return err
+}
+
+// EditContact save edit of contact & push it to Google, edit stay pending when push fail
+// new contact is saved with local GID until it is created in Google
+func EditContact(user User, gid, action string, values Contact) (ContactEdit, error) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "EditContact",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("contacts")
+
+	var c Contact
+
+	if action == "create" {
+
+		c = Contact{
+			ID:     bson.NewObjectId(),
+			GID:    localContactPrefix + bson.NewObjectId().Hex(),
+			Owner:  user.Email,
+			Source: "connections",
+		}
+
+		if err := DBC.Insert(c); err != nil {
+			return ContactEdit{}, err
+		}
+
+	} else if err := DBC.Find(bson.M{"owner": user.Email, "gid": gid}).One(&c); err != nil {
+		return ContactEdit{}, err
+	}
+
+	if c.Source == otherContactsGroup || c.MergedInto != "" {
+		return ContactEdit{}, errors.New("contact can't be edited")
+	}
+
+	edit, ok := GetContactEdit(user.Email, c.GID)
+	if ok && edit.Conflict {
+		return edit, errors.New("resolve conflict with Google first")
+	}
+
+	if !ok {
+		edit = ContactEdit{Owner: user.Email, GID: c.GID, Action: action, Etag: c.Etag}
+	}
+
+	// contact created in app & not yet in Google is created with edited values
+	if edit.Action != "create" || action == "delete" {
+		edit.Action = action
+	}
+
+	edit.Edited = time.Now()
+
+	if action == "delete" {
+
+		edit.Values = c
+		SoftDeleteContacts(bson.M{"owner": user.Email, "gid": c.GID})
+
+	} else {
+
+		c = ApplyContactEdit(c, values)
+		edit.Values = c
+
+		if err := SaveContactValues(c); err != nil {
+			return edit, err
+		}
+
+	}
+
+	if err := SaveContactEdit(edit); err != nil {
+		return edit, err
+	}
+
+	svc := GetPeopleService(user)
+	if svc == nil {
+		return edit, errors.New("unable to create people service")
+	}
+
+	return PushContactEdit(svc, user, edit)
+}
+
+// PushContactEdit push pending edit to Google, edit is marked as conflict when etag of contact changed
+func PushContactEdit(svc *people.Service, user User, edit ContactEdit) (ContactEdit, error) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "PushContactEdit",
+	}
+
+	defer SaveLog(proc)
+
+	local := strings.HasPrefix(edit.GID, localContactPrefix)
+
+	var person *people.Person
+	var err error
+
+	switch {
+	case edit.Action == "delete" && local:
+
+		// contact was never created in Google
+
+	case edit.Action == "delete":
+
+		// delete has no etag, contact is checked first
+		person, err = svc.People.Get(edit.GID).PersonFields(contactPersonFields).Do()
+		if err == nil && person.Etag != edit.Etag {
+			return ContactEditConflict(edit, person, user.Email)
+		}
+
+		if err == nil {
+			_, err = svc.People.DeleteContact(edit.GID).Do()
+		}
+
+		if ContactNotFound(err) {
+			err = nil
+		}
+
+		person = nil
+
+	case edit.Action == "create" || local:
+
+		values := edit.Values
+		values.GID, values.Etag = "", ""
+
+		person, err = svc.People.CreateContact(ContactPerson(values)).PersonFields(contactPersonFields).Do()
+
+	default:
+
+		values := edit.Values
+		values.Etag = edit.Etag
+
+		person, err = svc.People.UpdateContact(edit.GID, ContactPerson(values)).UpdatePersonFields(contactEditFields).PersonFields(contactPersonFields).Do()
+
+		if err != nil && EtagConflict(err) {
+
+			person, err = svc.People.Get(edit.GID).PersonFields(contactPersonFields).Do()
+			if err == nil || ContactNotFound(err) {
+				return ContactEditConflict(edit, person, user.Email)
+			}
+		}
+
+		if err != nil && ContactNotFound(err) {
+			return ContactEditConflict(edit, nil, user.Email)
+		}
+
+	}
+
+	if err != nil {
+
+		edit.Error = err.Error()
+		SaveContactEdit(edit)
+
+		return edit, err
+	}
+
+	if person != nil {
+
+		c := PersonContact(person, user.Email)
+		c.Source = "connections"
+		c.Synced = time.Now()
+
+		// local contact is replaced by created contact
+		if local {
+			RemoveContacts(user.Email, edit.GID)
+		}
+
+		SaveContacts(SaveContactPhotos([]Contact{c}))
+		ApplyContactMerges(user.Email)
+
+	}
+
+	if local && edit.Action == "delete" {
+		RemoveContacts(user.Email, edit.GID)
+	}
+
+	RemoveContactEdit(user.Email, edit.GID)
+
+	edit.Error = ""
+
+	return edit, nil
+}
+
+// ContactEditConflict save edit as conflict with contact in Google, remote is nil when contact was deleted
+func ContactEditConflict(edit ContactEdit, remote *people.Person, owner string) (ContactEdit, error) {
+
+	edit.Conflict = true
+	edit.Error = "contact was deleted in Google"
+	edit.Remote = nil
+
+	if remote != nil {
+		c := PersonContact(remote, owner)
+		edit.Remote = &c
+		edit.Error = "contact was changed in Google"
+	}
+
+	if err := SaveContactEdit(edit); err != nil {
+		return edit, err
+	}
+
+	return edit, errors.New(edit.Error)
+}
+
+// ResolveContactEdit resolve conflict, keep push edit over Google version, otherwise Google version is used
+func ResolveContactEdit(user User, gid string, keep bool) error {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "ResolveContactEdit",
+	}
+
+	defer SaveLog(proc)
+
+	edit, ok := GetContactEdit(user.Email, gid)
+	if !ok {
+		return errors.New("edit not found")
+	}
+
+	if !keep {
+
+		RemoveContactEdit(user.Email, gid)
+
+		if edit.Remote == nil {
+			SoftDeleteContacts(bson.M{"owner": user.Email, "gid": gid})
+			return nil
+		}
+
+		c := *edit.Remote
+		c.Source = "connections"
+		c.Synced = time.Now()
+
+		SaveContacts(SaveContactPhotos([]Contact{c}))
+		ApplyContactMerges(user.Email)
+
+		return nil
+	}
+
+	// edited values are pushed over Google version, deleted contact is created again
+	edit.Conflict = false
+	edit.Error = ""
+
+	if edit.Remote != nil {
+		edit.Etag = edit.Remote.Etag
+	} else if edit.Action != "delete" {
+		edit.Action = "create"
+	}
+
+	edit.Remote = nil
+
+	if err := SaveContactEdit(edit); err != nil {
+		return err
+	}
+
+	svc := GetPeopleService(user)
+	if svc == nil {
+		return errors.New("unable to create people service")
+	}
+
+	_, err := PushContactEdit(svc, user, edit)
+
+	return err
+}
+
+// PushContactEdits push pending edits of owner, conflicts wait for user
+func PushContactEdits(svc *people.Service, user User) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "PushContactEdits",
+	}
+
+	defer SaveLog(proc)
+
+	for _, edit := range GetContactEdits(user.Email) {
+
+		if edit.Conflict {
+			continue
+		}
+
+		if _, err := PushContactEdit(svc, user, edit); err != nil {
+			HandleError(proc, "push contact edit "+edit.GID, err, true)
+		}
+
+	}
+
+}
+
+// HoldEditedContacts return synced contacts without pending edits
+// contact changed in Google after edit is reported as conflict instead of saving it over edit
+func HoldEditedContacts(owner string, contacts []Contact) []Contact {
+
+	var kept []Contact
+
+	for _, c := range contacts {
+
+		edit, ok := GetContactEdit(owner, c.GID)
+		if !ok {
+			kept = append(kept, c)
+			continue
+		}
+
+		// held contact is listed, it is not soft deleted by full sync
+		DB := MongoSession()
+		DB.DB(os.Getenv("MONGO_DB")).C("contacts").Update(bson.M{"owner": owner, "gid": c.GID}, bson.M{"$set": bson.M{"synced": c.Synced}})
+		DB.Close()
+
+		if c.Etag != edit.Etag {
+			remote := c
+			edit.Conflict = true
+			edit.Error = "contact was changed in Google"
+			edit.Remote = &remote
+			SaveContactEdit(edit)
+		}
+
+	}
+
+	return kept
+}
+
+// HoldDeletedContact report contact deleted in Google with pending edit as conflict, deleted contact is not held
+func HoldDeletedContact(owner, gid string) bool {
+
+	edit, ok := GetContactEdit(owner, gid)
+	if !ok {
+		return false
+	}
+
+	if edit.Action == "delete" {
+		RemoveContactEdit(owner, gid)
+		return false
+	}
+
+	ContactEditConflict(edit, nil, owner)
+
+	return true
+}
+
+// HoldUnlistedContacts report edited contacts not listed by full sync as conflicts
+// return GIDs of edited contacts, they are not soft deleted, other contacts are not edited
+func HoldUnlistedContacts(owner, source string, start time.Time) []string {
+
+	gids := []string{}
+
+	if source == otherContactsGroup {
+		return gids
+	}
+
+	for _, edit := range GetContactEdits(owner) {
+
+		gids = append(gids, edit.GID)
+
+		if strings.HasPrefix(edit.GID, localContactPrefix) {
+			continue
+		}
+
+		var c Contact
+
+		DB := MongoSession()
+		err := DB.DB(os.Getenv("MONGO_DB")).C("contacts").Find(bson.M{"owner": owner, "gid": edit.GID}).Select(bson.M{"synced": 1}).One(&c)
+		DB.Close()
+
+		if err == nil && c.Synced.Before(start) {
+			HoldDeletedContact(owner, edit.GID)
+		}
+
+	}
+
+	return gids
+}
+
+// RemoveContacts remove contacts by GID
+func RemoveContacts(owner, gid string) {
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	DB.DB(os.Getenv("MONGO_DB")).C("contacts").RemoveAll(bson.M{"owner": owner, "gid": gid})
+
+}
@@ -0,0 +1,876 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ContactDuplicate possible duplicate of contact with other contact or correspondent
+// merged & dismissed duplicates are kept, so they are not found again
+type ContactDuplicate struct {
+	ID       bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner    string        `json:"owner" bson:"owner,omitempty"`
+	Key      string        `json:"key" bson:"key,omitempty"`
+	Kind     string        `json:"kind" bson:"kind,omitempty"`
+	GIDs     []string      `json:"gids" bson:"gids,omitempty"`
+	Email    string        `json:"email" bson:"email,omitempty"`
+	Reasons  []string      `json:"reasons" bson:"reasons,omitempty"`
+	Score    int           `json:"score" bson:"score,omitempty"`
+	Status   string        `json:"status" bson:"status,omitempty"`
+	Primary  string        `json:"primary" bson:"primary,omitempty"`
+	Found    time.Time     `json:"found" bson:"found,omitempty"`
+	Decided  time.Time     `json:"decided" bson:"decided,omitempty"`
+	Contacts []Contact     `json:"-" bson:"-"`
+}
+
+// duplicateScores score of each duplicate reason
+var duplicateScores = map[string]int{
+	"email":   3,
+	"phone":   2,
+	"company": 2,
+	"name":    1,
+}
+
+// nameFold latin letters with diacritics folded for name comparison
+var nameFold = strings.NewReplacer(
+	"č", "c", "ć", "c", "ç", "c", "ž", "z", "š", "s", "đ", "d", "ð", "d",
+	"á", "a", "à", "a", "ä", "a", "â", "a", "ã", "a", "å", "a", "ą", "a",
+	"é", "e", "è", "e", "ë", "e", "ê", "e", "ę", "e", "ě", "e",
+	"í", "i", "ì", "i", "ï", "i", "î", "i",
+	"ó", "o", "ò", "o", "ö", "o", "ô", "o", "õ", "o", "ø", "o", "ő", "o",
+	"ú", "u", "ù", "u", "ü", "u", "û", "u", "ů", "u", "ű", "u",
+	"ñ", "n", "ń", "n", "ň", "n", "ł", "l", "ř", "r", "ť", "t", "ý", "y", "ß", "ss",
+)
+
+// NormalizeEmail return lowercase email, dots & +tag are removed from gmail addresses
+func NormalizeEmail(email string) string {
+
+	email = strings.ToLower(strings.TrimSpace(email))
+
+	at := strings.LastIndex(email, "@")
+	if at < 1 {
+		return email
+	}
+
+	local, domain := email[:at], email[at+1:]
+
+	if domain == "gmail.com" || domain == "googlemail.com" {
+
+		if plus := strings.Index(local, "+"); plus > 0 {
+			local = local[:plus]
+		}
+
+		local = strings.Replace(local, ".", "", -1)
+		domain = "gmail.com"
+
+	}
+
+	return local + "@" + domain
+}
+
+// NormalizePhone return last 9 digits of phone, so numbers with & without country code match
+func NormalizePhone(phone string) string {
+
+	var digits []rune
+	for _, r := range phone {
+		if r >= '0' && r <= '9' {
+			digits = append(digits, r)
+		}
+	}
+
+	if len(digits) < 7 {
+		return ""
+	}
+
+	if len(digits) > 9 {
+		digits = digits[len(digits)-9:]
+	}
+
+	return string(digits)
+}
+
+// NormalizeName return lowercase name words without diacritics, sorted
+func NormalizeName(name string) string {
+
+	words := strings.FieldsFunc(nameFold.Replace(strings.ToLower(name)), func(r rune) bool {
+		return !unicode.IsLetter(r)
+	})
+
+	sort.Strings(words)
+
+	return strings.Join(words, " ")
+}
+
+// NameDistance return edit distance of two names
+func NameDistance(a, b string) int {
+
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+
+		cur := make([]int, len(rb)+1)
+		cur[0] = i
+
+		for j := 1; j <= len(rb); j++ {
+
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = cur[j-1] + 1
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if prev[j-1]+cost < cur[j] {
+				cur[j] = prev[j-1] + cost
+			}
+
+		}
+
+		prev = cur
+
+	}
+
+	return prev[len(rb)]
+}
+
+// SimilarNames check if normalized names are same or differ by typo, names must have two words
+func SimilarNames(a, b string) bool {
+
+	if a == "" || b == "" || !strings.Contains(a, " ") || !strings.Contains(b, " ") {
+		return false
+	}
+
+	if a == b {
+		return true
+	}
+
+	max := 1
+	if len(a) >= 12 {
+		max = 2
+	}
+
+	return NameDistance(a, b) <= max
+}
+
+// ContactEmails return normalized emails of contact
+func ContactEmails(c Contact) []string {
+
+	var emails []string
+	seen := make(map[string]bool)
+
+	for _, e := range append([]ContactValue{{Value: c.Email}}, c.Emails...) {
+		if n := NormalizeEmail(e.Value); n != "" && !seen[n] {
+			seen[n] = true
+			emails = append(emails, n)
+		}
+	}
+
+	return emails
+}
+
+// ContactPhones return normalized phones of contact
+func ContactPhones(c Contact) []string {
+
+	var phones []string
+	seen := make(map[string]bool)
+
+	for _, p := range append([]ContactValue{{Value: c.Phone}}, c.Phones...) {
+		if n := NormalizePhone(p.Value); n != "" && !seen[n] {
+			seen[n] = true
+			phones = append(phones, n)
+		}
+	}
+
+	return phones
+}
+
+// DuplicateKey return key of duplicate pair, same for any order
+func DuplicateKey(a, b string) string {
+
+	if b < a {
+		a, b = b, a
+	}
+
+	return a + "|" + b
+}
+
+// FindContactDuplicates find possible duplicates of contacts by normalized email, phone,
+// similar name with same company or same name, and correspondents not in contacts with same name
+func FindContactDuplicates(owner string) []ContactDuplicate {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "FindContactDuplicates",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	var contacts []Contact
+	err := db.C("contacts").Find(bson.M{
+		"owner":      owner,
+		"deleted":    bson.M{"$exists": false},
+		"mergedInto": bson.M{"$exists": false},
+	}).Select(bson.M{
+		"gid":       1,
+		"firstName": 1,
+		"lastName":  1,
+		"company":   1,
+		"email":     1,
+		"emails":    1,
+		"phone":     1,
+		"phones":    1,
+	}).All(&contacts)
+	if err != nil {
+		HandleError(proc, "get contacts", err, true)
+		return nil
+	}
+
+	pairs := make(map[string]*ContactDuplicate)
+
+	add := func(a, b Contact, reason string) {
+
+		if a.GID == b.GID {
+			return
+		}
+
+		key := DuplicateKey(a.GID, b.GID)
+
+		d, ok := pairs[key]
+		if !ok {
+			d = &ContactDuplicate{Owner: owner, Key: key, Kind: "contact", GIDs: []string{a.GID, b.GID}}
+			pairs[key] = d
+		}
+
+		for _, r := range d.Reasons {
+			if r == reason {
+				return
+			}
+		}
+
+		d.Reasons = append(d.Reasons, reason)
+		d.Score += duplicateScores[reason]
+	}
+
+	// same email or phone
+	for _, index := range []struct {
+		reason string
+		values func(c Contact) []string
+	}{
+		{"email", ContactEmails},
+		{"phone", ContactPhones},
+	} {
+
+		byValue := make(map[string][]Contact)
+
+		for _, c := range contacts {
+			for _, v := range index.values(c) {
+				byValue[v] = append(byValue[v], c)
+			}
+		}
+
+		for _, same := range byValue {
+			for i := 0; i < len(same); i++ {
+				for j := i + 1; j < len(same); j++ {
+					add(same[i], same[j], index.reason)
+				}
+			}
+		}
+
+	}
+
+	// similar name with same company, or same name
+	names := make(map[string]string)
+	byCompany := make(map[string][]Contact)
+	byName := make(map[string][]Contact)
+
+	for _, c := range contacts {
+
+		names[c.GID] = NormalizeName(c.FirstName + " " + c.LastName)
+
+		if company := NormalizeName(c.Company); company != "" {
+			byCompany[company] = append(byCompany[company], c)
+		}
+
+		if strings.Contains(names[c.GID], " ") {
+			byName[names[c.GID]] = append(byName[names[c.GID]], c)
+		}
+
+	}
+
+	for _, same := range byCompany {
+		for i := 0; i < len(same); i++ {
+			for j := i + 1; j < len(same); j++ {
+				if SimilarNames(names[same[i].GID], names[same[j].GID]) {
+					add(same[i], same[j], "company")
+				}
+			}
+		}
+	}
+
+	for _, same := range byName {
+		for i := 0; i < len(same); i++ {
+			for j := i + 1; j < len(same); j++ {
+				add(same[i], same[j], "name")
+			}
+		}
+	}
+
+	var duplicates []ContactDuplicate
+	for _, d := range pairs {
+		duplicates = append(duplicates, *d)
+	}
+
+	// correspondents not in contacts with same name as contact
+	var correspondent Correspondent
+	iter := db.C("correspondents").Find(bson.M{
+		"owner":     owner,
+		"contactID": bson.M{"$exists": false},
+		"names":     bson.M{"$exists": true},
+	}).Select(bson.M{"email": 1, "names": 1}).Iter()
+
+	for iter.Next(&correspondent) {
+
+		for _, name := range correspondent.Names {
+
+			same := byName[NormalizeName(name)]
+			if len(same) != 1 {
+				continue
+			}
+
+			duplicates = append(duplicates, ContactDuplicate{
+				Owner:   owner,
+				Key:     DuplicateKey(same[0].GID, "mailto:"+correspondent.Email),
+				Kind:    "correspondent",
+				GIDs:    []string{same[0].GID},
+				Email:   correspondent.Email,
+				Reasons: []string{"name"},
+				Score:   duplicateScores["name"],
+			})
+
+			break
+
+		}
+
+		correspondent = Correspondent{}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "iterate correspondents", err, true)
+	}
+
+	return duplicates
+}
+
+// DetectContactDuplicates save found duplicates for review, decided duplicates are not opened again
+func DetectContactDuplicates(syncer Syncer) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "DetectContactDuplicates",
+	}
+
+	defer SaveLog(proc)
+
+	syncer.Status = "start"
+	CRUDSyncer(syncer)
+
+	start := time.Now()
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("contactDuplicates")
+
+	for _, d := range FindContactDuplicates(syncer.Owner) {
+
+		var saved ContactDuplicate
+		err := DBC.Find(bson.M{"owner": d.Owner, "key": d.Key}).One(&saved)
+		if err == nil && saved.Status != "open" {
+			continue
+		}
+
+		d.Status = "open"
+		d.Found = start
+
+		_, err = DBC.Upsert(bson.M{"owner": d.Owner, "key": d.Key}, d)
+		if err != nil {
+			HandleError(proc, "save duplicate "+d.Key, err, true)
+			continue
+		}
+
+		syncer.Count++
+
+	}
+
+	// open duplicates not found again are not duplicates anymore
+	_, err := DBC.RemoveAll(bson.M{"owner": syncer.Owner, "status": "open", "found": bson.M{"$lt": start}})
+	if err != nil {
+		HandleError(proc, "remove duplicates", err, true)
+	}
+
+	syncer.End = time.Now()
+	syncer.Status = "end"
+	CRUDSyncer(syncer)
+
+}
+
+// GetContactDuplicates return duplicates of owner by status with contacts, best matches first
+func GetContactDuplicates(owner, status string) []ContactDuplicate {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetContactDuplicates",
+	}
+
+	defer SaveLog(proc)
+
+	var duplicates []ContactDuplicate
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	err := db.C("contactDuplicates").Find(bson.M{"owner": owner, "status": status}).Sort("-score", "-decided").Limit(200).All(&duplicates)
+	if err != nil {
+		HandleError(proc, "get duplicates", err, true)
+		return duplicates
+	}
+
+	for i, d := range duplicates {
+
+		for _, gid := range d.GIDs {
+
+			var c Contact
+			if db.C("contacts").Find(bson.M{"owner": owner, "gid": gid}).One(&c) == nil {
+				duplicates[i].Contacts = append(duplicates[i].Contacts, c)
+			}
+
+		}
+
+	}
+
+	return duplicates
+}
+
+// StripMerged remove values merged from contact or correspondent
+func StripMerged(c Contact, from string) Contact {
+
+	values := func(list []ContactValue) []ContactValue {
+		var kept []ContactValue
+		for _, v := range list {
+			if v.From != from {
+				kept = append(kept, v)
+			}
+		}
+		return kept
+	}
+
+	c.Emails = values(c.Emails)
+	c.Phones = values(c.Phones)
+	c.URLs = values(c.URLs)
+	c.Relations = values(c.Relations)
+
+	var addresses []ContactAddress
+	for _, a := range c.Addresses {
+		if a.From != from {
+			addresses = append(addresses, a)
+		}
+	}
+	c.Addresses = addresses
+
+	var organizations []ContactOrganization
+	for _, o := range c.Organizations {
+		if o.From != from {
+			organizations = append(organizations, o)
+		}
+	}
+	c.Organizations = organizations
+
+	for field, source := range c.Provenance {
+
+		if source != from {
+			continue
+		}
+
+		switch field {
+		case "name":
+			c.FirstName, c.MiddleName, c.LastName, c.Prefix, c.Suffix = "", "", "", "", ""
+		case "birthdays":
+			c.Birthdays = nil
+		case "biography":
+			c.Biography = ""
+		}
+
+		delete(c.Provenance, field)
+
+	}
+
+	return ContactPrimaryValues(c)
+}
+
+// ContactPrimaryValues set primary email, phone, company & title from lists
+func ContactPrimaryValues(c Contact) Contact {
+
+	c.Email = PrimaryContactValue(c.Emails)
+	c.Phone = PrimaryContactValue(c.Phones)
+	c.Company, c.Title = "", ""
+
+	if len(c.Organizations) != 0 {
+		c.Company = c.Organizations[0].Name
+		c.Title = c.Organizations[0].Title
+	}
+
+	return c
+}
+
+// MergeContact add values of duplicate to contact, values which contact has are skipped
+// each added value keep GID of duplicate, so merge can be applied again or undone
+func MergeContact(c, dup Contact) Contact {
+
+	c = StripMerged(c, dup.GID)
+
+	if c.Provenance == nil {
+		c.Provenance = make(map[string]string)
+	}
+
+	values := func(list, add []ContactValue, normalize func(string) string) []ContactValue {
+
+		has := make(map[string]bool)
+		for _, v := range list {
+			has[normalize(v.Value)] = true
+		}
+
+		for _, v := range add {
+
+			if has[normalize(v.Value)] {
+				continue
+			}
+
+			has[normalize(v.Value)] = true
+			v.Primary = false
+			v.From = dup.GID
+			list = append(list, v)
+
+		}
+
+		return list
+	}
+
+	same := func(v string) string { return strings.ToLower(strings.TrimSpace(v)) }
+
+	c.Emails = values(c.Emails, dup.Emails, NormalizeEmail)
+	c.Phones = values(c.Phones, dup.Phones, func(v string) string {
+		if n := NormalizePhone(v); n != "" {
+			return n
+		}
+		return v
+	})
+	c.URLs = values(c.URLs, dup.URLs, same)
+	c.Relations = values(c.Relations, dup.Relations, same)
+
+	has := make(map[string]bool)
+	for _, a := range c.Addresses {
+		has[same(a.Formatted)] = true
+	}
+	for _, a := range dup.Addresses {
+		if !has[same(a.Formatted)] {
+			has[same(a.Formatted)] = true
+			a.From = dup.GID
+			c.Addresses = append(c.Addresses, a)
+		}
+	}
+
+	has = make(map[string]bool)
+	for _, o := range c.Organizations {
+		has[same(o.Name+"|"+o.Title)] = true
+	}
+	for _, o := range dup.Organizations {
+		if !has[same(o.Name+"|"+o.Title)] {
+			has[same(o.Name+"|"+o.Title)] = true
+			o.From = dup.GID
+			c.Organizations = append(c.Organizations, o)
+		}
+	}
+
+	if c.FirstName == "" && c.LastName == "" && (dup.FirstName != "" || dup.LastName != "") {
+		c.FirstName, c.MiddleName, c.LastName, c.Prefix, c.Suffix = dup.FirstName, dup.MiddleName, dup.LastName, dup.Prefix, dup.Suffix
+		c.Provenance["name"] = dup.GID
+	}
+
+	if len(c.Birthdays) == 0 && len(dup.Birthdays) != 0 {
+		c.Birthdays = dup.Birthdays
+		c.Provenance["birthdays"] = dup.GID
+	}
+
+	if c.Biography == "" && dup.Biography != "" {
+		c.Biography = dup.Biography
+		c.Provenance["biography"] = dup.GID
+	}
+
+	return ContactPrimaryValues(c)
+}
+
+// CorrespondentContact return correspondent as contact which can be merged
+func CorrespondentContact(email string) Contact {
+
+	return Contact{
+		GID:    "mailto:" + email,
+		Emails: []ContactValue{{Value: email, Type: "other"}},
+	}
+}
+
+// SaveContactValues save values of merged or edited contact
+func SaveContactValues(c Contact) error {
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	return DB.DB(os.Getenv("MONGO_DB")).C("contacts").Update(bson.M{"owner": c.Owner, "gid": c.GID}, bson.M{"$set": bson.M{
+		"firstName":     c.FirstName,
+		"middleName":    c.MiddleName,
+		"lastName":      c.LastName,
+		"prefix":        c.Prefix,
+		"suffix":        c.Suffix,
+		"company":       c.Company,
+		"title":         c.Title,
+		"email":         c.Email,
+		"phone":         c.Phone,
+		"emails":        c.Emails,
+		"phones":        c.Phones,
+		"addresses":     c.Addresses,
+		"organizations": c.Organizations,
+		"birthdays":     c.Birthdays,
+		"urls":          c.URLs,
+		"biography":     c.Biography,
+		"relations":     c.Relations,
+		"provenance":    c.Provenance,
+	}})
+}
+
+// MergeDuplicate merge duplicate into primary contact & remember decision
+func MergeDuplicate(owner, id, primary string) error {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "MergeDuplicate",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+
+	var d ContactDuplicate
+	err := db.C("contactDuplicates").Find(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner}).One(&d)
+	if err != nil {
+		return err
+	}
+
+	if d.Kind == "correspondent" || primary != d.GIDs[1] {
+		primary = d.GIDs[0]
+	}
+
+	d.Primary = primary
+	d.Status = "merged"
+	d.Decided = time.Now()
+
+	err = db.C("contactDuplicates").UpdateId(d.ID, bson.M{"$set": bson.M{"primary": d.Primary, "status": d.Status, "decided": d.Decided}})
+	if err != nil {
+		return err
+	}
+
+	ApplyContactMerges(owner)
+
+	return nil
+}
+
+// DismissDuplicate remember that contacts are not duplicates, merged duplicate is undone
+func DismissDuplicate(owner, id string) error {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "DismissDuplicate",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+
+	var d ContactDuplicate
+	err := db.C("contactDuplicates").Find(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner}).One(&d)
+	if err != nil {
+		return err
+	}
+
+	if d.Status == "merged" {
+
+		from := "mailto:" + d.Email
+		secondary := ""
+
+		if d.Kind == "contact" {
+			secondary = d.GIDs[0]
+			if secondary == d.Primary {
+				secondary = d.GIDs[1]
+			}
+			from = secondary
+		}
+
+		var c Contact
+		if db.C("contacts").Find(bson.M{"owner": owner, "gid": d.Primary}).One(&c) == nil {
+			if err := SaveContactValues(StripMerged(c, from)); err != nil {
+				return err
+			}
+		}
+
+		if secondary != "" {
+			err := db.C("contacts").Update(bson.M{"owner": owner, "gid": secondary}, bson.M{"$unset": bson.M{"mergedInto": ""}})
+			if err != nil {
+				return err
+			}
+		}
+
+	}
+
+	err = db.C("contactDuplicates").UpdateId(d.ID, bson.M{
+		"$set":   bson.M{"status": "dismissed", "decided": time.Now()},
+		"$unset": bson.M{"primary": ""},
+	})
+	if err != nil {
+		return err
+	}
+
+	LinkCorrespondents(owner)
+
+	return nil
+}
+
+// ApplyContactMerges merge values of merged duplicates into primary contacts again
+// sync replace values of primary contact, merged contact stay hidden
+func ApplyContactMerges(owner string) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "ApplyContactMerges",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	var merges []ContactDuplicate
+	err := db.C("contactDuplicates").Find(bson.M{"owner": owner, "status": "merged"}).Sort("decided").All(&merges)
+	if err != nil {
+		HandleError(proc, "get merged duplicates", err, true)
+		return
+	}
+
+	for _, d := range merges {
+
+		secondary := ""
+		if d.Kind == "contact" {
+			secondary = d.GIDs[0]
+			if secondary == d.Primary {
+				secondary = d.GIDs[1]
+			}
+		}
+
+		var primary Contact
+		err := db.C("contacts").Find(bson.M{"owner": owner, "gid": d.Primary, "deleted": bson.M{"$exists": false}}).One(&primary)
+		if err != nil {
+
+			// primary contact is deleted, merged contact is shown again & duplicate is open for new decision
+			if secondary != "" {
+				err := db.C("contacts").Update(bson.M{"owner": owner, "gid": secondary}, bson.M{"$unset": bson.M{"mergedInto": ""}})
+				if err != nil {
+					HandleError(proc, "show merged contact "+secondary, err, true)
+				}
+			}
+
+			err = db.C("contactDuplicates").UpdateId(d.ID, bson.M{
+				"$set":   bson.M{"status": "open"},
+				"$unset": bson.M{"primary": "", "decided": ""},
+			})
+			if err != nil {
+				HandleError(proc, "open duplicate "+d.ID.Hex(), err, true)
+			}
+
+			continue
+
+		}
+
+		dup := CorrespondentContact(d.Email)
+
+		if secondary != "" {
+
+			err := db.C("contacts").Find(bson.M{"owner": owner, "gid": secondary}).One(&dup)
+			if err != nil {
+				HandleError(proc, "get merged contact "+secondary, err, true)
+				continue
+			}
+
+			err = db.C("contacts").Update(bson.M{"owner": owner, "gid": secondary}, bson.M{"$set": bson.M{"mergedInto": d.Primary}})
+			if err != nil {
+				HandleError(proc, "hide merged contact "+secondary, err, true)
+				continue
+			}
+
+		}
+
+		if err := SaveContactValues(MergeContact(primary, dup)); err != nil {
+			HandleError(proc, "save merged contact "+d.Primary, err, true)
+		}
+
+	}
+
+	LinkCorrespondents(owner)
+
+}
+
+// DuplicateSummary return text of duplicate reasons
+func (d ContactDuplicate) DuplicateSummary() string {
+
+	return strings.Join(d.Reasons, ", ") + " (score " + strconv.Itoa(d.Score) + ")"
+}
@@ -1,26 +1,103 @@
 package main
 
 import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
 	"os"
+	"strings"
 	"time"
 
+	"github.com/globalsign/mgo"
 	"github.com/globalsign/mgo/bson"
 	people "google.golang.org/api/people/v1"
 )
 
 // Contact define simlify person struct from gmail
+// first name, company, email & phone are primary values, all values are in lists
 type Contact struct {
-	ID        bson.ObjectId `json:"id" bson:"_id,omitempty"`
-	GID       string        `json:"gid" bson:"gid,omitempty"`
-	Owner     string        `json:"owner" bson:"owner,omitempty"`
-	FirstName string        `json:"firstName" bson:"firstName,omitempty"`
-	LastName  string        `json:"lastName" bson:"lastName,omitempty"`
-	Company   string        `json:"company" bson:"company,omitempty"`
-	Title     string        `json:"title" bson:"title,omitempty"`
-	Email     string        `json:"email" bson:"email,omitempty"`
-	Phone     string        `json:"phone" bson:"phone,omitempty"`
+	ID            bson.ObjectId         `json:"id" bson:"_id,omitempty"`
+	GID           string                `json:"gid" bson:"gid,omitempty"`
+	Owner         string                `json:"owner" bson:"owner,omitempty"`
+	FirstName     string                `json:"firstName" bson:"firstName,omitempty"`
+	MiddleName    string                `json:"middleName" bson:"middleName,omitempty"`
+	LastName      string                `json:"lastName" bson:"lastName,omitempty"`
+	Prefix        string                `json:"prefix" bson:"prefix,omitempty"`
+	Suffix        string                `json:"suffix" bson:"suffix,omitempty"`
+	Company       string                `json:"company" bson:"company,omitempty"`
+	Title         string                `json:"title" bson:"title,omitempty"`
+	Email         string                `json:"email" bson:"email,omitempty"`
+	Phone         string                `json:"phone" bson:"phone,omitempty"`
+	Emails        []ContactValue        `json:"emails" bson:"emails,omitempty"`
+	Phones        []ContactValue        `json:"phones" bson:"phones,omitempty"`
+	Addresses     []ContactAddress      `json:"addresses" bson:"addresses,omitempty"`
+	Organizations []ContactOrganization `json:"organizations" bson:"organizations,omitempty"`
+	Birthdays     []string              `json:"birthdays" bson:"birthdays,omitempty"`
+	URLs          []ContactValue        `json:"urls" bson:"urls,omitempty"`
+	Biography     string                `json:"biography" bson:"biography,omitempty"`
+	Relations     []ContactValue        `json:"relations" bson:"relations,omitempty"`
+	Memberships   []string              `json:"memberships" bson:"memberships,omitempty"`
+	Photos        []ContactPhoto        `json:"photos" bson:"photos,omitempty"`
+	GroupNames    []string              `json:"groupNames" bson:"-"`
+	Source        string                `json:"source" bson:"source,omitempty"`
+	Synced        time.Time             `json:"synced" bson:"synced,omitempty"`
+	Deleted       time.Time             `json:"deleted" bson:"deleted,omitempty"`
+	Etag          string                `json:"etag" bson:"etag,omitempty"`
+	MergedInto    string                `json:"mergedInto" bson:"mergedInto,omitempty"`
+	Provenance    map[string]string     `json:"provenance" bson:"provenance,omitempty"`
 }
 
+// ContactValue value with type label of email, phone, url or relation
+// from is contact or correspondent value was merged from
+type ContactValue struct {
+	Value   string `json:"value" bson:"value,omitempty"`
+	Type    string `json:"type" bson:"type,omitempty"`
+	Primary bool   `json:"primary" bson:"primary,omitempty"`
+	From    string `json:"from" bson:"from,omitempty"`
+}
+
+// ContactAddress postal address with type label
+type ContactAddress struct {
+	Type        string `json:"type" bson:"type,omitempty"`
+	Formatted   string `json:"formatted" bson:"formatted,omitempty"`
+	PoBox       string `json:"poBox" bson:"poBox,omitempty"`
+	Street      string `json:"street" bson:"street,omitempty"`
+	Extended    string `json:"extended" bson:"extended,omitempty"`
+	City        string `json:"city" bson:"city,omitempty"`
+	Region      string `json:"region" bson:"region,omitempty"`
+	PostalCode  string `json:"postalCode" bson:"postalCode,omitempty"`
+	Country     string `json:"country" bson:"country,omitempty"`
+	CountryCode string `json:"countryCode" bson:"countryCode,omitempty"`
+	From        string `json:"from" bson:"from,omitempty"`
+}
+
+// ContactOrganization company, title & department with type label
+type ContactOrganization struct {
+	Name       string `json:"name" bson:"name,omitempty"`
+	Title      string `json:"title" bson:"title,omitempty"`
+	Department string `json:"department" bson:"department,omitempty"`
+	Type       string `json:"type" bson:"type,omitempty"`
+	From       string `json:"from" bson:"from,omitempty"`
+}
+
+// ContactPhoto photo url, photo is downloaded to GridFS unless it is default one
+type ContactPhoto struct {
+	URL         string        `json:"url" bson:"url,omitempty"`
+	Default     bool          `json:"default" bson:"default,omitempty"`
+	ContentType string        `json:"contentType" bson:"contentType,omitempty"`
+	GridID      bson.ObjectId `json:"gridID" bson:"gridID,omitempty"`
+}
+
+// contactPersonFields person fields requested from api
+const contactPersonFields = "names,emailAddresses,phoneNumbers,addresses,organizations,birthdays,urls,biographies,relations,memberships,photos"
+
+// otherContactFields fields of other contacts requested from api
+const otherContactFields = "names,emailAddresses,phoneNumbers,photos"
+
+// maxContactPhoto max size of downloaded photo
+const maxContactPhoto = 5000000
+
 // GetAllContacts return all contacts by user
 func GetAllContacts(user User) []Contact {
 
@@ -82,7 +159,54 @@ func CRUDContact(p Contact) {
 
 	}
 
-	change := bson.M{"$set": p}
+	// all synced values are set, values removed in gmail are cleared
+	set := bson.M{
+		"firstName":     p.FirstName,
+		"middleName":    p.MiddleName,
+		"lastName":      p.LastName,
+		"prefix":        p.Prefix,
+		"suffix":        p.Suffix,
+		"company":       p.Company,
+		"title":         p.Title,
+		"email":         p.Email,
+		"phone":         p.Phone,
+		"emails":        p.Emails,
+		"phones":        p.Phones,
+		"addresses":     p.Addresses,
+		"organizations": p.Organizations,
+		"birthdays":     p.Birthdays,
+		"urls":          p.URLs,
+		"biography":     p.Biography,
+		"relations":     p.Relations,
+		"memberships":   p.Memberships,
+		"photos":        p.Photos,
+		"source":        p.Source,
+		"synced":        p.Synced,
+		"etag":          p.Etag,
+	}
+
+	change := bson.M{"$set": set}
+
+	unset := bson.M{}
+
+	// contact listed again is not deleted
+	if p.Deleted.IsZero() {
+		unset["deleted"] = ""
+	} else {
+		set["deleted"] = p.Deleted
+	}
+
+	// synced values replace merged ones, merges are applied again after sync
+	if p.Provenance == nil {
+		unset["provenance"] = ""
+	} else {
+		set["provenance"] = p.Provenance
+	}
+
+	if len(unset) != 0 {
+		change["$unset"] = unset
+	}
+
 	err = mongoC.Update(queryCheck, change)
 	if err != nil {
 		HandleError(proc, "error while updateing row", err, true)
@@ -92,7 +216,8 @@ func CRUDContact(p Contact) {
 
 }
 
-// SyncGPeople sync people from gmail
+// SyncGPeople sync contact groups, contacts & other contacts from gmail
+// sync tokens are saved, next sync get only changed & deleted contacts
 func SyncGPeople(syncer Syncer) {
 
 	proc := ServiceLog{
@@ -113,52 +238,65 @@ func SyncGPeople(syncer Syncer) {
 	syncer.Status = "start"
 	if svc != nil {
 
-		//Gmail people loop
-		pageToken := ""
-		for {
+		// edits are pushed before sync, conflicts are detected by sync
+		PushContactEdits(svc, user)
 
-			conns, err := GetConnectionsList(svc, pageToken)
-			if err != nil {
-				HandleError(proc, "Unable to retrieve threads", err, true)
-				break
-			}
-			// Proccess contacts
-			contacts, len := ProcessConections(conns.Connections, user)
+		state := GetContactSync(user.Email)
+
+		err := SyncContactGroups(svc, user)
+		if err != nil {
+			HandleError(proc, "Unable to retrieve contact groups", err, true)
+		}
 
-			// Add contacts count
-			syncer.Count = syncer.Count + len
+		token, err := SyncPersons(&syncer, user, "connections", state.SyncToken, func(pageToken, syncToken string) ([]*people.Person, string, string, error) {
 
-			// Save contacts to DB
-			SaveContacts(contacts)
+			r, err := GetConnectionsList(svc, pageToken, syncToken)
+			if err != nil {
+				return nil, "", "", err
+			}
 
-			// Check last token
-			pageToken = conns.NextPageToken
-			syncer.LastPageToken = pageToken
+			return r.Connections, r.NextPageToken, r.NextSyncToken, nil
+		})
+		if err != nil {
+			HandleError(proc, "Unable to retrieve contacts", err, true)
+			syncer.Status = "error:" + err.Error()
+		}
+		state.SyncToken = token
 
-			// Save syncer
-			CRUDSyncer(syncer)
+		// other contacts need contacts.other.readonly scope
+		token, err = SyncPersons(&syncer, user, "otherContacts", state.OtherSyncToken, func(pageToken, syncToken string) ([]*people.Person, string, string, error) {
 
-			// Reset
-			if conns.NextPageToken == "" {
-				svc = nil
-				conns = nil
-				break
+			r, err := GetOtherContactsList(svc, pageToken, syncToken)
+			if err != nil {
+				return nil, "", "", err
 			}
 
+			return r.OtherContacts, r.NextPageToken, r.NextSyncToken, nil
+		})
+		if err != nil {
+			HandleError(proc, "Unable to retrieve other contacts", err, true)
 		}
+		state.OtherSyncToken = token
+
+		CRUDContactSync(state)
+
+		// merged values are replaced by sync
+		ApplyContactMerges(user.Email)
 
 	}
 
 	syncer.End = time.Now()
-	syncer.Status = "end"
+	if !strings.HasPrefix(syncer.Status, "error") {
+		syncer.Status = "end"
+	}
 	CRUDSyncer(syncer)
 
 	return
 
 }
 
-// GetConnectionsList get connections from api
-func GetConnectionsList(svc *people.Service, pageToken string) (*people.ListConnectionsResponse, error) {
+// GetConnectionsList get connections from api, changes since sync token when it is set
+func GetConnectionsList(svc *people.Service, pageToken, syncToken string) (*people.ListConnectionsResponse, error) {
 
 	proc := ServiceLog{
 		Start:   time.Now(),
@@ -169,66 +307,306 @@ func GetConnectionsList(svc *people.Service, pageToken string) (*people.ListConn
 
 	defer SaveLog(proc)
 
-	personFields := "emailAddresses,names,phoneNumbers,organizations"
-
 	// Request contacts from api
-	req := svc.People.Connections.List("people/me").PersonFields(personFields)
+	req := svc.People.Connections.List("people/me").PersonFields(contactPersonFields).RequestSyncToken(true)
 	if pageToken != "" {
 		req.PageToken(pageToken)
 	}
+	if syncToken != "" {
+		req.SyncToken(syncToken)
+	}
 	r, err := req.Do()
 
 	return r, err
 
 }
 
-// ProcessConections standard people
-func ProcessConections(people []*people.Person, user User) ([]Contact, int) {
+// GetOtherContactsList get other contacts from api, changes since sync token when it is set
+func GetOtherContactsList(svc *people.Service, pageToken, syncToken string) (*people.ListOtherContactsResponse, error) {
 
 	proc := ServiceLog{
 		Start:   time.Now(),
 		Type:    "function",
 		Service: "gapp",
-		Name:    "ProcessConections",
+		Name:    "GetOtherContactsList",
 	}
 
 	defer SaveLog(proc)
 
-	var contacts []Contact
+	req := svc.OtherContacts.List().ReadMask(otherContactFields).RequestSyncToken(true)
+	if pageToken != "" {
+		req.PageToken(pageToken)
+	}
+	if syncToken != "" {
+		req.SyncToken(syncToken)
+	}
+	r, err := req.Do()
+
+	return r, err
 
-	count := len(people)
+}
 
-	if count != 0 {
-		for _, person := range people {
+// PersonContact convert person to contact with all values & type labels
+func PersonContact(person *people.Person, owner string) Contact {
 
-			p := Contact{
-				GID:   person.ResourceName,
-				Owner: user.Email,
-			}
+	p := Contact{
+		GID:   person.ResourceName,
+		Owner: owner,
+		Etag:  person.Etag,
+	}
 
-			if len(person.Names) != 0 {
-				p.FirstName = person.Names[0].GivenName
-				p.LastName = person.Names[0].FamilyName
-			}
+	if len(person.Names) != 0 {
+		p.FirstName = person.Names[0].GivenName
+		p.MiddleName = person.Names[0].MiddleName
+		p.LastName = person.Names[0].FamilyName
+		p.Prefix = person.Names[0].HonorificPrefix
+		p.Suffix = person.Names[0].HonorificSuffix
+	}
+
+	for _, e := range person.EmailAddresses {
+		if e.Value != "" {
+			p.Emails = append(p.Emails, ContactValue{Value: e.Value, Type: e.Type, Primary: FieldPrimary(e.Metadata)})
+		}
+	}
 
-			if len(person.Organizations) != 0 {
-				p.Company = person.Organizations[0].Name
-				p.Title = person.Organizations[0].Title
+	for _, n := range person.PhoneNumbers {
+
+		value := n.CanonicalForm
+		if value == "" {
+			value = n.Value
+		}
+
+		if value != "" {
+			p.Phones = append(p.Phones, ContactValue{Value: value, Type: n.Type, Primary: FieldPrimary(n.Metadata)})
+		}
+
+	}
+
+	for _, a := range person.Addresses {
+		p.Addresses = append(p.Addresses, ContactAddress{
+			Type:        a.Type,
+			Formatted:   a.FormattedValue,
+			PoBox:       a.PoBox,
+			Street:      a.StreetAddress,
+			Extended:    a.ExtendedAddress,
+			City:        a.City,
+			Region:      a.Region,
+			PostalCode:  a.PostalCode,
+			Country:     a.Country,
+			CountryCode: a.CountryCode,
+		})
+	}
+
+	for _, o := range person.Organizations {
+		p.Organizations = append(p.Organizations, ContactOrganization{
+			Name:       o.Name,
+			Title:      o.Title,
+			Department: o.Department,
+			Type:       o.Type,
+		})
+	}
+
+	for _, b := range person.Birthdays {
+		if birthday := BirthdayValue(b); birthday != "" {
+			p.Birthdays = append(p.Birthdays, birthday)
+		}
+	}
+
+	for _, u := range person.Urls {
+		if u.Value != "" {
+			p.URLs = append(p.URLs, ContactValue{Value: u.Value, Type: u.Type, Primary: FieldPrimary(u.Metadata)})
+		}
+	}
+
+	for _, b := range person.Biographies {
+		if b.Value != "" {
+			p.Biography = b.Value
+			break
+		}
+	}
+
+	for _, r := range person.Relations {
+		if r.Person != "" {
+			p.Relations = append(p.Relations, ContactValue{Value: r.Person, Type: r.Type})
+		}
+	}
+
+	for _, m := range person.Memberships {
+		if m.ContactGroupMembership != nil && m.ContactGroupMembership.ContactGroupResourceName != "" {
+			p.Memberships = append(p.Memberships, m.ContactGroupMembership.ContactGroupResourceName)
+		}
+	}
+
+	for _, ph := range person.Photos {
+		if ph.Url != "" {
+			p.Photos = append(p.Photos, ContactPhoto{URL: ph.Url, Default: ph.Default})
+		}
+	}
+
+	if len(p.Organizations) != 0 {
+		p.Company = p.Organizations[0].Name
+		p.Title = p.Organizations[0].Title
+	}
+
+	p.Email = PrimaryContactValue(p.Emails)
+	p.Phone = PrimaryContactValue(p.Phones)
+
+	return p
+}
+
+// FieldPrimary check if field is primary value of person
+func FieldPrimary(m *people.FieldMetadata) bool {
+
+	return m != nil && m.Primary
+}
+
+// PrimaryContactValue return primary value, first one when none is marked
+func PrimaryContactValue(values []ContactValue) string {
+
+	for _, v := range values {
+		if v.Primary {
+			return v.Value
+		}
+	}
+
+	if len(values) != 0 {
+		return values[0].Value
+	}
+
+	return ""
+}
+
+// BirthdayValue return birthday as YYYY-MM-DD, --MM-DD without year or text
+func BirthdayValue(b *people.Birthday) string {
+
+	if b.Date == nil || b.Date.Month == 0 || b.Date.Day == 0 {
+		return b.Text
+	}
+
+	if b.Date.Year == 0 {
+		return fmt.Sprintf("--%02d-%02d", b.Date.Month, b.Date.Day)
+	}
+
+	return fmt.Sprintf("%04d-%02d-%02d", b.Date.Year, b.Date.Month, b.Date.Day)
+}
+
+// SaveContactPhotos download photos of contacts to GridFS
+// photo with same url keep downloaded file, replaced photos are removed
+func SaveContactPhotos(contacts []Contact) []Contact {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "SaveContactPhotos",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	client := &http.Client{Timeout: 30 * time.Second}
+
+	for i, c := range contacts {
+
+		var saved Contact
+		db.C("contacts").Find(bson.M{"owner": c.Owner, "gid": c.GID}).Select(bson.M{"photos": 1}).One(&saved)
+
+		keep := make(map[bson.ObjectId]bool)
+
+		for k, photo := range c.Photos {
+
+			if photo.Default {
+				continue
 			}
 
-			if len(person.EmailAddresses) != 0 {
-				p.Email = person.EmailAddresses[0].Value
+			for _, sp := range saved.Photos {
+				if sp.URL == photo.URL && sp.GridID != "" {
+					photo.GridID = sp.GridID
+					photo.ContentType = sp.ContentType
+				}
 			}
 
-			if len(person.PhoneNumbers) != 0 {
-				p.Phone = person.PhoneNumbers[0].CanonicalForm
+			if photo.GridID == "" {
+
+				data, contentType, err := DownloadContactPhoto(client, photo.URL)
+				if err != nil {
+					HandleError(proc, "download photo of "+c.GID, err, true)
+					continue
+				}
+
+				photo.ContentType = contentType
+				photo.GridID, err = SaveContactPhoto(db, c.GID, contentType, data)
+				if err != nil {
+					HandleError(proc, "save photo of "+c.GID, err, true)
+					continue
+				}
+
 			}
 
-			contacts = append(contacts, p)
+			keep[photo.GridID] = true
+			contacts[i].Photos[k] = photo
 
 		}
+
+		for _, sp := range saved.Photos {
+			if sp.GridID != "" && !keep[sp.GridID] {
+				db.GridFS("contactPhotos").RemoveId(sp.GridID)
+			}
+		}
+
+	}
+
+	return contacts
+}
+
+// DownloadContactPhoto return photo content & content type
+func DownloadContactPhoto(client *http.Client, url string) ([]byte, string, error) {
+
+	res, err := client.Get(url)
+	if err != nil {
+		return nil, "", err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return nil, "", fmt.Errorf("photo download status %d", res.StatusCode)
+	}
+
+	data, err := ioutil.ReadAll(io.LimitReader(res.Body, maxContactPhoto))
+	if err != nil {
+		return nil, "", err
+	}
+
+	contentType := res.Header.Get("Content-Type")
+	if contentType == "" {
+		contentType = http.DetectContentType(data)
+	}
+
+	return data, contentType, nil
+}
+
+// SaveContactPhoto save photo to GridFS
+func SaveContactPhoto(db *mgo.Database, name, contentType string, data []byte) (bson.ObjectId, error) {
+
+	gridFile, err := db.GridFS("contactPhotos").Create(name)
+	if err != nil {
+		return "", err
+	}
+
+	gridFile.SetContentType(contentType)
+
+	_, err = gridFile.Write(data)
+	if cerr := gridFile.Close(); err == nil {
+		err = cerr
 	}
-	return contacts, count
+	if err != nil {
+		return "", err
+	}
+
+	return gridFile.Id().(bson.ObjectId), nil
 }
 
 // SaveContacts standard people
@@ -250,3 +628,20 @@ func SaveContacts(contacts []Contact) {
 	}
 
 }
+
+// GetContact return contact of owner by id
+func GetContact(owner, id string) (Contact, error) {
+
+	var c Contact
+
+	if !bson.IsObjectIdHex(id) {
+		return c, mgo.ErrNotFound
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	err := DB.DB(os.Getenv("MONGO_DB")).C("contacts").Find(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner}).One(&c)
+
+	return c, err
+}
@@ -0,0 +1,770 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// telURIChars phone numbers which can be written as tel uri
+var telURIChars = regexp.MustCompile(`^\+?[0-9][0-9-]*$`)
+
+// ContactCSVColumn csv column name & value of contact
+type ContactCSVColumn struct {
+	Name  string
+	Value func(c Contact) string
+}
+
+// contactCSVLayouts csv columns by format, columns are named as in Google & Outlook import
+var contactCSVLayouts = map[string][]ContactCSVColumn{
+	"google":  GoogleCSVColumns(),
+	"outlook": OutlookCSVColumns(),
+}
+
+// GoogleCSVColumns columns of Google contacts csv
+func GoogleCSVColumns() []ContactCSVColumn {
+
+	columns := []ContactCSVColumn{
+		{"Name", func(c Contact) string { return c.FullName() }},
+		{"Given Name", func(c Contact) string { return c.FirstName }},
+		{"Additional Name", func(c Contact) string { return c.MiddleName }},
+		{"Family Name", func(c Contact) string { return c.LastName }},
+		{"Name Prefix", func(c Contact) string { return c.Prefix }},
+		{"Name Suffix", func(c Contact) string { return c.Suffix }},
+		{"Birthday", func(c Contact) string { return FirstValue(c.Birthdays) }},
+		{"Notes", func(c Contact) string { return c.Biography }},
+		{"Group Membership", func(c Contact) string { return strings.Join(ContactGroupNames(c), " ::: ") }},
+		{"Photo", func(c Contact) string { return ContactPhotoURL(c) }},
+	}
+
+	values := func(name string, n int, list func(c Contact) []ContactValue) {
+
+		for i := 0; i < n; i++ {
+
+			i := i
+			prefix := fmt.Sprintf("%s %d - ", name, i+1)
+
+			columns = append(columns,
+				ContactCSVColumn{prefix + "Type", func(c Contact) string { return GoogleCSVType(nthValue(list(c), i)) }},
+				ContactCSVColumn{prefix + "Value", func(c Contact) string { return nthValue(list(c), i).Value }},
+			)
+
+		}
+
+	}
+
+	values("E-mail", 3, func(c Contact) []ContactValue { return c.Emails })
+	values("Phone", 3, func(c Contact) []ContactValue { return c.Phones })
+
+	for i := 0; i < 2; i++ {
+
+		i := i
+		prefix := fmt.Sprintf("Address %d - ", i+1)
+		address := func(c Contact) ContactAddress { return nthAddress(c.Addresses, i) }
+
+		columns = append(columns,
+			ContactCSVColumn{prefix + "Type", func(c Contact) string {
+				return GoogleCSVType(ContactValue{Type: address(c).Type, Value: address(c).Formatted + address(c).Street})
+			}},
+			ContactCSVColumn{prefix + "Formatted", func(c Contact) string { return address(c).Formatted }},
+			ContactCSVColumn{prefix + "Street", func(c Contact) string { return address(c).Street }},
+			ContactCSVColumn{prefix + "City", func(c Contact) string { return address(c).City }},
+			ContactCSVColumn{prefix + "PO Box", func(c Contact) string { return address(c).PoBox }},
+			ContactCSVColumn{prefix + "Region", func(c Contact) string { return address(c).Region }},
+			ContactCSVColumn{prefix + "Postal Code", func(c Contact) string { return address(c).PostalCode }},
+			ContactCSVColumn{prefix + "Country", func(c Contact) string { return address(c).Country }},
+			ContactCSVColumn{prefix + "Extended Address", func(c Contact) string { return address(c).Extended }},
+		)
+
+	}
+
+	org := func(c Contact) ContactOrganization {
+		if len(c.Organizations) != 0 {
+			return c.Organizations[0]
+		}
+		return ContactOrganization{}
+	}
+
+	columns = append(columns,
+		ContactCSVColumn{"Organization 1 - Type", func(c Contact) string {
+			return GoogleCSVType(ContactValue{Type: org(c).Type, Value: org(c).Name + org(c).Title})
+		}},
+		ContactCSVColumn{"Organization 1 - Name", func(c Contact) string { return org(c).Name }},
+		ContactCSVColumn{"Organization 1 - Title", func(c Contact) string { return org(c).Title }},
+		ContactCSVColumn{"Organization 1 - Department", func(c Contact) string { return org(c).Department }},
+	)
+
+	values("Website", 2, func(c Contact) []ContactValue { return c.URLs })
+	values("Relation", 2, func(c Contact) []ContactValue { return c.Relations })
+
+	return columns
+}
+
+// GoogleCSVType return type label as in Google csv, primary value is marked with *
+func GoogleCSVType(v ContactValue) string {
+
+	if v.Value == "" {
+		return ""
+	}
+
+	label := strings.Title(v.Type)
+	if label == "" {
+		label = "Other"
+	}
+
+	if v.Primary {
+		return "* " + label
+	}
+
+	return label
+}
+
+// OutlookCSVColumns columns of Outlook contacts csv, values are placed by type
+func OutlookCSVColumns() []ContactCSVColumn {
+
+	columns := []ContactCSVColumn{
+		{"Title", func(c Contact) string { return c.Prefix }},
+		{"First Name", func(c Contact) string { return c.FirstName }},
+		{"Middle Name", func(c Contact) string { return c.MiddleName }},
+		{"Last Name", func(c Contact) string { return c.LastName }},
+		{"Suffix", func(c Contact) string { return c.Suffix }},
+		{"Company", func(c Contact) string { return c.Company }},
+		{"Department", func(c Contact) string {
+			if len(c.Organizations) != 0 {
+				return c.Organizations[0].Department
+			}
+			return ""
+		}},
+		{"Job Title", func(c Contact) string { return c.Title }},
+	}
+
+	for _, kind := range []string{"Business", "Home", "Other"} {
+
+		kind := kind
+		address := func(c Contact) ContactAddress { return OutlookAddress(c.Addresses, kind) }
+
+		columns = append(columns,
+			ContactCSVColumn{kind + " Street", func(c Contact) string {
+				return strings.TrimSpace(address(c).Street + " " + address(c).Extended)
+			}},
+			ContactCSVColumn{kind + " City", func(c Contact) string { return address(c).City }},
+			ContactCSVColumn{kind + " State", func(c Contact) string { return address(c).Region }},
+			ContactCSVColumn{kind + " Postal Code", func(c Contact) string { return address(c).PostalCode }},
+			ContactCSVColumn{kind + " Country/Region", func(c Contact) string { return address(c).Country }},
+		)
+
+	}
+
+	phone := func(kind string) func(c Contact) string {
+		return func(c Contact) string { return OutlookPhones(c.Phones)[kind] }
+	}
+
+	email := func(i int) func(c Contact) string {
+		return func(c Contact) string { return nthValue(OrderedContactValues(c.Emails), i).Value }
+	}
+
+	columns = append(columns,
+		ContactCSVColumn{"Business Phone", phone("Business")},
+		ContactCSVColumn{"Home Phone", phone("Home")},
+		ContactCSVColumn{"Mobile Phone", phone("Mobile")},
+		ContactCSVColumn{"Other Phone", phone("Other")},
+		ContactCSVColumn{"E-mail Address", email(0)},
+		ContactCSVColumn{"E-mail Display Name", func(c Contact) string {
+			if c.Email == "" {
+				return ""
+			}
+			return c.FullName() + " (" + c.Email + ")"
+		}},
+		ContactCSVColumn{"E-mail 2 Address", email(1)},
+		ContactCSVColumn{"E-mail 3 Address", email(2)},
+		ContactCSVColumn{"Web Page", func(c Contact) string { return nthValue(OrderedContactValues(c.URLs), 0).Value }},
+		ContactCSVColumn{"Birthday", func(c Contact) string { return OutlookBirthday(FirstValue(c.Birthdays)) }},
+		ContactCSVColumn{"Notes", func(c Contact) string { return c.Biography }},
+		ContactCSVColumn{"Categories", func(c Contact) string {
+			var names []string
+			for _, g := range ContactGroupNames(c) {
+				names = append(names, strings.TrimPrefix(g, "* "))
+			}
+			return strings.Join(names, ";")
+		}},
+	)
+
+	return columns
+}
+
+// OutlookAddress return address of Outlook kind, address without work or home type is other
+func OutlookAddress(addresses []ContactAddress, kind string) ContactAddress {
+
+	for _, a := range addresses {
+
+		k := "Other"
+		switch strings.ToLower(a.Type) {
+		case "work":
+			k = "Business"
+		case "home":
+			k = "Home"
+		}
+
+		if k == kind {
+			return a
+		}
+
+	}
+
+	return ContactAddress{}
+}
+
+// OutlookPhones return phones by Outlook kind, first phone of each kind is used
+func OutlookPhones(phones []ContactValue) map[string]string {
+
+	kinds := make(map[string]string)
+
+	for _, p := range OrderedContactValues(phones) {
+
+		k := "Other"
+		switch strings.ToLower(p.Type) {
+		case "work", "workmobile":
+			k = "Business"
+		case "home":
+			k = "Home"
+		case "mobile":
+			k = "Mobile"
+		}
+
+		if kinds[k] == "" {
+			kinds[k] = p.Value
+		}
+
+	}
+
+	return kinds
+}
+
+// OutlookBirthday return birthday as M/D/YYYY, birthday without year is skipped
+func OutlookBirthday(birthday string) string {
+
+	t, err := time.Parse("2006-01-02", birthday)
+	if err != nil {
+		return ""
+	}
+
+	return t.Format("1/2/2006")
+}
+
+// OrderedContactValues return values with primary value first
+func OrderedContactValues(values []ContactValue) []ContactValue {
+
+	var ordered []ContactValue
+
+	for _, v := range values {
+		if v.Primary {
+			ordered = append(ordered, v)
+		}
+	}
+
+	for _, v := range values {
+		if !v.Primary {
+			ordered = append(ordered, v)
+		}
+	}
+
+	return ordered
+}
+
+// nthValue return value at index or empty value
+func nthValue(values []ContactValue, i int) ContactValue {
+
+	if i < len(values) {
+		return values[i]
+	}
+
+	return ContactValue{}
+}
+
+// nthAddress return address at index or empty address
+func nthAddress(addresses []ContactAddress, i int) ContactAddress {
+
+	if i < len(addresses) {
+		return addresses[i]
+	}
+
+	return ContactAddress{}
+}
+
+// FirstValue return first value of list
+func FirstValue(values []string) string {
+
+	if len(values) != 0 {
+		return values[0]
+	}
+
+	return ""
+}
+
+// ContactGroupNames return names of contact groups, system groups are marked with *
+// group IDs are used when names are not loaded
+func ContactGroupNames(c Contact) []string {
+
+	if len(c.GroupNames) != 0 {
+		return c.GroupNames
+	}
+
+	var names []string
+
+	for _, m := range c.Memberships {
+		names = append(names, strings.TrimPrefix(m, "contactGroups/"))
+	}
+
+	return names
+}
+
+// HasPhoto check if contact has saved photo
+func (c Contact) HasPhoto() bool {
+
+	for _, p := range c.Photos {
+		if p.GridID != "" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// ContactPhotoURL return url of first photo which is not default
+func ContactPhotoURL(c Contact) string {
+
+	for _, p := range c.Photos {
+		if !p.Default {
+			return p.URL
+		}
+	}
+
+	return ""
+}
+
+// FullName return contact name, company or email when name is not set
+func (c Contact) FullName() string {
+
+	name := strings.TrimSpace(c.FirstName + " " + c.LastName)
+
+	switch {
+	case name != "":
+		return name
+	case c.Company != "":
+		return c.Company
+	}
+
+	return c.Email
+}
+
+// SearchContacts return contacts of user in group matching query by name, company, email, phone or address
+// other contacts are returned only when selected as group, deleted & merged contacts are not returned
+func SearchContacts(user User, query, group string) []Contact {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "SearchContacts",
+	}
+
+	defer SaveLog(proc)
+
+	var contacts []Contact
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("contacts")
+
+	mquery := bson.M{
+		"owner":      user.Email,
+		"deleted":    bson.M{"$exists": false},
+		"mergedInto": bson.M{"$exists": false},
+		"source":     bson.M{"$ne": otherContactsGroup},
+	}
+
+	switch group {
+	case "":
+	case otherContactsGroup:
+		mquery["source"] = otherContactsGroup
+	default:
+		mquery["memberships"] = group
+	}
+
+	if query = strings.TrimSpace(query); query != "" {
+
+		contains := bson.RegEx{Pattern: regexp.QuoteMeta(query), Options: "i"}
+
+		mquery["$or"] = []bson.M{
+			{"firstName": contains},
+			{"lastName": contains},
+			{"company": contains},
+			{"title": contains},
+			{"email": contains},
+			{"phone": contains},
+			{"emails.value": contains},
+			{"phones.value": contains},
+			{"addresses.formatted": contains},
+			{"organizations.name": contains},
+		}
+
+	}
+
+	err := DBC.Find(mquery).Sort("lastName", "firstName", "email").All(&contacts)
+	if err != nil {
+		HandleError(proc, "get contacts", err, true)
+		return contacts
+	}
+
+	names := make(map[string]string)
+	for _, g := range GetContactGroups(user) {
+		names[g.GID] = g.DisplayName()
+	}
+
+	for i, c := range contacts {
+		for _, m := range c.Memberships {
+			if name, ok := names[m]; ok {
+				contacts[i].GroupNames = append(contacts[i].GroupNames, name)
+			}
+		}
+	}
+
+	return contacts
+}
+
+// VCardEscape escape vCard text value, comma & semicolon are escaped for list & structured values
+func VCardEscape(value string) string {
+
+	return strings.NewReplacer(
+		`\`, `\\`,
+		",", `\,`,
+		";", `\;`,
+		"\r\n", `\n`,
+		"\n", `\n`,
+		"\r", `\n`,
+	).Replace(value)
+}
+
+// VCardParam escape quoted parameter value (RFC 6868)
+func VCardParam(value string) string {
+
+	return strings.NewReplacer(
+		"^", "^^",
+		`"`, "^'",
+		"\r\n", "^n",
+		"\n", "^n",
+		"\r", "^n",
+	).Replace(value)
+}
+
+// VCardLine return content line folded to 75 octets, utf-8 sequences are not split
+func VCardLine(name, value string) string {
+
+	line := name + ":" + value
+
+	var folded strings.Builder
+
+	limit := 75
+	for len(line) > limit {
+
+		cut := limit
+		for cut > 0 && !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+
+		folded.WriteString(line[:cut])
+		folded.WriteString("\r\n ")
+		line = line[cut:]
+
+		// continuation line start with space
+		limit = 74
+
+	}
+
+	folded.WriteString(line)
+	folded.WriteString("\r\n")
+
+	return folded.String()
+}
+
+// vcardRelatedTypes relation types of people api which have vCard RELATED type
+var vcardRelatedTypes = map[string]string{
+	"spouse":          "spouse",
+	"child":           "child",
+	"mother":          "parent",
+	"father":          "parent",
+	"parent":          "parent",
+	"brother":         "sibling",
+	"sister":          "sibling",
+	"friend":          "friend",
+	"relative":        "kin",
+	"domesticPartner": "sweetheart",
+	"partner":         "sweetheart",
+	"manager":         "co-worker",
+	"assistant":       "agent",
+}
+
+// vcardToken parameter value which is not quoted
+var vcardToken = regexp.MustCompile(`^[a-z0-9-]+$`)
+
+// vcardBirthday birthday with date, with or without year
+var vcardBirthday = regexp.MustCompile(`^(\d{4}|-)-(\d{2})-(\d{2})$`)
+
+// VCardType return TYPE parameter of value, work & home are vCard types, others are lowercase text
+func VCardType(name, label string) string {
+
+	label = strings.ToLower(label)
+
+	switch {
+	case label == "":
+		return name
+	case name == "TEL" && label == "workmobile":
+		return name + ";TYPE=work,cell"
+	case name == "TEL" && label == "mobile":
+		return name + ";TYPE=cell"
+	case name == "TEL" && strings.HasSuffix(label, "fax"):
+		return name + ";TYPE=fax"
+	}
+
+	if vcardToken.MatchString(label) {
+		return name + ";TYPE=" + label
+	}
+
+	return name + `;TYPE="` + VCardParam(label) + `"`
+}
+
+// VCardPref return name with PREF parameter of primary value
+func VCardPref(name string, primary bool) string {
+
+	if primary {
+		return name + ";PREF=1"
+	}
+
+	return name
+}
+
+// ContactVCard return contact as vCard 4.0, photo is data uri or url
+func ContactVCard(c Contact, photo string) string {
+
+	var card strings.Builder
+
+	card.WriteString(VCardLine("BEGIN", "VCARD"))
+	card.WriteString(VCardLine("VERSION", "4.0"))
+
+	if c.GID != "" {
+		card.WriteString(VCardLine("UID;VALUE=text", VCardEscape(c.GID)))
+	}
+
+	card.WriteString(VCardLine("FN", VCardEscape(c.FullName())))
+
+	if c.FirstName != "" || c.LastName != "" || c.MiddleName != "" {
+		card.WriteString(VCardLine("N", strings.Join([]string{
+			VCardEscape(c.LastName),
+			VCardEscape(c.FirstName),
+			VCardEscape(c.MiddleName),
+			VCardEscape(c.Prefix),
+			VCardEscape(c.Suffix),
+		}, ";")))
+	}
+
+	for _, o := range c.Organizations {
+
+		if o.Name != "" || o.Department != "" {
+			org := VCardEscape(o.Name)
+			if o.Department != "" {
+				org += ";" + VCardEscape(o.Department)
+			}
+			card.WriteString(VCardLine("ORG", org))
+		}
+
+		if o.Title != "" {
+			card.WriteString(VCardLine("TITLE", VCardEscape(o.Title)))
+		}
+
+	}
+
+	for _, e := range c.Emails {
+		card.WriteString(VCardLine(VCardPref(VCardType("EMAIL", e.Type), e.Primary), VCardEscape(e.Value)))
+	}
+
+	for _, p := range c.Phones {
+
+		name := VCardPref(VCardType("TEL", p.Type), p.Primary)
+
+		if telURIChars.MatchString(p.Value) {
+			card.WriteString(VCardLine(name+";VALUE=uri", "tel:"+p.Value))
+		} else {
+			card.WriteString(VCardLine(name+";VALUE=text", VCardEscape(p.Value)))
+		}
+
+	}
+
+	for _, a := range c.Addresses {
+
+		name := VCardType("ADR", a.Type)
+		if a.Formatted != "" {
+			name += `;LABEL="` + VCardParam(a.Formatted) + `"`
+		}
+
+		card.WriteString(VCardLine(name, strings.Join([]string{
+			VCardEscape(a.PoBox),
+			VCardEscape(a.Extended),
+			VCardEscape(a.Street),
+			VCardEscape(a.City),
+			VCardEscape(a.Region),
+			VCardEscape(a.PostalCode),
+			VCardEscape(a.Country),
+		}, ";")))
+
+	}
+
+	for _, b := range c.Birthdays {
+
+		if m := vcardBirthday.FindStringSubmatch(b); m != nil {
+
+			date := m[1] + m[2] + m[3]
+			if m[1] == "-" {
+				date = "--" + m[2] + m[3]
+			}
+
+			card.WriteString(VCardLine("BDAY", date))
+
+		} else {
+			card.WriteString(VCardLine("BDAY;VALUE=text", VCardEscape(b)))
+		}
+
+		// only one birthday is allowed
+		break
+
+	}
+
+	for _, u := range c.URLs {
+		card.WriteString(VCardLine(VCardPref(VCardType("URL", u.Type), u.Primary), u.Value))
+	}
+
+	for _, r := range c.Relations {
+
+		name := "RELATED"
+		if t := vcardRelatedTypes[r.Type]; t != "" {
+			name += ";TYPE=" + t
+		}
+
+		card.WriteString(VCardLine(name+";VALUE=text", VCardEscape(r.Value)))
+
+	}
+
+	if groups := ContactGroupNames(c); len(groups) != 0 {
+
+		var escaped []string
+		for _, g := range groups {
+			escaped = append(escaped, VCardEscape(strings.TrimPrefix(g, "* ")))
+		}
+
+		card.WriteString(VCardLine("CATEGORIES", strings.Join(escaped, ",")))
+
+	}
+
+	if c.Biography != "" {
+		card.WriteString(VCardLine("NOTE", VCardEscape(c.Biography)))
+	}
+
+	if photo != "" {
+		card.WriteString(VCardLine("PHOTO", photo))
+	}
+
+	card.WriteString(VCardLine("END", "VCARD"))
+
+	return card.String()
+}
+
+// ContactPhotoData return first saved photo of contact as data uri, url when it is not saved
+func ContactPhotoData(db *mgo.Database, c Contact) string {
+
+	for _, p := range c.Photos {
+
+		if p.Default {
+			continue
+		}
+
+		if p.GridID == "" {
+			return p.URL
+		}
+
+		gridFile, err := db.GridFS("contactPhotos").OpenId(p.GridID)
+		if err != nil {
+			return p.URL
+		}
+
+		data, err := ioutil.ReadAll(gridFile)
+		gridFile.Close()
+		if err != nil {
+			return p.URL
+		}
+
+		return "data:" + p.ContentType + ";base64," + base64.StdEncoding.EncodeToString(data)
+
+	}
+
+	return ""
+}
+
+// WriteContactsVCard write contacts as vcf file, saved photos are embedded
+func WriteContactsVCard(w io.Writer, contacts []Contact) error {
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	for _, c := range contacts {
+
+		if _, err := io.WriteString(w, ContactVCard(c, ContactPhotoData(db, c))); err != nil {
+			return err
+		}
+
+	}
+
+	return nil
+}
+
+// WriteContactsCSV write contacts as csv file with columns of layout
+func WriteContactsCSV(w io.Writer, contacts []Contact, columns []ContactCSVColumn) error {
+
+	cw := csv.NewWriter(w)
+	cw.UseCRLF = true
+
+	var header []string
+	for _, col := range columns {
+		header = append(header, col.Name)
+	}
+
+	if err := cw.Write(header); err != nil {
+		return err
+	}
+
+	for _, c := range contacts {
+
+		var row []string
+		for _, col := range columns {
+			row = append(row, col.Value(c))
+		}
+
+		if err := cw.Write(row); err != nil {
+			return err
+		}
+
+	}
+
+	cw.Flush()
+
+	return cw.Error()
+}
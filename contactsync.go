@@ -0,0 +1,321 @@
+package main
+
+import (
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"google.golang.org/api/googleapi"
+	people "google.golang.org/api/people/v1"
+)
+
+// ContactSync sync tokens of user contacts & other contacts
+type ContactSync struct {
+	ID             bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner          string        `json:"owner" bson:"owner,omitempty"`
+	SyncToken      string        `json:"syncToken" bson:"syncToken,omitempty"`
+	OtherSyncToken string        `json:"otherSyncToken" bson:"otherSyncToken,omitempty"`
+	Synced         time.Time     `json:"synced" bson:"synced,omitempty"`
+}
+
+// ContactGroup contact group of user
+type ContactGroup struct {
+	ID            bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner         string        `json:"owner" bson:"owner,omitempty"`
+	GID           string        `json:"gid" bson:"gid,omitempty"`
+	Name          string        `json:"name" bson:"name,omitempty"`
+	FormattedName string        `json:"formattedName" bson:"formattedName,omitempty"`
+	Type          string        `json:"type" bson:"type,omitempty"`
+	MemberCount   int64         `json:"memberCount" bson:"memberCount,omitempty"`
+	Synced        time.Time     `json:"synced" bson:"synced,omitempty"`
+}
+
+// otherContactsGroup filter value of other contacts on contacts page
+const otherContactsGroup = "otherContacts"
+
+// DisplayName return group name, system groups are marked with * as in Google csv
+func (g ContactGroup) DisplayName() string {
+
+	if g.Type == "SYSTEM_CONTACT_GROUP" {
+		return "* " + g.Name
+	}
+
+	return g.Name
+}
+
+// GetContactSync return sync tokens of owner
+func GetContactSync(owner string) ContactSync {
+
+	state := ContactSync{Owner: owner}
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	DB.DB(os.Getenv("MONGO_DB")).C("contactSyncs").Find(bson.M{"owner": owner}).One(&state)
+
+	return state
+}
+
+// CRUDContactSync save sync tokens
+func CRUDContactSync(state ContactSync) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "CRUDContactSync",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	state.ID = ""
+	state.Synced = time.Now()
+
+	_, err := DB.DB(os.Getenv("MONGO_DB")).C("contactSyncs").Upsert(bson.M{"owner": state.Owner}, state)
+	if err != nil {
+		HandleError(proc, "error while saving sync tokens", err, true)
+	}
+
+}
+
+// ExpiredSyncToken check if api refused sync token, full sync is needed
+// people api return 400 with EXPIRED_SYNC_TOKEN reason, older apis 410
+func ExpiredSyncToken(err error) bool {
+
+	gerr, ok := err.(*googleapi.Error)
+	if !ok {
+		return false
+	}
+
+	if gerr.Code == 410 {
+		return true
+	}
+
+	return gerr.Code == 400 && (strings.Contains(gerr.Body, "EXPIRED_SYNC_TOKEN") || strings.Contains(gerr.Body, "failedPrecondition") || strings.Contains(gerr.Body, "FAILED_PRECONDITION"))
+}
+
+// SyncPersons save persons of source page by page, persons reported as deleted are soft deleted
+// without sync token all persons are listed & contacts of source not listed are soft deleted
+// on error sync token to keep is returned, empty when token expired
+func SyncPersons(syncer *Syncer, user User, source, syncToken string, list func(pageToken, syncToken string) ([]*people.Person, string, string, error)) (string, error) {
+
+	start := time.Now()
+
+	pageToken := ""
+	nextSyncToken := ""
+
+	for {
+
+		persons, nextPage, nextSync, err := list(pageToken, syncToken)
+		if err != nil {
+
+			if syncToken != "" && ExpiredSyncToken(err) {
+
+				// token expired, start full sync
+				syncToken = ""
+				pageToken = ""
+				continue
+
+			}
+
+			// people page token is not resumed, daily sync resume only gmail page tokens
+			syncer.LastPageToken = ""
+
+			// sync token is cleared when it expired
+			return syncToken, err
+		}
+
+		var contacts []Contact
+
+		for _, person := range persons {
+
+			if person.Metadata != nil && person.Metadata.Deleted {
+				if HoldDeletedContact(user.Email, person.ResourceName) {
+					continue
+				}
+				SoftDeleteContacts(bson.M{"owner": user.Email, "gid": person.ResourceName})
+				continue
+			}
+
+			c := PersonContact(person, user.Email)
+			c.Source = source
+			c.Synced = start
+
+			contacts = append(contacts, c)
+
+		}
+
+		// contacts with pending edits are not overwritten
+		contacts = HoldEditedContacts(user.Email, contacts)
+
+		// Add contacts count
+		syncer.Count = syncer.Count + len(contacts)
+
+		// Save contacts & photos to DB
+		SaveContacts(SaveContactPhotos(contacts))
+
+		syncer.LastPageToken = nextPage
+		CRUDSyncer(*syncer)
+
+		if nextSync != "" {
+			nextSyncToken = nextSync
+		}
+
+		if nextPage == "" {
+			break
+		}
+
+		pageToken = nextPage
+
+	}
+
+	if syncToken == "" {
+
+		// contacts synced before source was saved don't have it
+		sources := []interface{}{source}
+		if source == "connections" {
+			sources = append(sources, nil)
+		}
+
+		// contacts with pending edits are reported as conflicts
+		SoftDeleteContacts(bson.M{
+			"owner":   user.Email,
+			"gid":     bson.M{"$nin": HoldUnlistedContacts(user.Email, source, start)},
+			"source":  bson.M{"$in": sources},
+			"synced":  bson.M{"$not": bson.M{"$gte": start}},
+			"deleted": bson.M{"$exists": false},
+		})
+
+	}
+
+	return nextSyncToken, nil
+}
+
+// SoftDeleteContacts mark contacts as deleted, deleted contacts are not listed
+func SoftDeleteContacts(query bson.M) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "SoftDeleteContacts",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	_, err := DB.DB(os.Getenv("MONGO_DB")).C("contacts").UpdateAll(query, bson.M{"$set": bson.M{"deleted": time.Now()}})
+	if err != nil {
+		HandleError(proc, "error while deleting contacts", err, true)
+	}
+
+}
+
+// SyncContactGroups save all contact groups of user, removed groups are deleted
+func SyncContactGroups(svc *people.Service, user User) error {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "SyncContactGroups",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("contactGroups")
+
+	start := time.Now()
+
+	pageToken := ""
+	for {
+
+		req := svc.ContactGroups.List()
+		if pageToken != "" {
+			req.PageToken(pageToken)
+		}
+
+		r, err := req.Do()
+		if err != nil {
+			return err
+		}
+
+		for _, g := range r.ContactGroups {
+
+			if g.Metadata != nil && g.Metadata.Deleted {
+				continue
+			}
+
+			group := ContactGroup{
+				Owner:         user.Email,
+				GID:           g.ResourceName,
+				Name:          g.Name,
+				FormattedName: g.FormattedName,
+				Type:          g.GroupType,
+				MemberCount:   g.MemberCount,
+				Synced:        start,
+			}
+
+			_, err := DBC.Upsert(bson.M{"owner": user.Email, "gid": group.GID}, group)
+			if err != nil {
+				return err
+			}
+
+		}
+
+		if r.NextPageToken == "" {
+			break
+		}
+
+		pageToken = r.NextPageToken
+
+	}
+
+	_, err := DBC.RemoveAll(bson.M{"owner": user.Email, "synced": bson.M{"$lt": start}})
+
+	return err
+}
+
+// GetContactGroups return contact groups of user, system groups first
+func GetContactGroups(user User) []ContactGroup {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetContactGroups",
+	}
+
+	defer SaveLog(proc)
+
+	var groups []ContactGroup
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	err := DB.DB(os.Getenv("MONGO_DB")).C("contactGroups").Find(bson.M{"owner": user.Email}).All(&groups)
+	if err != nil {
+		HandleError(proc, "get contact groups", err, true)
+		return groups
+	}
+
+	sort.Slice(groups, func(i, j int) bool {
+
+		if groups[i].Type != groups[j].Type {
+			return groups[i].Type == "SYSTEM_CONTACT_GROUP"
+		}
+
+		return groups[i].FormattedName < groups[j].FormattedName
+	})
+
+	return groups
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"encoding/base64"
+	"encoding/json"
 	"fmt"
 	"html/template"
 	"io"
@@ -11,6 +12,7 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/globalsign/mgo/bson"
@@ -83,7 +85,112 @@ type ContactsPage struct {
 	View     string
 	N        Notifications
 	User     User
+	Query    string
+	Group    string
+	Groups   []ContactGroup
 	Contacts []Contact
+	Edits    []ContactEdit
+}
+
+// ContactEditPage struct for contact edit form
+type ContactEditPage struct {
+	URL        string
+	Logo       string
+	Name       string
+	View       string
+	N          Notifications
+	User       User
+	New        bool
+	Contact    Contact
+	Edit       ContactEdit
+	Pending    bool
+	Emails     string
+	Phones     string
+	URLs       string
+	Company    string
+	Title      string
+	Department string
+	Birthday   string
+}
+
+// ContactPage struct for contact details & email timeline
+type ContactPage struct {
+	URL      string
+	Logo     string
+	Name     string
+	View     string
+	N        Notifications
+	User     User
+	Contact  Contact
+	Timeline ContactTimeline
+}
+
+// DuplicatesPage struct for contact duplicates review
+type DuplicatesPage struct {
+	URL        string
+	Logo       string
+	Name       string
+	View       string
+	N          Notifications
+	User       User
+	Duplicates []ContactDuplicate
+	Merged     []ContactDuplicate
+}
+
+// CorrespondentsPage struct for correspondents page
+type CorrespondentsPage struct {
+	URL            string
+	Logo           string
+	Name           string
+	View           string
+	N              Notifications
+	User           User
+	Query          string
+	Unsaved        bool
+	Correspondents []Correspondent
+}
+
+// OrganizationsPage struct for organizations list & organization details
+type OrganizationsPage struct {
+	URL           string
+	Logo          string
+	Name          string
+	View          string
+	N             Notifications
+	User          User
+	Query         string
+	All           bool
+	Organizations []Organization
+	Organization  Organization
+}
+
+//RetentionPage struct for retention policies
+type RetentionPage struct {
+	URL        string
+	Logo       string
+	Name       string
+	View       string
+	N          Notifications
+	User       User
+	Labels     []Label
+	LabelNames map[string]string
+	Holds      []LegalHold
+	Policies   []RetentionPolicy
+	Purges     []RetentionPurge
+}
+
+// ExportPage struct for export page
+type ExportPage struct {
+	URL      string
+	Logo     string
+	Name     string
+	View     string
+	N        Notifications
+	User     User
+	Labels   []Label
+	Searches []SavedSearch
+	Exports  []Export
+	Targets  []string
 }
 
 //EsPage struct for email pages
@@ -102,6 +209,10 @@ type EsPage struct {
 	Search    ESearch
 	Labels    map[string][]Label
 	Emails    []Thread
+	Facets    []FacetGroup
+	Filters   []FacetItem
+	Saved     string
+	Searches  []SavedSearch
 }
 
 //EPage struct for email pages
@@ -155,19 +266,13 @@ var MailsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Reque
 		firstLabel, labelsList := GetLabelsList(user)
 		labelsByType := GetLabelsByType(user)
 
-		s := ESearch{
-			Query:   r.FormValue("search[query]"),
-			From:    r.FormValue("search[from]"),
-			To:      r.FormValue("search[to]"),
-			Subject: r.FormValue("search[subject]"),
-			Text:    r.FormValue("search[text]"),
-		}
+		s := GetESearch(r)
 
 		label := ""
 		label = r.FormValue("label")
 		if label == "" {
 
-			if firstLabel != "" && s.Query == "" {
+			if firstLabel != "" && s.IsEmpty() {
 				label = firstLabel
 			}
 
@@ -181,6 +286,29 @@ var MailsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Reque
 
 		pg, _ := strconv.Atoi(page)
 
+		if r.Method == "POST" && r.FormValue("saveSearch") != "" && r.FormValue("name") != "" {
+
+			CRUDSavedSearch(SavedSearch{
+				Owner:  user.Email,
+				Name:   r.FormValue("name"),
+				Label:  label,
+				Search: s,
+				Alert:  r.FormValue("alert") != "",
+			})
+
+		}
+
+		if r.Method == "POST" && r.FormValue("deleteSearch") != "" {
+			DeleteSavedSearch(r.FormValue("deleteSearch"), user.Email)
+		}
+
+		saved := r.FormValue("saved")
+		if search, ok := GetSavedSearch(saved, user.Email); ok && search.NewCount != 0 {
+			SeenSavedSearch(search.ID)
+		}
+
+		savedSearches := GetSavedSearches(user)
+
 		gp := GPagging{
 			MinCount:     pg * 50,
 			MaxCount:     (pg * 50) + 50,
@@ -199,6 +327,9 @@ var MailsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Reque
 			Label:     label,
 			Labels:    labelsByType,
 			Emails:    emails,
+			Filters:   GetActiveFacets(label, s, labelsList),
+			Saved:     saved,
+			Searches:  savedSearches,
 			Count:     gcount,
 			Paggining: gp,
 			Stats:     stats,
@@ -208,6 +339,29 @@ var MailsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Reque
 			p.LabelName = val
 		}
 
+		for _, search := range savedSearches {
+
+			if search.NewCount != 0 && search.ID.Hex() != saved {
+				AddNotification("Saved search", strconv.Itoa(search.NewCount)+" new threads match "+search.Name, "info", &p.N)
+			}
+
+		}
+
+		facets, err := GetFacets(user, label, s)
+		if err != nil {
+			HandleError(proc, "get facets", err, true)
+		}
+
+		p.Facets = GetFacetGroups(facets, label, s, labelsList)
+
+		if !s.IsEmpty() {
+
+			if _, err := ParseSearchQuery(s.QueryString()); err != nil {
+				AddNotification("Search", err.Error(), "danger", &p.N)
+			}
+
+		}
+
 		parsedTemplate, err := template.ParseFiles(
 			"template/index.html",
 			"template/header.html",
@@ -230,6 +384,75 @@ var MailsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Reque
 
 })
 
+// FacetsController return facet counts of label & search as json
+var FacetsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "FacetsController",
+	}
+
+	defer SaveLog(proc)
+
+	if CookieValid(r) == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user := GetUser(CookieValid(r))
+	s := GetESearch(r)
+	label := r.FormValue("label")
+
+	facets, err := GetFacets(user, label, s)
+	if err != nil {
+		HandleError(proc, "get facets", err, true)
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(struct {
+		Label   string                   `json:"label"`
+		Query   string                   `json:"query"`
+		Filters FacetFilter              `json:"filters"`
+		Facets  map[string][]SearchFacet `json:"facets"`
+	}{
+		Label:   label,
+		Query:   s.QueryString(),
+		Filters: s.Facets,
+		Facets:  facets,
+	})
+	if err != nil {
+		HandleError(proc, "encode facets", err, true)
+	}
+
+})
+
+// GetESearch return search & facet filters from request
+func GetESearch(r *http.Request) ESearch {
+
+	return ESearch{
+		Query:   r.FormValue("search[query]"),
+		From:    r.FormValue("search[from]"),
+		To:      r.FormValue("search[to]"),
+		Subject: r.FormValue("search[subject]"),
+		Text:    r.FormValue("search[text]"),
+		Sort:    r.FormValue("search[sort]"),
+		Facets: FacetFilter{
+			Domain:      r.FormValue("facet[domain]"),
+			Year:        r.FormValue("facet[year]"),
+			Month:       r.FormValue("facet[month]"),
+			Label:       r.FormValue("facet[label]"),
+			Attachment:  r.FormValue("facet[attachment]"),
+			MimeType:    r.FormValue("facet[mimeType]"),
+			Participant: r.FormValue("facet[participant]"),
+		},
+	}
+}
+
 // GetGMailsStats return gmail stats
 func GetGMailsStats(user User) GStats {
 
@@ -363,12 +586,20 @@ var AttachController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Requ
 
 		attachID := vars["attachID"]
 
-		a := GetAttachment(attachID)
+		user := GetUser(CookieValid(r))
+
+		// attachment IDs are unique only by owner
+		a := GetAttachment(user.Email, attachID)
+		if a.AttachID == "" {
+			http.NotFound(w, r)
+			return
+		}
 
-		for key, val := range a.Headers {
-			w.Header().Set(key, val)
+		for _, h := range a.Headers {
+			w.Header().Set(h.Name, h.Value)
 		}
 
+		w.Header().Set("Content-Disposition", ContentDisposition(a.Filename))
 		w.Header().Set("Expires", "0")
 		w.Header().Set("Content-Length", strconv.Itoa(int(a.Size)))
 
@@ -418,12 +649,47 @@ var ContactsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Re
 
 		u := GetUser(CookieValid(r))
 
+		query := r.FormValue("q")
+		group := r.FormValue("group")
+
 		p := ContactsPage{
 			Name:     "Contacts",
 			View:     "contacts",
 			URL:      os.Getenv("URL"),
 			User:     u,
-			Contacts: GetAllContacts(u),
+			Query:    query,
+			Group:    group,
+			Groups:   GetContactGroups(u),
+			Contacts: SearchContacts(u, query, group),
+			Edits:    GetContactEdits(u.Email),
+		}
+
+		// download contacts shown on page
+		format := r.FormValue("format")
+		if format == "vcf" {
+
+			w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+			w.Header().Set("Content-Disposition", ContentDisposition("contacts.vcf"))
+
+			if err := WriteContactsVCard(w, p.Contacts); err != nil {
+				HandleError(proc, "write vcard", err, true)
+			}
+
+			return
+
+		}
+
+		if layout, ok := contactCSVLayouts[format]; ok {
+
+			w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+			w.Header().Set("Content-Disposition", ContentDisposition("contacts-"+format+".csv"))
+
+			if err := WriteContactsCSV(w, p.Contacts, layout); err != nil {
+				HandleError(proc, "write csv", err, true)
+			}
+
+			return
+
 		}
 
 		parsedTemplate, err := template.ParseFiles(
@@ -448,14 +714,14 @@ var ContactsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Re
 
 })
 
-// SyncController handle token requests
-var SyncController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+// ContactEditController edit, create & delete contact, resolve conflicts with Google
+var ContactEditController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
 	proc := ServiceLog{
 		Start:   time.Now(),
 		Type:    "controller",
 		Service: "gapp",
-		Name:    "SyncController",
+		Name:    "ContactEditController",
 	}
 
 	defer SaveLog(proc)
@@ -466,138 +732,83 @@ var SyncController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Reques
 
 		u := GetUser(CookieValid(r))
 
-		if r.Method == "POST" {
-
-			if r.FormValue("labels") != "" && u.Token != nil {
-
-				s := Syncer{
-					CreatedBy: "user",
-					Owner:     u.Email,
-					Query:     "labels",
-					Type:      "init",
-					Start:     time.Now(),
-				}
+		contactID := mux.Vars(r)["contactID"]
 
-				// init save syncer
-				CRUDSyncer(s)
+		p := ContactEditPage{
+			Name: "Edit contact",
+			View: "contactedit",
+			URL:  os.Getenv("URL"),
+			User: u,
+			New:  contactID == "new",
+		}
 
-				go SyncGLabels(s)
+		if !p.New {
 
+			if !bson.IsObjectIdHex(contactID) {
+				http.NotFound(w, r)
+				return
 			}
 
-			if r.FormValue("contacts") != "" && u.Token != nil {
-
-				s := Syncer{
-					CreatedBy: "user",
-					Owner:     u.Email,
-					Query:     "contacts",
-					Type:      "init",
-					Start:     time.Now(),
-				}
-
-				// init save syncer
-				CRUDSyncer(s)
-
-				go SyncGPeople(s)
+			DB := MongoSession()
+			err := DB.DB(os.Getenv("MONGO_DB")).C("contacts").Find(bson.M{"_id": bson.ObjectIdHex(contactID), "owner": u.Email}).One(&p.Contact)
+			DB.Close()
 
+			if err != nil {
+				http.NotFound(w, r)
+				return
 			}
 
-			if r.FormValue("gmail") != "" && u.Token != nil {
-
-				query := " "
-				if r.FormValue("query") != "" {
-					query = r.FormValue("query")
-				}
-
-				s := Syncer{
-					CreatedBy:   "user",
-					Owner:       u.Email,
-					Query:       query,
-					Type:        r.FormValue("type"),
-					DeleteEmail: r.FormValue("deleteEmail"),
-					Start:       time.Now(),
-				}
-
-				// init save syncer
-				CRUDSyncer(s)
+		}
 
-				go SyncGMail(s)
+		if r.Method == "POST" {
 
+			var err error
+
+			switch {
+			case r.FormValue("keep") != "":
+				err = ResolveContactEdit(u, p.Contact.GID, true)
+			case r.FormValue("google") != "":
+				err = ResolveContactEdit(u, p.Contact.GID, false)
+			case r.FormValue("delete") != "":
+				_, err = EditContact(u, p.Contact.GID, "delete", Contact{})
+			case p.New:
+				_, err = EditContact(u, "", "create", ContactEditValues(r.FormValue))
+			default:
+				_, err = EditContact(u, p.Contact.GID, "update", ContactEditValues(r.FormValue))
 			}
 
-			if r.FormValue("cred") != "" {
-
-				// Parse our multipart form, 10 << 20 specifies a maximum
-				// upload of 10 MB files.
-				r.ParseMultipartForm(10 << 20)
-				// FormFile returns the first file for the given key `myFile`
-				// it also returns the FileHeader so we can get the Filename,
-				// the Header and the size of the file
-				file, _, err := r.FormFile("credentials")
-				if err != nil {
-					fmt.Println("Error Retrieving the File")
-					fmt.Println(err)
-					return
-				}
-				defer file.Close()
-				/*
-					fmt.Printf("Uploaded File: %+v\n", handler.Filename)
-					fmt.Printf("File Size: %+v\n", handler.Size)
-					fmt.Printf("MIME Header: %+v\n", handler.Header)
-				*/
-				// read all of the contents of our uploaded file into a
-				// byte array
-				fileBytes, err := ioutil.ReadAll(file)
-				if err != nil {
-					fmt.Println(err)
-				}
-
-				//https://godoc.org/golang.org/x/oauth2/jwt#Config
-				//JWTConfigFromJSON
-				// need to try
-				//axt.labels.set
-				/*
-					sourceToken, err := google.JWTAccessTokenSourceFromJSON(fileBytes, gmail.MailGoogleComScope)
-					if err != nil {
-						log.Fatal("jwt to conf | ", err)
-					}
-					st, _ := sourceToken.Token()
-
-					u.Token = st
-					u.Credentials = fileBytes
-
-					UpdateUser(u.ID.Hex(), u)
-				*/
-
-				// If modifying these scopes, delete your previously saved token.json.
-				config, err := google.ConfigFromJSON(fileBytes, gmail.MailGoogleComScope, people.ContactsScope)
-				if err != nil {
-					log.Fatalf("Unable to parse client secret file to config: %v", err)
-				}
-
-				config.RedirectURL = os.Getenv("URL") + "token/"
+			// edit is saved & shown on contacts page when push fail
+			if err != nil {
+				HandleError(proc, "edit contact", err, true)
+			}
 
-				u.Config = config
-				u.Credentials = fileBytes
+			http.Redirect(w, r, os.Getenv("URL")+"/contacts/", 301)
+			return
 
-				UpdateUser(u.ID.Hex(), u)
+		}
 
-				authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+		if !p.New {
+			p.Edit, p.Pending = GetContactEdit(u.Email, p.Contact.GID)
+		}
 
-				http.Redirect(w, r, authURL, 301)
+		if p.Pending && p.Edit.Conflict {
+			AddNotification("Conflict", p.Edit.Error+", keep your edit or use Google version", "warning", &p.N)
+		} else if p.Pending && p.Edit.Error != "" {
+			AddNotification("Not pushed", p.Edit.Error+", edit is pushed with next contacts sync", "danger", &p.N)
+		}
 
-			}
+		p.Emails = FormatContactValues(p.Contact.Emails)
+		p.Phones = FormatContactValues(p.Contact.Phones)
+		p.URLs = FormatContactValues(p.Contact.URLs)
 
+		// first organization is edited
+		if len(p.Contact.Organizations) != 0 && p.Contact.Organizations[0].From == "" {
+			o := p.Contact.Organizations[0]
+			p.Company, p.Title, p.Department = o.Name, o.Title, o.Department
 		}
 
-		syncers := GetAllSyncers(u)
-
-		p := SyncPage{
-			Name:    "Sync",
-			View:    "sync",
-			URL:     os.Getenv("URL"),
-			User:    u,
-			Syncers: syncers,
+		if len(p.Contact.Birthdays) != 0 {
+			p.Birthday = p.Contact.Birthdays[0]
 		}
 
 		parsedTemplate, err := template.ParseFiles(
@@ -622,6 +833,1087 @@ var SyncController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Reques
 
 })
 
+// DuplicatesController review, merge & dismiss contact duplicates
+var DuplicatesController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "DuplicatesController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		p := DuplicatesPage{
+			Name: "Duplicates",
+			View: "duplicates",
+			URL:  os.Getenv("URL"),
+			User: u,
+		}
+
+		if r.Method == "POST" {
+
+			switch {
+			case r.FormValue("find") != "":
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "duplicates",
+					Type:      "init",
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				// job is short, page show found duplicates
+				DetectContactDuplicates(s)
+
+				AddNotification("Duplicates", "Duplicates search finished", "success", &p.N)
+
+			case r.FormValue("merge") != "":
+
+				if err := MergeDuplicate(u.Email, r.FormValue("merge"), r.FormValue("primary")); err != nil {
+					HandleError(proc, "merge duplicate", err, true)
+					AddNotification("Duplicates", "Merge failed", "danger", &p.N)
+				} else {
+					AddNotification("Duplicates", "Contacts merged", "success", &p.N)
+				}
+
+			case r.FormValue("dismiss") != "":
+
+				if err := DismissDuplicate(u.Email, r.FormValue("dismiss")); err != nil {
+					HandleError(proc, "dismiss duplicate", err, true)
+					AddNotification("Duplicates", "Dismiss failed", "danger", &p.N)
+				} else {
+					AddNotification("Duplicates", "Contacts are kept separate", "success", &p.N)
+				}
+
+			}
+
+		}
+
+		p.Duplicates = GetContactDuplicates(u.Email, "open")
+		p.Merged = GetContactDuplicates(u.Email, "merged")
+
+		parsedTemplate, err := template.ParseFiles(
+			"template/index.html",
+			"template/header.html",
+			"template/views/"+p.View+".html",
+		)
+
+		if err != nil {
+			log.Println("Error ParseFiles: "+p.View, err)
+			return
+		}
+
+		err = parsedTemplate.Execute(w, p)
+
+		if err != nil {
+			log.Println("Error Execute:", err)
+			return
+		}
+
+	}
+
+})
+
+// CorrespondentsController list correspondents derived from headers
+var CorrespondentsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "CorrespondentsController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		query := r.FormValue("q")
+		unsaved := r.FormValue("unsaved") != ""
+
+		p := CorrespondentsPage{
+			Name:           "Correspondents",
+			View:           "correspondents",
+			URL:            os.Getenv("URL"),
+			User:           u,
+			Query:          query,
+			Unsaved:        unsaved,
+			Correspondents: SearchCorrespondents(u, query, unsaved),
+		}
+
+		parsedTemplate, err := template.ParseFiles(
+			"template/index.html",
+			"template/header.html",
+			"template/views/"+p.View+".html",
+		)
+
+		if err != nil {
+			log.Println("Error ParseFiles: "+p.View, err)
+			return
+		}
+
+		err = parsedTemplate.Execute(w, p)
+
+		if err != nil {
+			log.Println("Error Execute:", err)
+			return
+		}
+
+	}
+
+})
+
+// ContactController show contact with threads where contact is in from, to or cc
+var ContactController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "ContactController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		c, err := GetContact(u.Email, mux.Vars(r)["contactID"])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		p := ContactPage{
+			Name:    c.FullName(),
+			View:    "contact",
+			URL:     os.Getenv("URL"),
+			User:    u,
+			Contact: c,
+		}
+
+		p.Timeline, err = GetContactTimeline(u.Email, c)
+		if err != nil {
+			HandleError(proc, "get contact timeline", err, true)
+			AddNotification("Timeline", "Unable to load emails of contact", "danger", &p.N)
+		}
+
+		parsedTemplate, err := template.ParseFiles(
+			"template/index.html",
+			"template/header.html",
+			"template/views/"+p.View+".html",
+		)
+
+		if err != nil {
+			log.Println("Error ParseFiles: "+p.View, err)
+			return
+		}
+
+		err = parsedTemplate.Execute(w, p)
+
+		if err != nil {
+			log.Println("Error Execute:", err)
+			return
+		}
+
+	}
+
+})
+
+// ContactTimelineController return contact email timeline as json
+var ContactTimelineController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "ContactTimelineController",
+	}
+
+	defer SaveLog(proc)
+
+	if CookieValid(r) == "" {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	user := GetUser(CookieValid(r))
+
+	c, err := GetContact(user.Email, mux.Vars(r)["contactID"])
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+
+	timeline, err := GetContactTimeline(user.Email, c)
+	if err != nil {
+		HandleError(proc, "get contact timeline", err, true)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	err = json.NewEncoder(w).Encode(struct {
+		ContactID string          `json:"contactID"`
+		Name      string          `json:"name"`
+		Timeline  ContactTimeline `json:"timeline"`
+	}{
+		ContactID: c.ID.Hex(),
+		Name:      c.FullName(),
+		Timeline:  timeline,
+	})
+	if err != nil {
+		HandleError(proc, "encode contact timeline", err, true)
+	}
+
+})
+
+// OrganizationsController list organizations, exclude & include organization
+var OrganizationsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "OrganizationsController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		query := r.FormValue("q")
+		all := r.FormValue("all") != ""
+
+		p := OrganizationsPage{
+			Name:  "Organizations",
+			View:  "organizations",
+			URL:   os.Getenv("URL"),
+			User:  u,
+			Query: query,
+			All:   all,
+		}
+
+		if r.Method == "POST" {
+
+			id := r.FormValue("exclude")
+			excluded := id != ""
+			if !excluded {
+				id = r.FormValue("include")
+			}
+
+			if err := ExcludeOrganization(u.Email, id, excluded); err != nil {
+				HandleError(proc, "exclude organization", err, true)
+				AddNotification("Organizations", "Unable to change organization", "danger", &p.N)
+			}
+
+		}
+
+		p.Organizations = SearchOrganizations(u, query, all)
+
+		parsedTemplate, err := template.ParseFiles(
+			"template/index.html",
+			"template/header.html",
+			"template/views/"+p.View+".html",
+		)
+
+		if err != nil {
+			log.Println("Error ParseFiles: "+p.View, err)
+			return
+		}
+
+		err = parsedTemplate.Execute(w, p)
+
+		if err != nil {
+			log.Println("Error Execute:", err)
+			return
+		}
+
+	}
+
+})
+
+// OrganizationController show people, volume over time & top attachments of organization
+var OrganizationController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "OrganizationController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		org, err := GetOrganization(u.Email, mux.Vars(r)["organizationID"])
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		p := OrganizationsPage{
+			Name:         org.Name,
+			View:         "organization",
+			URL:          os.Getenv("URL"),
+			User:         u,
+			Organization: org,
+		}
+
+		parsedTemplate, err := template.ParseFiles(
+			"template/index.html",
+			"template/header.html",
+			"template/views/"+p.View+".html",
+		)
+
+		if err != nil {
+			log.Println("Error ParseFiles: "+p.View, err)
+			return
+		}
+
+		err = parsedTemplate.Execute(w, p)
+
+		if err != nil {
+			log.Println("Error Execute:", err)
+			return
+		}
+
+	}
+
+})
+
+// ContactPhotoController return saved contact photo
+var ContactPhotoController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "ContactPhotoController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		contactID := mux.Vars(r)["contactID"]
+		if !bson.IsObjectIdHex(contactID) {
+			http.NotFound(w, r)
+			return
+		}
+
+		DB := MongoSession()
+		defer DB.Close()
+		db := DB.DB(os.Getenv("MONGO_DB"))
+
+		var c Contact
+		err := db.C("contacts").Find(bson.M{"_id": bson.ObjectIdHex(contactID), "owner": u.Email}).Select(bson.M{"photos": 1}).One(&c)
+		if err != nil {
+			http.NotFound(w, r)
+			return
+		}
+
+		for _, photo := range c.Photos {
+
+			if photo.GridID == "" {
+				continue
+			}
+
+			gridFile, err := db.GridFS("contactPhotos").OpenId(photo.GridID)
+			if err != nil {
+				HandleError(proc, "open contact photo", err, true)
+				break
+			}
+
+			defer gridFile.Close()
+
+			w.Header().Set("Content-Type", photo.ContentType)
+			w.Header().Set("Content-Length", strconv.FormatInt(gridFile.Size(), 10))
+			w.Header().Set("Cache-Control", "private, max-age=86400")
+
+			io.Copy(w, gridFile)
+
+			return
+
+		}
+
+		http.NotFound(w, r)
+
+	}
+
+})
+
+// SyncController handle token requests
+var SyncController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "SyncController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		if r.Method == "POST" {
+
+			if r.FormValue("labels") != "" && u.Token != nil {
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "labels",
+					Type:      "init",
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go SyncGLabels(s)
+
+			}
+
+			if r.FormValue("contacts") != "" && u.Token != nil {
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "contacts",
+					Type:      "init",
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go SyncGPeople(s)
+
+			}
+
+			if r.FormValue("headers") != "" {
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "headers",
+					Type:      "init",
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go ReprocessHeaders(s)
+
+			}
+
+			if r.FormValue("correspondents") != "" {
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "correspondents",
+					Type:      "init",
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go DeriveCorrespondents(s)
+
+			}
+
+			if r.FormValue("organizations") != "" {
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "organizations",
+					Type:      "init",
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go DeriveOrganizations(s)
+
+			}
+
+			if r.FormValue("extract") != "" {
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "extract",
+					Type:      "init",
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go ExtractAttachmentsText(s)
+
+			}
+
+			if r.FormValue("reindex") != "" {
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "reindex",
+					Type:      "init",
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go ReindexMessages(s)
+
+			}
+
+			if r.FormValue("imap") != "" && r.FormValue("host") != "" {
+
+				port, _ := strconv.Atoi(r.FormValue("port"))
+
+				src := IMAPSource{
+					Host:     r.FormValue("host"),
+					Port:     port,
+					Username: r.FormValue("username"),
+					Password: r.FormValue("password"),
+					Security: r.FormValue("security"),
+				}
+
+				for _, f := range strings.Split(r.FormValue("folders"), ",") {
+					if f = strings.TrimSpace(f); f != "" {
+						src.Folders = append(src.Folders, f)
+					}
+				}
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "imap " + src.Account(),
+					Type:      r.FormValue("type"),
+					Source:    "imap",
+					IMAP:      &src,
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go SyncIMAP(s)
+
+			}
+
+			if r.FormValue("import") != "" {
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "import",
+					Type:      "init",
+					Start:     time.Now(),
+				}
+
+				if name := r.FormValue("path"); name != "" && os.Getenv("IMPORT_PATH") != "" {
+
+					// files are read only from import directory of user
+					filename, err := ImportFile(u.Email, name)
+					if err != nil {
+						HandleError(proc, "import file "+name, err, true)
+						return
+					}
+
+					s.Query = "import " + name
+
+					CRUDSyncer(s)
+
+					go ImportMbox(s, filename, false)
+
+				} else if file, handler, err := r.FormFile("mbox"); err == nil {
+
+					defer file.Close()
+
+					dir, err := ImportDir(u.Email)
+					if err != nil {
+						HandleError(proc, "create import directory", err, true)
+						return
+					}
+
+					tmp, err := ioutil.TempFile(dir, importUpload)
+					if err != nil {
+						HandleError(proc, "create import file", err, true)
+						return
+					}
+
+					_, err = io.Copy(tmp, file)
+					tmp.Close()
+					if err != nil {
+						os.Remove(tmp.Name())
+						HandleError(proc, "save import file", err, true)
+						return
+					}
+
+					s.Query = "import " + handler.Filename
+
+					CRUDSyncer(s)
+
+					go ImportMbox(s, tmp.Name(), true)
+
+				}
+
+			}
+
+			if r.FormValue("gmail") != "" && u.Token != nil {
+
+				query := " "
+				if r.FormValue("query") != "" {
+					query = r.FormValue("query")
+				}
+
+				s := Syncer{
+					CreatedBy:   "user",
+					Owner:       u.Email,
+					Query:       query,
+					Type:        r.FormValue("type"),
+					DeleteEmail: r.FormValue("deleteEmail"),
+					Start:       time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go SyncGMail(s)
+
+			}
+
+			if r.FormValue("cred") != "" {
+
+				// Parse our multipart form, 10 << 20 specifies a maximum
+				// upload of 10 MB files.
+				r.ParseMultipartForm(10 << 20)
+				// FormFile returns the first file for the given key `myFile`
+				// it also returns the FileHeader so we can get the Filename,
+				// the Header and the size of the file
+				file, _, err := r.FormFile("credentials")
+				if err != nil {
+					fmt.Println("Error Retrieving the File")
+					fmt.Println(err)
+					return
+				}
+				defer file.Close()
+				/*
+					fmt.Printf("Uploaded File: %+v\n", handler.Filename)
+					fmt.Printf("File Size: %+v\n", handler.Size)
+					fmt.Printf("MIME Header: %+v\n", handler.Header)
+				*/
+				// read all of the contents of our uploaded file into a
+				// byte array
+				fileBytes, err := ioutil.ReadAll(file)
+				if err != nil {
+					fmt.Println(err)
+				}
+
+				//https://godoc.org/golang.org/x/oauth2/jwt#Config
+				//JWTConfigFromJSON
+				// need to try
+				//axt.labels.set
+				/*
+					sourceToken, err := google.JWTAccessTokenSourceFromJSON(fileBytes, gmail.MailGoogleComScope)
+					if err != nil {
+						log.Fatal("jwt to conf | ", err)
+					}
+					st, _ := sourceToken.Token()
+
+					u.Token = st
+					u.Credentials = fileBytes
+
+					UpdateUser(u.ID.Hex(), u)
+				*/
+
+				// If modifying these scopes, delete your previously saved token.json.
+				config, err := google.ConfigFromJSON(fileBytes, gmail.MailGoogleComScope, people.ContactsScope, people.ContactsOtherReadonlyScope)
+				if err != nil {
+					log.Fatalf("Unable to parse client secret file to config: %v", err)
+				}
+
+				config.RedirectURL = os.Getenv("URL") + "token/"
+
+				u.Config = config
+				u.Credentials = fileBytes
+
+				UpdateUser(u.ID.Hex(), u)
+
+				authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline, oauth2.ApprovalForce)
+
+				http.Redirect(w, r, authURL, 301)
+
+			}
+
+		}
+
+		syncers := GetAllSyncers(u)
+
+		p := SyncPage{
+			Name:    "Sync",
+			View:    "sync",
+			URL:     os.Getenv("URL"),
+			User:    u,
+			Syncers: syncers,
+		}
+
+		parsedTemplate, err := template.ParseFiles(
+			"template/index.html",
+			"template/header.html",
+			"template/views/"+p.View+".html",
+		)
+
+		if err != nil {
+			log.Println("Error ParseFiles: "+p.View, err)
+			return
+		}
+
+		err = parsedTemplate.Execute(w, p)
+
+		if err != nil {
+			log.Println("Error Execute:", err)
+			return
+		}
+
+	}
+
+})
+
+// RetentionController handle retention policies requests
+var RetentionController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "RetentionController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		if r.Method == "POST" {
+
+			if r.FormValue("policy") != "" {
+
+				days, _ := strconv.Atoi(r.FormValue("days"))
+
+				if days > 0 {
+
+					CRUDRetentionPolicy(RetentionPolicy{
+						Owner:  u.Email,
+						Name:   r.FormValue("name"),
+						Label:  r.FormValue("label"),
+						Domain: r.FormValue("domain"),
+						Days:   days,
+					})
+
+				}
+
+			}
+
+			if r.FormValue("deletePolicy") != "" {
+				DeleteRetentionPolicy(u, r.FormValue("deletePolicy"))
+			}
+
+			if r.FormValue("hold") != "" && r.FormValue("label") != "" {
+
+				CRUDLegalHold(LegalHold{
+					Owner:   u.Email,
+					LabelID: r.FormValue("label"),
+					Reason:  r.FormValue("reason"),
+				})
+
+			}
+
+			if r.FormValue("release") != "" {
+				DeleteLegalHold(u, r.FormValue("release"))
+			}
+
+		}
+
+		_, labelNames := GetLabelsList(u)
+
+		p := RetentionPage{
+			Name:       "Retention",
+			View:       "retention",
+			URL:        os.Getenv("URL"),
+			User:       u,
+			Labels:     GetLabels(u),
+			LabelNames: labelNames,
+			Holds:      GetLegalHolds(u.Email),
+			Policies:   GetRetentionPolicies(u),
+			Purges:     GetRetentionPurges(u),
+		}
+
+		parsedTemplate, err := template.ParseFiles(
+			"template/index.html",
+			"template/header.html",
+			"template/views/"+p.View+".html",
+		)
+
+		if err != nil {
+			log.Println("Error ParseFiles: "+p.View, err)
+			return
+		}
+
+		err = parsedTemplate.Execute(w, p)
+
+		if err != nil {
+			log.Println("Error Execute:", err)
+			return
+		}
+
+	}
+
+})
+
+// ExportsController start exports & list them
+var ExportsController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "ExportsController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		p := ExportPage{
+			Name: "Export",
+			View: "exports",
+			URL:  os.Getenv("URL"),
+			User: u,
+		}
+
+		if r.Method == "POST" && r.FormValue("export") != "" {
+
+			e := Export{
+				Owner:       u.Email,
+				Format:      r.FormValue("format"),
+				Label:       r.FormValue("label"),
+				SavedSearch: r.FormValue("savedSearch"),
+				After:       r.FormValue("after"),
+				Before:      r.FormValue("before"),
+				Start:       time.Now(),
+			}
+
+			if e.Format == "" {
+				e.Format = "mbox"
+			}
+
+			e.Filename = "gapp-" + time.Now().Format("2006-01-02-150405") + "." + e.Format
+			if e.Format != "mbox" {
+				e.Filename = "gapp-" + time.Now().Format("2006-01-02-150405") + "-" + e.Format + ".zip"
+			}
+
+			if !exportFormats[e.Format] {
+
+				AddNotification("Export", "Unknown export format", "danger", &p.N)
+
+			} else if e.Format != "bundle" && e.Label == "" && e.SavedSearch == "" && e.After == "" && e.Before == "" {
+
+				// bundle export whole account
+				AddNotification("Export", "Select label, saved search or date range", "danger", &p.N)
+
+			} else {
+
+				e = CRUDExport(e)
+
+				go RunExport(e)
+
+				AddNotification("Export", "Export started", "success", &p.N)
+
+			}
+
+		}
+
+		if r.Method == "POST" && r.FormValue("restore") != "" {
+
+			sel := RestoreSelection{
+				Target:      r.FormValue("target"),
+				Label:       r.FormValue("label"),
+				SavedSearch: r.FormValue("savedSearch"),
+				After:       r.FormValue("after"),
+				Before:      r.FormValue("before"),
+			}
+
+			// thread IDs are separated by commas or spaces
+			sel.ThreadIDs = strings.Fields(strings.Replace(r.FormValue("threads"), ",", " ", -1))
+
+			if sel.Target == "" {
+				sel.Target = u.Email
+			}
+
+			if sel.IsEmpty() {
+
+				AddNotification("Restore", "Select threads, label, saved search or date range", "danger", &p.N)
+
+			} else if !RestoreTarget(u, sel.Target) {
+
+				AddNotification("Restore", "Gmail account can't be used for restore", "danger", &p.N)
+
+			} else if GetUserByEmail(sel.Target).Token == nil {
+
+				AddNotification("Restore", "Gmail account is not connected", "danger", &p.N)
+
+			} else {
+
+				s := Syncer{
+					CreatedBy: "user",
+					Owner:     u.Email,
+					Query:     "restore",
+					Type:      "init",
+					Restore:   &sel,
+					Start:     time.Now(),
+				}
+
+				// init save syncer
+				CRUDSyncer(s)
+
+				go RestoreMessages(s)
+
+				AddNotification("Restore", "Restore started, progress is shown on sync page", "success", &p.N)
+
+			}
+
+		}
+
+		p.Labels = GetLabels(u)
+		p.Searches = GetSavedSearches(u)
+		p.Exports = GetExports(u.Email)
+		p.Targets = RestoreTargets(u)
+
+		parsedTemplate, err := template.ParseFiles(
+			"template/index.html",
+			"template/header.html",
+			"template/views/"+p.View+".html",
+		)
+
+		if err != nil {
+			log.Println("Error ParseFiles: "+p.View, err)
+			return
+		}
+
+		err = parsedTemplate.Execute(w, p)
+
+		if err != nil {
+			log.Println("Error Execute:", err)
+			return
+		}
+
+	}
+
+})
+
+// ExportController download export file
+var ExportController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "controller",
+		Service: "gapp",
+		Name:    "ExportController",
+	}
+
+	defer SaveLog(proc)
+
+	redirect := CheckAuth(w, r, false, "/login")
+
+	if !redirect {
+
+		u := GetUser(CookieValid(r))
+
+		e, ok := GetExport(mux.Vars(r)["exportID"], u.Email)
+		if !ok || e.Status != "end" {
+			http.NotFound(w, r)
+			return
+		}
+
+		DB := MongoSession()
+		defer DB.Close()
+
+		gridFile, err := DB.DB(os.Getenv("MONGO_DB")).GridFS("exports").OpenId(e.GridID)
+		if err != nil {
+			HandleError(proc, "open export", err, true)
+			http.NotFound(w, r)
+			return
+		}
+
+		defer gridFile.Close()
+
+		w.Header().Set("Content-Type", ExportContentType(e.Format))
+		w.Header().Set("Content-Disposition", ContentDisposition(e.Filename))
+		w.Header().Set("Content-Length", strconv.FormatInt(gridFile.Size(), 10))
+
+		io.Copy(w, gridFile)
+
+	}
+
+})
+
 // TokenController handle token requests
 var TokenController = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 
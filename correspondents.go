@@ -0,0 +1,344 @@
+package main
+
+import (
+	"net/mail"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// Correspondent email address derived from message headers
+// received are messages from address, sent are messages of owner to address
+type Correspondent struct {
+	ID          bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner       string        `json:"owner" bson:"owner,omitempty"`
+	Email       string        `json:"email" bson:"email,omitempty"`
+	Names       []string      `json:"names" bson:"names,omitempty"`
+	FirstSeen   time.Time     `json:"firstSeen" bson:"firstSeen,omitempty"`
+	LastSeen    time.Time     `json:"lastSeen" bson:"lastSeen,omitempty"`
+	Received    int           `json:"received" bson:"received"`
+	Sent        int           `json:"sent" bson:"sent"`
+	Threads     []string      `json:"threads" bson:"threads,omitempty"`
+	ThreadCount int           `json:"threadCount" bson:"threadCount"`
+	ContactID   bson.ObjectId `json:"contactID" bson:"contactID,omitempty"`
+	ContactName string        `json:"contactName" bson:"contactName,omitempty"`
+	Derived     time.Time     `json:"derived" bson:"derived,omitempty"`
+}
+
+// maxCorrespondentNames max display name variants saved
+const maxCorrespondentNames = 10
+
+// AddName add display name variant
+func (c *Correspondent) AddName(name string) {
+
+	name = strings.TrimSpace(strings.Trim(name, `"' `))
+	if name == "" || strings.EqualFold(name, c.Email) || len(c.Names) >= maxCorrespondentNames {
+		return
+	}
+
+	for _, n := range c.Names {
+		if n == name {
+			return
+		}
+	}
+
+	c.Names = append(c.Names, name)
+}
+
+// Seen update first & last seen date and shared threads
+func (c *Correspondent) Seen(date time.Time, threadID string, threads map[string]bool) {
+
+	if !date.IsZero() {
+
+		if c.FirstSeen.IsZero() || date.Before(c.FirstSeen) {
+			c.FirstSeen = date
+		}
+
+		if date.After(c.LastSeen) {
+			c.LastSeen = date
+		}
+
+	}
+
+	if threadID != "" && !threads[threadID] {
+		threads[threadID] = true
+		c.Threads = append(c.Threads, threadID)
+	}
+
+}
+
+// HeaderAddresses return emails with display names of header, emails without name are taken from normalized emails
+func HeaderAddresses(value, emails string) map[string]string {
+
+	addresses := make(map[string]string)
+
+	for _, e := range strings.Split(emails, ",") {
+		if e = strings.TrimSpace(e); e != "" {
+			addresses[e] = ""
+		}
+	}
+
+	if list, err := mail.ParseAddressList(value); err == nil {
+		for _, a := range list {
+			email := strings.ToLower(a.Address)
+			if _, ok := addresses[email]; ok || emails == "" {
+				addresses[email] = a.Name
+			}
+		}
+	}
+
+	return addresses
+}
+
+// DeriveCorrespondents build correspondents of owner from from, to & cc headers of messages
+// correspondents are rebuilt & merged with contacts by email
+func DeriveCorrespondents(syncer Syncer) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "DeriveCorrespondents",
+	}
+
+	defer SaveLog(proc)
+
+	syncer.Status = "start"
+	CRUDSyncer(syncer)
+
+	start := time.Now()
+	owner := strings.ToLower(syncer.Owner)
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	correspondents := make(map[string]*Correspondent)
+	threads := make(map[string]map[string]bool)
+
+	get := func(email string) *Correspondent {
+
+		c, ok := correspondents[email]
+		if !ok {
+			c = &Correspondent{Owner: syncer.Owner, Email: email}
+			correspondents[email] = c
+			threads[email] = make(map[string]bool)
+		}
+
+		return c
+	}
+
+	var msg Message
+	iter := db.C("messages").Find(bson.M{"owner": syncer.Owner}).Select(bson.M{
+		"threadID":     1,
+		"internalDate": 1,
+		"labels":       1,
+		"from":         1,
+		"fromEmails":   1,
+		"to":           1,
+		"toEmails":     1,
+		"cc":           1,
+		"ccEmails":     1,
+	}).Iter()
+
+	for iter.Next(&msg) {
+
+		from := HeaderAddresses(msg.From, msg.FromEmails)
+
+		_, outgoing := from[owner]
+		for _, l := range msg.Labels {
+			if l == "SENT" {
+				outgoing = true
+			}
+		}
+
+		for email, name := range from {
+
+			if email == owner {
+				continue
+			}
+
+			c := get(email)
+			c.AddName(name)
+			c.Seen(msg.InternalDate, msg.ThreadID, threads[email])
+
+			if !outgoing {
+				c.Received++
+			}
+
+		}
+
+		for _, header := range [][2]string{{msg.To, msg.ToEmails}, {msg.CC, msg.CCEmails}} {
+
+			for email, name := range HeaderAddresses(header[0], header[1]) {
+
+				if email == owner {
+					continue
+				}
+
+				c := get(email)
+				c.AddName(name)
+				c.Seen(msg.InternalDate, msg.ThreadID, threads[email])
+
+				if outgoing {
+					c.Sent++
+				}
+
+			}
+
+		}
+
+		syncer.Count++
+		msg = Message{}
+
+		if syncer.Count%1000 == 0 {
+			syncer.Status = "messages " + strconv.Itoa(syncer.Count) + ", correspondents " + strconv.Itoa(len(correspondents))
+			CRUDSyncer(syncer)
+		}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "iterate messages", err, true)
+		syncer.Status = "error:" + err.Error()
+		CRUDSyncer(syncer)
+		return
+	}
+
+	DBC := db.C("correspondents")
+
+	for email, c := range correspondents {
+
+		c.ThreadCount = len(c.Threads)
+		c.Derived = start
+
+		_, err := DBC.Upsert(bson.M{"owner": syncer.Owner, "email": email}, c)
+		if err != nil {
+			HandleError(proc, "save correspondent "+email, err, true)
+		}
+
+	}
+
+	_, err := DBC.RemoveAll(bson.M{"owner": syncer.Owner, "derived": bson.M{"$lt": start}})
+	if err != nil {
+		HandleError(proc, "remove correspondents", err, true)
+	}
+
+	LinkCorrespondents(syncer.Owner)
+
+	syncer.End = time.Now()
+	syncer.Status = "end"
+	CRUDSyncer(syncer)
+
+}
+
+// LinkCorrespondents set contact of correspondents with same email
+func LinkCorrespondents(owner string) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "LinkCorrespondents",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	_, err := db.C("correspondents").UpdateAll(bson.M{"owner": owner}, bson.M{"$unset": bson.M{"contactID": "", "contactName": ""}})
+	if err != nil {
+		HandleError(proc, "unlink correspondents", err, true)
+		return
+	}
+
+	var c Contact
+	iter := db.C("contacts").Find(bson.M{
+		"owner":      owner,
+		"deleted":    bson.M{"$exists": false},
+		"mergedInto": bson.M{"$exists": false},
+	}).Select(bson.M{"firstName": 1, "lastName": 1, "company": 1, "email": 1, "emails": 1, "source": 1}).Sort("source").Iter()
+
+	for iter.Next(&c) {
+
+		emails := map[string]bool{}
+		if c.Email != "" {
+			emails[strings.ToLower(c.Email)] = true
+		}
+		for _, e := range c.Emails {
+			emails[strings.ToLower(e.Value)] = true
+		}
+
+		for email := range emails {
+
+			// contact is set once, connections are sorted before other contacts
+			_, err := db.C("correspondents").UpdateAll(bson.M{
+				"owner":     owner,
+				"email":     email,
+				"contactID": bson.M{"$exists": false},
+			}, bson.M{"$set": bson.M{"contactID": c.ID, "contactName": c.FullName()}})
+			if err != nil {
+				HandleError(proc, "link correspondent "+email, err, true)
+			}
+
+		}
+
+		c = Contact{}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "iterate contacts", err, true)
+	}
+
+}
+
+// SearchCorrespondents return correspondents of user matching query by email or name, most recent first
+func SearchCorrespondents(user User, query string, unsaved bool) []Correspondent {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "SearchCorrespondents",
+	}
+
+	defer SaveLog(proc)
+
+	var correspondents []Correspondent
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	mquery := bson.M{"owner": user.Email}
+
+	if query = strings.TrimSpace(query); query != "" {
+
+		contains := bson.RegEx{Pattern: regexp.QuoteMeta(query), Options: "i"}
+
+		mquery["$or"] = []bson.M{
+			{"email": contains},
+			{"names": contains},
+			{"contactName": contains},
+		}
+
+	}
+
+	if unsaved {
+		mquery["contactID"] = bson.M{"$exists": false}
+	}
+
+	err := DB.DB(os.Getenv("MONGO_DB")).C("correspondents").Find(mquery).Select(bson.M{"threads": 0}).Sort("-lastSeen").Limit(500).All(&correspondents)
+	if err != nil {
+		HandleError(proc, "get correspondents", err, true)
+		return correspondents
+	}
+
+	return correspondents
+}
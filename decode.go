@@ -0,0 +1,434 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"mime"
+	"net/url"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"golang.org/x/text/encoding/htmlindex"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// MessageBodyPart decoding details of single text part
+type MessageBodyPart struct {
+	PartID           string `json:"partID" bson:"partID,omitempty"`
+	MimeType         string `json:"mimeType" bson:"mimeType,omitempty"`
+	Charset          string `json:"charset" bson:"charset,omitempty"`
+	TransferEncoding string `json:"transferEncoding" bson:"transferEncoding,omitempty"`
+	Size             int    `json:"size" bson:"size,omitempty"`
+	Error            string `json:"error" bson:"error,omitempty"`
+}
+
+// extParam rfc 2231 parameter, with optional continuation index & charset
+var extParam = regexp.MustCompile(`(?i)(?:^|;)\s*([a-z0-9_-]+)\*(?:(\d+)(\*)?|(\*)?)\s*=\s*("(?:[^"\\]|\\.)*"|[^;\s]*)`)
+
+// wordDecoder decode rfc 2047 encoded words in any charset known to htmlindex
+var wordDecoder = mime.WordDecoder{
+	CharsetReader: func(charset string, input io.Reader) (io.Reader, error) {
+
+		enc, err := htmlindex.Get(charset)
+		if err != nil {
+			return nil, err
+		}
+
+		return enc.NewDecoder().Reader(input), nil
+	},
+}
+
+// GetPartHeader return first header value by name, case insensitive
+func GetPartHeader(headers []*gmail.MessagePartHeader, name string) string {
+
+	if len(headers) != 0 {
+
+		for _, h := range headers {
+
+			if strings.EqualFold(h.Name, name) {
+				return h.Value
+			}
+
+		}
+
+	}
+
+	return ""
+}
+
+// DecodeBodyData decode base64url body data from gmail api
+func DecodeBodyData(data string) ([]byte, error) {
+
+	decoded, err := base64.URLEncoding.DecodeString(data)
+	if err == nil {
+		return decoded, nil
+	}
+
+	// gmail sometimes omits padding
+	decoded, rerr := base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+	if rerr == nil {
+		return decoded, nil
+	}
+
+	return nil, err
+}
+
+// DecodeCharset convert body from charset to utf-8
+func DecodeCharset(body []byte, charset string) (string, error) {
+
+	charset = strings.Trim(strings.TrimSpace(charset), `"'`)
+	if charset == "" {
+		charset = "utf-8"
+	}
+
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+
+		// unknown charset, keep what is valid utf-8
+		enc, _ = htmlindex.Get("utf-8")
+		decoded, _ := enc.NewDecoder().Bytes(body)
+
+		return string(decoded), errors.New("unknown charset " + charset)
+	}
+
+	decoded, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return "", err
+	}
+
+	return string(decoded), nil
+}
+
+// DecodePartBody decode gmail message part body to utf-8 text
+// body data is already transfer decoded by gmail, raw messages are decoded while parsing
+func DecodePartBody(p *gmail.MessagePart) (string, MessageBodyPart) {
+
+	part := MessageBodyPart{
+		PartID:           p.PartId,
+		MimeType:         p.MimeType,
+		TransferEncoding: GetPartHeader(p.Headers, "Content-Transfer-Encoding"),
+	}
+
+	if contentType := GetPartHeader(p.Headers, "Content-Type"); contentType != "" {
+
+		_, params, err := mime.ParseMediaType(contentType)
+		if err == nil {
+			part.Charset = params["charset"]
+		}
+
+	}
+
+	if p.Body == nil || p.Body.Data == "" {
+		return "", part
+	}
+
+	body, err := DecodeBodyData(p.Body.Data)
+	if err != nil {
+		part.Error = "body: " + err.Error()
+		return "", part
+	}
+
+	text, err := DecodeCharset(body, part.Charset)
+	if err != nil {
+
+		if part.Error != "" {
+			part.Error = part.Error + "; "
+		}
+
+		part.Error = part.Error + "charset: " + err.Error()
+	}
+
+	part.Size = len(text)
+
+	return text, part
+}
+
+// DecodeHeader decode rfc 2047 encoded words, value is returned as is on error
+func DecodeHeader(value string) string {
+
+	if !strings.Contains(value, "=?") {
+		return value
+	}
+
+	decoded, err := wordDecoder.DecodeHeader(value)
+	if err != nil {
+		return value
+	}
+
+	return decoded
+}
+
+// DecodeExtParam return rfc 2231 parameter from header value, joined from continuations
+func DecodeExtParam(value, name string) string {
+
+	type segment struct {
+		index   int
+		encoded bool
+		value   string
+	}
+
+	var segments []segment
+
+	for _, m := range extParam.FindAllStringSubmatch(value, -1) {
+
+		if !strings.EqualFold(m[1], name) {
+			continue
+		}
+
+		index, _ := strconv.Atoi(m[2])
+
+		segments = append(segments, segment{
+			index:   index,
+			encoded: m[3] != "" || m[4] != "" || m[2] == "",
+			value:   strings.Trim(m[5], `"`),
+		})
+
+	}
+
+	if len(segments) == 0 {
+		return ""
+	}
+
+	sort.Slice(segments, func(i, j int) bool { return segments[i].index < segments[j].index })
+
+	charset := ""
+	var raw []byte
+
+	for k, seg := range segments {
+
+		if !seg.encoded {
+			raw = append(raw, seg.value...)
+			continue
+		}
+
+		v := seg.value
+
+		// first encoded segment starts with charset'language'
+		if k == 0 {
+			if parts := strings.SplitN(v, "'", 3); len(parts) == 3 {
+				charset = parts[0]
+				v = parts[2]
+			}
+		}
+
+		unescaped, err := url.PathUnescape(v)
+		if err != nil {
+			unescaped = v
+		}
+
+		raw = append(raw, unescaped...)
+
+	}
+
+	decoded, _ := DecodeCharset(raw, charset)
+
+	return decoded
+}
+
+// DecodeFilename return decoded attachment filename
+// gmail filename is used unless it still looks encoded
+func DecodeFilename(filename string, headers MessageHeaders) string {
+
+	if filename != "" && !strings.Contains(filename, "=?") && !strings.Contains(filename, "''") {
+		return filename
+	}
+
+	for _, h := range []struct{ header, param string }{
+		{"Content-Disposition", "filename"},
+		{"Content-Type", "name"},
+	} {
+
+		value := headers.Get(h.header)
+		if value == "" {
+			continue
+		}
+
+		if name := DecodeExtParam(value, h.param); name != "" {
+			return name
+		}
+
+		if _, params, err := mime.ParseMediaType(value); err == nil && params[h.param] != "" {
+			return DecodeHeader(params[h.param])
+		}
+
+	}
+
+	return DecodeHeader(filename)
+}
+
+// ContentDisposition return attachment disposition with ascii fallback & rfc 5987 filename
+func ContentDisposition(filename string) string {
+
+	fallback := []rune{}
+	for _, r := range filename {
+		if r < 0x20 || r > 0x7e || r == '"' || r == '\\' {
+			r = '_'
+		}
+		fallback = append(fallback, r)
+	}
+
+	disposition := `attachment; filename="` + string(fallback) + `"`
+
+	if string(fallback) != filename {
+		disposition = disposition + "; filename*=UTF-8''" + strings.Replace(url.QueryEscape(filename), "+", "%20", -1)
+	}
+
+	return disposition
+}
+
+// ReprocessHeaders decode encoded words in already saved messages, threads & attachments
+func ReprocessHeaders(syncer Syncer) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "ReprocessHeaders",
+	}
+
+	defer SaveLog(proc)
+
+	syncer.Status = "start"
+	CRUDSyncer(syncer)
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	encoded := bson.M{"$regex": `=\?`}
+
+	// Messages
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	var updated []bson.ObjectId
+	var msg Message
+	iter := DBM.Find(bson.M{"owner": syncer.Owner, "$or": []bson.M{
+		bson.M{"subject": encoded},
+		bson.M{"from": encoded},
+		bson.M{"to": encoded},
+		bson.M{"cc": encoded},
+		bson.M{"bcc": encoded},
+	}}).Select(bson.M{"subject": 1, "from": 1, "to": 1, "cc": 1, "bcc": 1}).Iter()
+
+	for iter.Next(&msg) {
+
+		change := bson.M{
+			"subject": DecodeHeader(msg.Subject),
+			"from":    DecodeHeader(msg.From),
+			"to":      DecodeHeader(msg.To),
+			"cc":      DecodeHeader(msg.CC),
+			"bcc":     DecodeHeader(msg.BCC),
+		}
+
+		err := DBM.UpdateId(msg.ID, bson.M{"$set": change})
+		if err != nil {
+			HandleError(proc, "update message "+msg.ID.Hex(), err, true)
+			msg = Message{}
+			continue
+		}
+
+		updated = append(updated, msg.ID)
+		syncer.Count++
+		msg = Message{}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "iterate messages", err, true)
+	}
+
+	// search backend index decoded headers instead of encoded ones
+	if len(updated) != 0 {
+
+		_, err := BleveIndexQuery(bson.M{"_id": bson.M{"$in": updated}}, func(messages []Message) error {
+			IndexSearchMessages(messages)
+			return nil
+		})
+		if err != nil {
+			HandleError(proc, "index messages", err, true)
+		}
+
+	}
+
+	// Threads
+	DBT := DB.DB(os.Getenv("MONGO_DB")).C("threads")
+
+	var thread Thread
+	iter = DBT.Find(bson.M{"owner": syncer.Owner, "$or": []bson.M{
+		bson.M{"subject": encoded},
+		bson.M{"from": encoded},
+		bson.M{"to": encoded},
+		bson.M{"cc": encoded},
+		bson.M{"bcc": encoded},
+	}}).Select(bson.M{"subject": 1, "from": 1, "to": 1, "cc": 1, "bcc": 1}).Iter()
+
+	for iter.Next(&thread) {
+
+		change := bson.M{
+			"subject": DecodeHeader(thread.Subject),
+			"from":    DecodeHeader(thread.From),
+			"to":      DecodeHeader(thread.To),
+			"cc":      DecodeHeader(thread.CC),
+			"bcc":     DecodeHeader(thread.BCC),
+		}
+
+		err := DBT.UpdateId(thread.ID, bson.M{"$set": change})
+		if err != nil {
+			HandleError(proc, "update thread "+thread.ID.Hex(), err, true)
+			thread = Thread{}
+			continue
+		}
+
+		syncer.Count++
+		thread = Thread{}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "iterate threads", err, true)
+	}
+
+	// Attachments
+	DBA := DB.DB(os.Getenv("MONGO_DB")).C("attachments")
+
+	var attach Attachment
+	iter = DBA.Find(bson.M{"owner": syncer.Owner, "$or": []bson.M{
+		bson.M{"filename": encoded},
+		bson.M{"filename": bson.M{"$regex": "''"}},
+	}}).Select(bson.M{"filename": 1, "headers": 1}).Iter()
+
+	for iter.Next(&attach) {
+
+		filename := DecodeFilename(attach.Filename, attach.Headers)
+
+		if filename != attach.Filename {
+
+			err := DBA.UpdateId(attach.ID, bson.M{"$set": bson.M{"filename": filename}})
+			if err != nil {
+				HandleError(proc, "update attachment "+attach.ID.Hex(), err, true)
+				attach = Attachment{}
+				continue
+			}
+
+			syncer.Count++
+
+		}
+
+		attach = Attachment{}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "iterate attachments", err, true)
+	}
+
+	syncer.End = time.Now()
+	syncer.Status = "end"
+	CRUDSyncer(syncer)
+
+}
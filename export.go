@@ -0,0 +1,658 @@
+package main
+
+import (
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"errors"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"os"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// Export background export of owner messages to file stored in GridFS
+type Export struct {
+	ID          bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner       string        `json:"owner" bson:"owner,omitempty"`
+	Format      string        `json:"format" bson:"format,omitempty"`
+	Label       string        `json:"label" bson:"label,omitempty"`
+	SavedSearch string        `json:"savedSearch" bson:"savedSearch,omitempty"`
+	After       string        `json:"after" bson:"after,omitempty"`
+	Before      string        `json:"before" bson:"before,omitempty"`
+	Filename    string        `json:"filename" bson:"filename,omitempty"`
+	GridID      bson.ObjectId `json:"gridID" bson:"gridID,omitempty"`
+	Size        int64         `json:"size" bson:"size,omitempty"`
+	Count       int           `json:"count" bson:"count,omitempty"`
+	Missing     int           `json:"missing" bson:"missing,omitempty"`
+	Status      string        `json:"status" bson:"status,omitempty"`
+	Error       string        `json:"error" bson:"error,omitempty"`
+	Start       time.Time     `json:"start" bson:"start,omitempty"`
+	End         time.Time     `json:"end" bson:"end,omitempty"`
+}
+
+// exportFormats supported export formats
+var exportFormats = map[string]bool{"mbox": true, "eml": true, "maildir": true, "bundle": true}
+
+// exportPathChars characters not allowed in exported folder names
+var exportPathChars = regexp.MustCompile(`[\\:*?"<>|\x00-\x1f]`)
+
+// mboxFrom lines quoted in mboxrd format
+var mboxFrom = regexp.MustCompile(`(?m)^(>*From )`)
+
+// CRUDExport create or update export
+func CRUDExport(export Export) Export {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "CRUDExport",
+	}
+
+	defer SaveLog(proc)
+
+	MS := MongoSession()
+	mongoC := MS.DB(os.Getenv("MONGO_DB")).C("exports")
+	defer MS.Close()
+
+	if export.ID == "" {
+
+		export.ID = bson.NewObjectId()
+
+		err := mongoC.Insert(export)
+		if err != nil {
+			HandleError(proc, "error while inserting row", err, true)
+		}
+
+		return export
+	}
+
+	err := mongoC.UpdateId(export.ID, bson.M{"$set": export})
+	if err != nil {
+		HandleError(proc, "error while updateing row", err, true)
+	}
+
+	return export
+}
+
+// GetExports return exports of owner, newest first
+func GetExports(owner string) []Export {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetExports",
+	}
+
+	defer SaveLog(proc)
+
+	var exports []Export
+
+	DB := MongoSession()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("exports")
+	defer DB.Close()
+
+	err := DBC.Find(bson.M{"owner": owner}).Sort("-start").Limit(50).All(&exports)
+	if err != nil {
+		HandleError(proc, "get exports", err, true)
+	}
+
+	return exports
+}
+
+// GetExport return export of owner by ID
+func GetExport(id, owner string) (Export, bool) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetExport",
+	}
+
+	defer SaveLog(proc)
+
+	var export Export
+
+	if !bson.IsObjectIdHex(id) {
+		return export, false
+	}
+
+	DB := MongoSession()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("exports")
+	defer DB.Close()
+
+	err := DBC.Find(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner}).One(&export)
+	if err != nil {
+		HandleError(proc, "get export", err, false)
+		return export, false
+	}
+
+	return export, true
+}
+
+// ExportSearch return label & search selecting messages of export
+func ExportSearch(export Export) (string, ESearch) {
+
+	label := export.Label
+	var s ESearch
+
+	if search, ok := GetSavedSearch(export.SavedSearch, export.Owner); ok {
+		label = search.Label
+		s = search.Search
+	}
+
+	var dates []string
+
+	if export.After != "" {
+		dates = append(dates, "after:"+export.After)
+	}
+
+	if export.Before != "" {
+		dates = append(dates, "before:"+export.Before)
+	}
+
+	if len(dates) != 0 {
+		s.Query = strings.TrimSpace(s.Query + " " + strings.Join(dates, " "))
+	}
+
+	return label, s
+}
+
+// ExportContentType return content type of export file
+func ExportContentType(format string) string {
+
+	switch format {
+	case "mbox":
+		return "application/mbox"
+	case "eml", "maildir", "bundle":
+		return "application/zip"
+	}
+
+	return "application/octet-stream"
+}
+
+// RunExport run export job, result is saved to GridFS
+func RunExport(export Export) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "RunExport",
+	}
+
+	defer SaveLog(proc)
+
+	export.Status = "start"
+	export = CRUDExport(export)
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	gridFile, err := db.GridFS("exports").Create(export.Filename)
+	if err != nil {
+		HandleError(proc, "create export file", err, true)
+		export.Status = "error"
+		export.Error = err.Error()
+		export.End = time.Now()
+		CRUDExport(export)
+		return
+	}
+
+	export.GridID = gridFile.Id().(bson.ObjectId)
+
+	w := bufio.NewWriterSize(gridFile, 261120)
+
+	switch export.Format {
+	case "eml", "maildir":
+		err = ExportZip(DB, &export, w)
+	case "bundle":
+		err = ExportBundle(DB, &export, w)
+	default:
+		err = ExportMbox(DB, &export, w)
+	}
+
+	if err == nil {
+		err = w.Flush()
+	}
+
+	if cerr := gridFile.Close(); err == nil {
+		err = cerr
+	}
+
+	export.Size = gridFile.Size()
+	export.End = time.Now()
+	export.Status = "end"
+
+	if err != nil {
+		HandleError(proc, "export "+export.ID.Hex(), err, true)
+		export.Status = "error"
+		export.Error = err.Error()
+	}
+
+	CRUDExport(export)
+
+}
+
+// ExportRawMessages call fn with raw message of each exported message, oldest first
+func ExportRawMessages(DB *mgo.Session, export *Export, fn func(raw RawMessage, msg Message) error) error {
+
+	user := GetUserByEmail(export.Owner)
+	label, s := ExportSearch(*export)
+
+	// text index exists only with mongo backend
+	_, text := searchBackend.(MongoSearchBackend)
+
+	mquery, _, _, err := SearchMessagesQuery(DB, user, label, s, text)
+	if err != nil {
+		return err
+	}
+
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	var msg Message
+	iter := db.C("messages").Find(mquery).Select(bson.M{
+		"msgID":        1,
+		"threadID":     1,
+		"fromEmails":   1,
+		"subject":      1,
+		"labels":       1,
+		"internalDate": 1,
+	}).Sort("internalDate").Iter()
+
+	for iter.Next(&msg) {
+
+		var raw RawMessage
+		err := db.C("messagesRaw").Find(bson.M{"owner": export.Owner, "msgID": msg.MsgID}).One(&raw)
+		if err != nil {
+			export.Missing++
+			msg = Message{}
+			continue
+		}
+
+		err = fn(raw, msg)
+		if err != nil {
+			iter.Close()
+			return err
+		}
+
+		export.Count++
+		msg = Message{}
+
+		if export.Count%100 == 0 {
+			CRUDExport(*export)
+		}
+
+	}
+
+	return iter.Close()
+}
+
+// ExportMbox write selected messages to mboxrd file
+func ExportMbox(DB *mgo.Session, export *Export, w io.Writer) error {
+
+	return ExportRawMessages(DB, export, func(raw RawMessage, msg Message) error {
+
+		source, err := BuildRFC822(DB, raw)
+		if err != nil {
+			return err
+		}
+
+		from := strings.Split(msg.FromEmails, ",")[0]
+		if from == "" {
+			from = "MAILER-DAEMON"
+		}
+
+		return WriteMbox(w, from, raw.InternalDate, source)
+	})
+}
+
+// ExportZip write selected messages to zip of eml files or Maildir tree
+// folders are mapped from label names, message is added to folder of each label
+func ExportZip(DB *mgo.Session, export *Export, w io.Writer) error {
+
+	_, labelNames := GetLabelsList(User{Email: export.Owner})
+
+	zw := zip.NewWriter(w)
+
+	var manifest bytes.Buffer
+	mw := csv.NewWriter(&manifest)
+	mw.Write([]string{"file", "msgID", "threadID", "labels", "sha256", "size"})
+
+	folders := make(map[string]bool)
+
+	err := ExportRawMessages(DB, export, func(raw RawMessage, msg Message) error {
+
+		source, err := BuildRFC822(DB, raw)
+		if err != nil {
+			return err
+		}
+
+		sum := sha256.Sum256(source)
+
+		var labels []string
+		for _, l := range raw.Labels {
+			if name, ok := labelNames[l]; ok {
+				labels = append(labels, name)
+			} else {
+				labels = append(labels, l)
+			}
+		}
+
+		for _, folder := range ExportFolders(raw.Labels, labelNames) {
+
+			var name string
+
+			if export.Format == "maildir" {
+
+				if !folders[folder] {
+
+					for _, dir := range []string{"cur", "new", "tmp"} {
+						if _, err := zw.Create(path.Join(folder, dir) + "/"); err != nil {
+							return err
+						}
+					}
+
+					folders[folder] = true
+
+				}
+
+				name = path.Join(folder, "cur", MaildirFilename(raw))
+
+			} else {
+
+				name = path.Join(folder, raw.InternalDate.UTC().Format("20060102-150405")+"-"+raw.MsgID+".eml")
+
+			}
+
+			f, err := zw.CreateHeader(&zip.FileHeader{
+				Name:     name,
+				Method:   zip.Deflate,
+				Modified: raw.InternalDate,
+			})
+			if err != nil {
+				return err
+			}
+
+			_, err = f.Write(source)
+			if err != nil {
+				return err
+			}
+
+			mw.Write([]string{
+				name,
+				raw.MsgID,
+				raw.ThreadID,
+				strings.Join(labels, ";"),
+				hex.EncodeToString(sum[:]),
+				strconv.Itoa(len(source)),
+			})
+
+		}
+
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	mw.Flush()
+
+	f, err := zw.Create("manifest.csv")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(manifest.Bytes())
+	if err != nil {
+		return err
+	}
+
+	return zw.Close()
+}
+
+// ExportFolders return folder paths of message labels, nested labels as Parent/Child
+func ExportFolders(labels []string, labelNames map[string]string) []string {
+
+	var folders []string
+
+	for _, l := range labels {
+
+		// state labels are not folders
+		switch l {
+		case "UNREAD", "STARRED", "IMPORTANT":
+			continue
+		}
+
+		name, ok := labelNames[l]
+		if !ok {
+			name = l
+		}
+
+		var parts []string
+		for _, part := range strings.Split(name, "/") {
+
+			part = exportPathChars.ReplaceAllString(strings.TrimSpace(part), "_")
+			if part != "" && part != "." && part != ".." {
+				parts = append(parts, part)
+			}
+
+		}
+
+		if len(parts) != 0 {
+			folders = append(folders, path.Join(parts...))
+		}
+
+	}
+
+	if len(folders) == 0 {
+		folders = append(folders, "All Mail")
+	}
+
+	return folders
+}
+
+// MaildirFilename return unique Maildir name with seen & flagged info
+func MaildirFilename(raw RawMessage) string {
+
+	flags := ""
+
+	for _, l := range raw.Labels {
+		if l == "STARRED" {
+			flags = "F"
+		}
+	}
+
+	seen := true
+	for _, l := range raw.Labels {
+		if l == "UNREAD" {
+			seen = false
+		}
+	}
+
+	if seen {
+		flags = flags + "S"
+	}
+
+	return strconv.FormatInt(raw.InternalDate.Unix(), 10) + "." + raw.MsgID + ".gapp:2," + flags
+}
+
+// WriteMbox write message with mboxrd From line & quoting
+func WriteMbox(w io.Writer, from string, date time.Time, source []byte) error {
+
+	source = bytes.Replace(source, []byte("\r\n"), []byte("\n"), -1)
+	source = mboxFrom.ReplaceAll(source, []byte(">$1"))
+
+	if !bytes.HasSuffix(source, []byte("\n")) {
+		source = append(source, '\n')
+	}
+
+	_, err := io.WriteString(w, "From "+from+" "+date.UTC().Format("Mon Jan _2 15:04:05 2006")+"\n")
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(source)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, "\n")
+
+	return err
+}
+
+// BuildRFC822 return message source, rebuilt from payload & attachments if not stored
+func BuildRFC822(DB *mgo.Session, raw RawMessage) ([]byte, error) {
+
+	if len(raw.Source) != 0 {
+		return raw.Source, nil
+	}
+
+	if raw.Payload == nil {
+		return nil, errors.New("message " + raw.MsgID + " without payload")
+	}
+
+	var buf bytes.Buffer
+
+	err := WriteMIMEPart(&buf, DB, raw.Owner, raw.Payload)
+
+	return buf.Bytes(), err
+}
+
+// WriteMIMEPart write part headers & body, leaf bodies are encoded again
+func WriteMIMEPart(buf *bytes.Buffer, DB *mgo.Session, owner string, p *gmail.MessagePart) error {
+
+	mimeType := strings.ToLower(p.MimeType)
+
+	boundary := ""
+	if strings.HasPrefix(mimeType, "multipart/") {
+
+		_, params, _ := mime.ParseMediaType(GetPartHeader(p.Headers, "Content-Type"))
+		boundary = params["boundary"]
+
+	}
+
+	for _, h := range p.Headers {
+
+		if strings.EqualFold(h.Name, "Content-Transfer-Encoding") {
+			continue
+		}
+
+		if strings.EqualFold(h.Name, "Content-Type") && strings.HasPrefix(mimeType, "multipart/") && boundary == "" {
+			continue
+		}
+
+		buf.WriteString(h.Name + ": " + h.Value + "\n")
+
+	}
+
+	switch {
+	case strings.HasPrefix(mimeType, "multipart/"):
+
+		if boundary == "" {
+			boundary = "gapp-" + bson.NewObjectId().Hex()
+			buf.WriteString("Content-Type: " + mime.FormatMediaType(mimeType, map[string]string{"boundary": boundary}) + "\n")
+		}
+
+		buf.WriteString("\n")
+
+		for _, child := range p.Parts {
+
+			buf.WriteString("--" + boundary + "\n")
+
+			err := WriteMIMEPart(buf, DB, owner, child)
+			if err != nil {
+				return err
+			}
+
+			buf.WriteString("\n")
+
+		}
+
+		buf.WriteString("--" + boundary + "--\n")
+
+		return nil
+
+	case mimeType == "message/rfc822" && len(p.Parts) == 1:
+
+		buf.WriteString("\n")
+
+		return WriteMIMEPart(buf, DB, owner, p.Parts[0])
+
+	}
+
+	// export continue without body of attachment not saved
+	data, err := MIMEPartData(DB, owner, p)
+	if err != nil {
+		buf.WriteString("X-Gapp-Export-Error: " + err.Error() + "\n")
+	}
+
+	if strings.HasPrefix(mimeType, "text/") {
+
+		buf.WriteString("Content-Transfer-Encoding: quoted-printable\n\n")
+
+		qp := quotedprintable.NewWriter(buf)
+		qp.Write(data)
+		qp.Close()
+
+		buf.WriteString("\n")
+
+		return nil
+
+	}
+
+	buf.WriteString("Content-Transfer-Encoding: base64\n\n")
+
+	encoded := base64.StdEncoding.EncodeToString(data)
+	for len(encoded) > 76 {
+		buf.WriteString(encoded[:76] + "\n")
+		encoded = encoded[76:]
+	}
+
+	buf.WriteString(encoded + "\n")
+
+	return nil
+}
+
+// MIMEPartData return decoded body of part, from saved attachment when not in payload
+func MIMEPartData(DB *mgo.Session, owner string, p *gmail.MessagePart) ([]byte, error) {
+
+	if p.Body == nil {
+		return nil, nil
+	}
+
+	if p.Body.Data != "" {
+		return DecodeBodyData(p.Body.Data)
+	}
+
+	if p.Body.AttachmentId == "" {
+		return nil, nil
+	}
+
+	var attch Attachment
+	err := DB.DB(os.Getenv("MONGO_DB")).C("attachments").Find(bson.M{"owner": owner, "attachID": p.Body.AttachmentId}).One(&attch)
+	if err != nil {
+		return nil, errors.New("attachment " + p.Filename + " not saved")
+	}
+
+	return AttachmentData(attch)
+}
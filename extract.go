@@ -0,0 +1,452 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	"github.com/ledongthuc/pdf"
+)
+
+// maxExtractSize attachments bigger are not extracted
+const maxExtractSize = 25000000
+
+// maxExtractText extracted text is cut to keep documents under mongo limit
+const maxExtractText = 1000000
+
+// extractFormats format by mime type
+var extractFormats = map[string]string{
+	"application/pdf":   "pdf",
+	"application/x-pdf": "pdf",
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": "docx",
+	"application/vnd.openxmlformats-officedocument.spreadsheetml.sheet":       "xlsx",
+	"application/vnd.oasis.opendocument.text":                                 "odt",
+	"application/vnd.oasis.opendocument.spreadsheet":                          "odt",
+	"application/vnd.oasis.opendocument.presentation":                         "odt",
+	"text/html":  "html",
+	"text/plain": "txt",
+	"text/csv":   "txt",
+}
+
+// extractExtensions format by filename extension, used for application/octet-stream
+var extractExtensions = map[string]string{
+	".pdf":  "pdf",
+	".docx": "docx",
+	".xlsx": "xlsx",
+	".odt":  "odt",
+	".ods":  "odt",
+	".odp":  "odt",
+	".html": "html",
+	".htm":  "html",
+	".txt":  "txt",
+	".csv":  "txt",
+}
+
+// ExtractFormat return text format of attachment, empty if not supported
+func ExtractFormat(attch Attachment) string {
+
+	mimeType, _, _ := mime.ParseMediaType(attch.ContentType)
+	if mimeType == "" {
+		mimeType = attch.MimeType
+	}
+
+	if format, ok := extractFormats[strings.ToLower(mimeType)]; ok && format != "" {
+		return format
+	}
+
+	return extractExtensions[strings.ToLower(path.Ext(attch.Filename))]
+}
+
+// ExtractText return plain text of document
+func ExtractText(data []byte, format, charset string) (text string, err error) {
+
+	// malformed documents can panic in parsers
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("unable to parse %s: %v", format, r)
+		}
+	}()
+
+	switch format {
+	case "pdf":
+		text, err = ExtractPDF(data)
+	case "docx":
+		text, err = ExtractZipXML(data, []string{"word/document.xml", "word/header*.xml", "word/footer*.xml"}, []string{"t"}, []string{"p", "tr"})
+	case "xlsx":
+		text, err = ExtractZipXML(data, []string{"xl/sharedStrings.xml", "xl/worksheets/sheet*.xml"}, []string{"t"}, []string{"si", "c"})
+	case "odt":
+		text, err = ExtractZipXML(data, []string{"content.xml"}, []string{"p", "h"}, []string{"p", "h"})
+	case "html":
+		text, err = DecodeCharset(data, charset)
+		text = StripHTML(text)
+	case "txt":
+		text, err = DecodeCharset(data, charset)
+	default:
+		err = errors.New("unsupported format " + format)
+	}
+
+	text = strings.TrimSpace(text)
+
+	if len(text) > maxExtractText {
+		text = text[:runeStart(text, maxExtractText)]
+	}
+
+	return text, err
+}
+
+// ExtractPDF return text of all pdf pages
+func ExtractPDF(data []byte) (string, error) {
+
+	r, err := pdf.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	plain, err := r.GetPlainText()
+	if err != nil {
+		return "", err
+	}
+
+	text, err := ioutil.ReadAll(io.LimitReader(plain, maxExtractText))
+	if err != nil {
+		return "", err
+	}
+
+	return string(text), nil
+}
+
+// ExtractZipXML return text of xml files in zip document matching patterns
+// text is read inside textTags elements, lines end on breakTags
+func ExtractZipXML(data []byte, patterns, textTags, breakTags []string) (string, error) {
+
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return "", err
+	}
+
+	var files []*zip.File
+	for _, pattern := range patterns {
+
+		var matched []*zip.File
+		for _, f := range zr.File {
+			if ok, _ := path.Match(pattern, f.Name); ok {
+				matched = append(matched, f)
+			}
+		}
+
+		sort.Slice(matched, func(i, j int) bool { return matched[i].Name < matched[j].Name })
+
+		files = append(files, matched...)
+
+	}
+
+	if len(files) == 0 {
+		return "", errors.New("no document content")
+	}
+
+	var text bytes.Buffer
+
+	for _, f := range files {
+
+		rc, err := f.Open()
+		if err != nil {
+			return text.String(), err
+		}
+
+		err = ExtractXMLText(io.LimitReader(rc, maxExtractSize), textTags, breakTags, &text)
+		rc.Close()
+		if err != nil {
+			return text.String(), err
+		}
+
+		if text.Len() > maxExtractText {
+			break
+		}
+
+	}
+
+	return text.String(), nil
+}
+
+// ExtractXMLText write character data of text elements to buffer
+func ExtractXMLText(r io.Reader, textTags, breakTags []string, text *bytes.Buffer) error {
+
+	isText := make(map[string]bool)
+	for _, t := range textTags {
+		isText[t] = true
+	}
+
+	isBreak := make(map[string]bool)
+	for _, t := range breakTags {
+		isBreak[t] = true
+	}
+
+	decoder := xml.NewDecoder(r)
+	decoder.Strict = false
+
+	depth := 0
+
+	for {
+
+		token, err := decoder.Token()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		switch t := token.(type) {
+		case xml.StartElement:
+
+			if isText[t.Name.Local] {
+				depth++
+			}
+
+			// tabs & spaces are elements in docx & odt
+			if t.Name.Local == "tab" || t.Name.Local == "s" || t.Name.Local == "br" {
+				text.WriteString(" ")
+			}
+
+		case xml.EndElement:
+
+			if isText[t.Name.Local] && depth != 0 {
+				depth--
+			}
+
+			if isBreak[t.Name.Local] {
+				text.WriteString("\n")
+			}
+
+		case xml.CharData:
+
+			if depth != 0 {
+				text.Write(t)
+			}
+
+		}
+
+	}
+
+}
+
+// AttachmentData return decoded attachment content from document or GridFS
+func AttachmentData(attch Attachment) ([]byte, error) {
+
+	if attch.Data != "gridFS" {
+		return DecodeBodyData(attch.Data)
+	}
+
+	gridFile := GetAttachmentGridFS(attch)
+	if gridFile == nil {
+		return nil, errors.New("attachment not found in GridFS")
+	}
+	defer gridFile.Close()
+
+	return ioutil.ReadAll(gridFile)
+}
+
+// ExtractAttachment set extracted text & status of attachment
+func ExtractAttachment(attch *Attachment) {
+
+	attch.TextStatus = "unsupported"
+
+	format := ExtractFormat(*attch)
+	if format == "" {
+		return
+	}
+
+	if attch.Size > maxExtractSize {
+		attch.TextStatus = "too large"
+		return
+	}
+
+	data, err := AttachmentData(*attch)
+	if err != nil {
+		attch.TextStatus = "error: " + err.Error()
+		return
+	}
+
+	if len(data) > maxExtractSize {
+		attch.TextStatus = "too large"
+		return
+	}
+
+	_, params, _ := mime.ParseMediaType(attch.ContentType)
+
+	text, err := ExtractText(data, format, params["charset"])
+
+	attch.Text = text
+	attch.TextStatus = "ok"
+
+	if err != nil {
+		attch.TextStatus = "error: " + err.Error()
+	}
+
+}
+
+// ExtractAttachments extract text of saved attachments
+// text is stored on attachment & copied to message for search
+func ExtractAttachments(attachments []Attachment) int {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "ExtractAttachments",
+	}
+
+	defer SaveLog(proc)
+
+	if len(attachments) == 0 {
+		return 0
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBA := DB.DB(os.Getenv("MONGO_DB")).C("attachments")
+
+	count := 0
+	msgIDs := make(map[string]string)
+
+	for _, a := range attachments {
+
+		ExtractAttachment(&a)
+
+		err := DBA.Update(bson.M{"owner": a.Owner, "attachID": a.AttachID}, bson.M{"$set": bson.M{
+			"text":       a.Text,
+			"textStatus": a.TextStatus,
+		}})
+		if err != nil {
+			HandleError(proc, "update attachment "+a.AttachID, err, true)
+			continue
+		}
+
+		if a.Text != "" {
+			msgIDs[a.MsgID] = a.Owner
+			count++
+		}
+
+	}
+
+	for msgID, owner := range msgIDs {
+		UpdateMessageAttachmentText(owner, msgID)
+	}
+
+	return count
+}
+
+// UpdateMessageAttachmentText copy attachments text to message & search backend
+func UpdateMessageAttachmentText(owner, msgID string) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "UpdateMessageAttachmentText",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBA := DB.DB(os.Getenv("MONGO_DB")).C("attachments")
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	var attachments []Attachment
+	err := DBA.Find(bson.M{"owner": owner, "msgID": msgID, "text": bson.M{"$exists": true}}).Select(bson.M{"filename": 1, "text": 1}).All(&attachments)
+	if err != nil {
+		HandleError(proc, "get attachments text", err, true)
+		return
+	}
+
+	var texts []string
+	for _, a := range attachments {
+		if a.Text != "" {
+			texts = append(texts, a.Filename+"\n"+a.Text)
+		}
+	}
+
+	text := strings.Join(texts, "\n\n")
+	if len(text) > maxExtractText {
+		text = text[:runeStart(text, maxExtractText)]
+	}
+
+	err = DBM.Update(bson.M{"owner": owner, "msgID": msgID}, bson.M{"$set": bson.M{"attachmentText": text}})
+	if err != nil {
+		HandleError(proc, "update message attachment text", err, true)
+		return
+	}
+
+	var msg Message
+	err = DBM.Find(bson.M{"owner": owner, "msgID": msgID}).One(&msg)
+	if err != nil {
+		HandleError(proc, "get message", err, true)
+		return
+	}
+
+	if err := searchBackend.IndexMessages([]Message{msg}); err != nil {
+		HandleError(proc, "index message", err, true)
+	}
+
+}
+
+// ExtractAttachmentsText extract text of attachments saved before extraction
+func ExtractAttachmentsText(syncer Syncer) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "ExtractAttachmentsText",
+	}
+
+	defer SaveLog(proc)
+
+	syncer.Status = "start"
+	CRUDSyncer(syncer)
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBA := DB.DB(os.Getenv("MONGO_DB")).C("attachments")
+
+	var attachments []Attachment
+	var attch Attachment
+
+	iter := DBA.Find(bson.M{"owner": syncer.Owner, "textStatus": bson.M{"$exists": false}}).Iter()
+
+	for iter.Next(&attch) {
+
+		attachments = append(attachments, attch)
+		attch = Attachment{}
+
+		if len(attachments) == 50 {
+			syncer.Count = syncer.Count + ExtractAttachments(attachments)
+			CRUDSyncer(syncer)
+			attachments = nil
+		}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "get attachments", err, true)
+	}
+
+	syncer.Count = syncer.Count + ExtractAttachments(attachments)
+
+	syncer.End = time.Now()
+	syncer.Status = "end"
+	CRUDSyncer(syncer)
+
+}
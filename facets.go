@@ -0,0 +1,406 @@
+package main
+
+import (
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// FacetFilter drill-down filters selected on emails page
+type FacetFilter struct {
+	Domain      string `json:"domain" bson:"domain,omitempty"`
+	Year        string `json:"year" bson:"year,omitempty"`
+	Month       string `json:"month" bson:"month,omitempty"`
+	Label       string `json:"label" bson:"label,omitempty"`
+	Attachment  string `json:"attachment" bson:"attachment,omitempty"`
+	MimeType    string `json:"mimeType" bson:"mimeType,omitempty"`
+	Participant string `json:"participant" bson:"participant,omitempty"`
+}
+
+// FacetGroup facet values shown on emails page
+type FacetGroup struct {
+	Name  string
+	Key   string
+	Items []FacetItem
+}
+
+// FacetItem facet value with link to drill-down or remove filter
+type FacetItem struct {
+	Key    string
+	Term   string
+	Title  string
+	Count  int
+	URL    string
+	Active bool
+}
+
+// facetNames facet keys & titles in order shown
+var facetNames = []struct{ Key, Name string }{
+	{"label", "Label"},
+	{"domain", "Sender domain"},
+	{"participant", "Participant"},
+	{"year", "Year"},
+	{"month", "Month"},
+	{"attachment", "Attachment"},
+	{"mimeType", "Attachment type"},
+}
+
+// facetMonth layout of month facet, 2019-03
+const facetMonth = "2006-01"
+
+// Get return filter value by facet key
+func (f FacetFilter) Get(key string) string {
+
+	switch key {
+	case "domain":
+		return f.Domain
+	case "year":
+		return f.Year
+	case "month":
+		return f.Month
+	case "label":
+		return f.Label
+	case "attachment":
+		return f.Attachment
+	case "mimeType":
+		return f.MimeType
+	case "participant":
+		return f.Participant
+	}
+
+	return ""
+}
+
+// Set return filter with facet key set to value
+func (f FacetFilter) Set(key, value string) FacetFilter {
+
+	switch key {
+	case "domain":
+		f.Domain = value
+	case "year":
+		f.Year = value
+	case "month":
+		f.Month = value
+	case "label":
+		f.Label = value
+	case "attachment":
+		f.Attachment = value
+	case "mimeType":
+		f.MimeType = value
+	case "participant":
+		f.Participant = value
+	}
+
+	return f
+}
+
+// QueryString return filters as gmail style query
+func (f FacetFilter) QueryString() string {
+
+	var q []string
+
+	quote := func(value string) string {
+		return `"` + strings.Replace(value, `"`, "", -1) + `"`
+	}
+
+	if f.Domain != "" {
+		q = append(q, "from:"+quote("@"+f.Domain))
+	}
+
+	if f.Participant != "" {
+		q = append(q, "(from:"+quote(f.Participant)+" OR to:"+quote(f.Participant)+" OR cc:"+quote(f.Participant)+")")
+	}
+
+	if f.Label != "" {
+		q = append(q, "label:"+quote(f.Label))
+	}
+
+	if month, err := time.ParseInLocation(facetMonth, f.Month, time.Local); err == nil {
+
+		q = append(q, "after:"+month.Format("2006/01/02"), "before:"+month.AddDate(0, 1, 0).Format("2006/01/02"))
+
+	} else if year, err := strconv.Atoi(f.Year); err == nil {
+
+		q = append(q, "after:"+strconv.Itoa(year)+"/01/01", "before:"+strconv.Itoa(year+1)+"/01/01")
+
+	}
+
+	switch f.Attachment {
+	case "yes":
+		q = append(q, "has:attachment")
+	case "no":
+		q = append(q, "-has:attachment")
+	}
+
+	if f.MimeType != "" {
+		q = append(q, "mimetype:"+quote(f.MimeType))
+	}
+
+	return strings.Join(q, " ")
+}
+
+// GetFacets return facet counts of threads matching label & search
+// labels & attachments are counted on threads, other facets on messages
+// with bleve backend labels & domains of search are counted by index
+func GetFacets(user User, label string, s ESearch) (map[string][]SearchFacet, error) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetFacets",
+	}
+
+	defer SaveLog(proc)
+
+	facets := make(map[string][]SearchFacet)
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("threads")
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	// text index exists only with mongo backend
+	_, text := searchBackend.(MongoSearchBackend)
+
+	mquery, _, _, err := SearchMessagesQuery(DB, user, label, s, text)
+	if err != nil {
+		return facets, err
+	}
+
+	firstEmail := bson.M{"$arrayElemAt": []interface{}{bson.M{"$split": []interface{}{bson.M{"$ifNull": []interface{}{"$fromEmails", ""}}, ","}}, 0}}
+
+	var mfacets map[string][]SearchFacet
+	err = DBM.Pipe([]bson.M{
+		bson.M{"$match": mquery},
+		bson.M{"$facet": bson.M{
+			"domain": FacetPipeline(bson.M{"$project": bson.M{
+				"threadID": 1,
+				"v":        bson.M{"$toLower": bson.M{"$arrayElemAt": []interface{}{bson.M{"$split": []interface{}{firstEmail, "@"}}, 1}}},
+			}}),
+			"participant": FacetPipeline(
+				bson.M{"$project": bson.M{
+					"threadID": 1,
+					"v": bson.M{"$split": []interface{}{bson.M{"$concat": []interface{}{
+						bson.M{"$ifNull": []interface{}{"$fromEmails", ""}}, ",",
+						bson.M{"$ifNull": []interface{}{"$toEmails", ""}}, ",",
+						bson.M{"$ifNull": []interface{}{"$ccEmails", ""}},
+					}}, ","}},
+				}},
+				bson.M{"$unwind": "$v"},
+				bson.M{"$match": bson.M{"v": bson.M{"$ne": strings.ToLower(user.Email)}}},
+			),
+			"year": FacetPipeline(bson.M{"$project": bson.M{
+				"threadID": 1,
+				"v":        "$year",
+			}}),
+			"month": FacetPipeline(bson.M{"$project": bson.M{
+				"threadID": 1,
+				"v":        bson.M{"$concat": []interface{}{"$year", "-", "$month"}},
+			}}),
+			"mimeType": FacetPipeline(
+				bson.M{"$unwind": "$attachments"},
+				bson.M{"$project": bson.M{
+					"threadID": 1,
+					"v":        bson.M{"$toLower": "$attachments.mimeType"},
+				}},
+			),
+		}},
+	}).AllowDiskUse().One(&mfacets)
+	if err != nil {
+		return facets, err
+	}
+
+	for k, v := range mfacets {
+		facets[k] = v
+	}
+
+	tquery := bson.M{"owner": user.Email, "labels": label}
+
+	if !s.IsEmpty() {
+
+		var tIDs []string
+
+		err = DBM.Find(mquery).Distinct("threadID", &tIDs)
+		if err != nil {
+			return facets, err
+		}
+
+		tquery = bson.M{"owner": user.Email, "threadID": bson.M{"$in": tIDs}}
+
+	}
+
+	var tfacets map[string][]SearchFacet
+	err = DBC.Pipe([]bson.M{
+		bson.M{"$match": tquery},
+		bson.M{"$facet": bson.M{
+			"label": FacetPipeline(
+				bson.M{"$unwind": "$labels"},
+				bson.M{"$project": bson.M{
+					"threadID": 1,
+					"v":        "$labels",
+				}},
+			),
+			"attachment": FacetPipeline(bson.M{"$project": bson.M{
+				"threadID": 1,
+				"v":        bson.M{"$cond": []interface{}{bson.M{"$gt": []interface{}{"$attchCount", 0}}, "yes", "no"}},
+			}}),
+		}},
+	}).AllowDiskUse().One(&tfacets)
+	if err != nil {
+		return facets, err
+	}
+
+	for k, v := range tfacets {
+		facets[k] = v
+	}
+
+	// bleve index count labels & sender domains of messages matching search
+	if b, ok := searchBackend.(*BleveSearchBackend); ok && !s.IsEmpty() {
+
+		bfacets, err := b.Facets(user, label, s)
+		if err != nil {
+			return facets, err
+		}
+
+		for k, v := range bfacets {
+			facets[k] = v
+		}
+
+	}
+
+	// years & months are browsed in time order
+	for _, k := range []string{"year", "month"} {
+		sort.Slice(facets[k], func(i, j int) bool { return facets[k][i].Term > facets[k][j].Term })
+	}
+
+	return facets, nil
+}
+
+// FacetPipeline return stages counting threads by value v of projected documents
+func FacetPipeline(stages ...bson.M) []bson.M {
+
+	return append(stages,
+		bson.M{"$match": bson.M{"v": bson.M{"$nin": []interface{}{nil, ""}}}},
+		bson.M{"$group": bson.M{"_id": bson.M{"v": "$v", "t": "$threadID"}}},
+		bson.M{"$group": bson.M{"_id": "$_id.v", "count": bson.M{"$sum": 1}}},
+		bson.M{"$sort": bson.D{{Name: "count", Value: -1}, {Name: "_id", Value: 1}}},
+		bson.M{"$limit": 10},
+		bson.M{"$project": bson.M{"_id": 0, "term": "$_id", "count": 1}},
+	)
+}
+
+// GetFacetGroups return facets with drill-down links of emails page
+func GetFacetGroups(facets map[string][]SearchFacet, label string, s ESearch, labelNames map[string]string) []FacetGroup {
+
+	var groups []FacetGroup
+
+	for _, n := range facetNames {
+
+		group := FacetGroup{
+			Name: n.Name,
+			Key:  n.Key,
+		}
+
+		active := s.Facets.Get(n.Key)
+
+		for _, f := range facets[n.Key] {
+
+			item := FacetItem{
+				Key:    n.Key,
+				Term:   f.Term,
+				Title:  f.Term,
+				Count:  f.Count,
+				Active: f.Term == active,
+			}
+
+			if name, ok := labelNames[f.Term]; ok && n.Key == "label" {
+				item.Title = name
+			}
+
+			fs := s
+			if item.Active {
+				fs.Facets = s.Facets.Set(n.Key, "")
+			} else {
+				fs.Facets = s.Facets.Set(n.Key, f.Term)
+			}
+
+			item.URL = SearchURL(label, fs)
+
+			group.Items = append(group.Items, item)
+
+		}
+
+		if len(group.Items) != 0 {
+			groups = append(groups, group)
+		}
+
+	}
+
+	return groups
+}
+
+// GetActiveFacets return selected filters with links removing them
+func GetActiveFacets(label string, s ESearch, labelNames map[string]string) []FacetItem {
+
+	var items []FacetItem
+
+	for _, n := range facetNames {
+
+		value := s.Facets.Get(n.Key)
+		if value == "" {
+			continue
+		}
+
+		item := FacetItem{
+			Key:    n.Key,
+			Term:   value,
+			Title:  n.Name + ": " + value,
+			Active: true,
+		}
+
+		if name, ok := labelNames[value]; ok && n.Key == "label" {
+			item.Title = n.Name + ": " + name
+		}
+
+		fs := s
+		fs.Facets = s.Facets.Set(n.Key, "")
+		item.URL = SearchURL(label, fs)
+
+		items = append(items, item)
+
+	}
+
+	return items
+}
+
+// SearchURL return emails page link of label & search
+func SearchURL(label string, s ESearch) string {
+
+	v := url.Values{}
+
+	set := func(key, value string) {
+		if value != "" {
+			v.Set(key, value)
+		}
+	}
+
+	set("label", label)
+	set("search[query]", s.Query)
+	set("search[from]", s.From)
+	set("search[to]", s.To)
+	set("search[subject]", s.Subject)
+	set("search[text]", s.Text)
+	set("search[sort]", s.Sort)
+
+	for _, n := range facetNames {
+		set("facet["+n.Key+"]", s.Facets.Get(n.Key))
+	}
+
+	return os.Getenv("URL") + "/emails?" + v.Encode()
+}
@@ -0,0 +1,841 @@
+package main
+
+import (
+	"crypto/sha1"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/client"
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// IMAPSource connection of IMAP syncer
+type IMAPSource struct {
+	Host     string   `json:"host" bson:"host,omitempty"`
+	Port     int      `json:"port" bson:"port,omitempty"`
+	Username string   `json:"username" bson:"username,omitempty"`
+	Password string   `json:"-" bson:"password,omitempty"`
+	Security string   `json:"security" bson:"security,omitempty"`
+	Folders  []string `json:"folders" bson:"folders,omitempty"`
+}
+
+// IMAPFolder sync state of IMAP folder
+type IMAPFolder struct {
+	ID          bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner       string        `json:"owner" bson:"owner,omitempty"`
+	Account     string        `json:"account" bson:"account,omitempty"`
+	Name        string        `json:"name" bson:"name,omitempty"`
+	LabelID     string        `json:"labelID" bson:"labelID,omitempty"`
+	UIDValidity uint32        `json:"uidValidity" bson:"uidValidity,omitempty"`
+	UIDNext     uint32        `json:"uidNext" bson:"uidNext,omitempty"`
+	Synced      time.Time     `json:"synced" bson:"synced,omitempty"`
+}
+
+// IMAPUID location of message on IMAP server
+type IMAPUID struct {
+	Account     string `json:"account" bson:"account,omitempty"`
+	Folder      string `json:"folder" bson:"folder,omitempty"`
+	UIDValidity uint32 `json:"uidValidity" bson:"uidValidity,omitempty"`
+	UID         uint32 `json:"uid" bson:"uid,omitempty"`
+}
+
+// messageIDs message IDs in Message-ID, In-Reply-To & References headers
+var messageIDs = regexp.MustCompile(`<([^<>\s]+)>`)
+
+// Account return account key of source, username@host
+func (src IMAPSource) Account() string {
+
+	return src.Username + "@" + src.Host
+}
+
+// ParseMessageIDs return message IDs of header value without brackets
+func ParseMessageIDs(value string) []string {
+
+	var ids []string
+
+	for _, m := range messageIDs.FindAllStringSubmatch(value, -1) {
+		ids = append(ids, m[1])
+	}
+
+	return ids
+}
+
+// IMAPMessageID return message ID by account & Message-ID, key is used when Message-ID is missing
+func IMAPMessageID(account, messageID, key string) string {
+
+	if messageID == "" {
+		messageID = key
+	}
+
+	sum := sha1.Sum([]byte(account + "\n" + messageID))
+
+	return "imap" + hex.EncodeToString(sum[:8])
+}
+
+// IMAPLabelID return label ID of account folder
+func IMAPLabelID(account, folder string) string {
+
+	sum := sha1.Sum([]byte(account + "\n" + folder))
+
+	return "IMAP_" + hex.EncodeToString(sum[:6])
+}
+
+// IMAPDial connect & login to IMAP server, security is tls, starttls or none
+func IMAPDial(src IMAPSource) (*client.Client, error) {
+
+	port := src.Port
+	if port == 0 {
+		port = 993
+		if src.Security == "starttls" || src.Security == "none" {
+			port = 143
+		}
+	}
+
+	addr := src.Host + ":" + strconv.Itoa(port)
+
+	var c *client.Client
+	var err error
+
+	switch src.Security {
+	case "none":
+		c, err = client.Dial(addr)
+	case "starttls":
+		c, err = client.Dial(addr)
+		if err == nil {
+			err = c.StartTLS(&tls.Config{ServerName: src.Host})
+		}
+	default:
+		c, err = client.DialTLS(addr, &tls.Config{ServerName: src.Host})
+	}
+
+	if err != nil {
+		if c != nil {
+			c.Logout()
+		}
+		return nil, err
+	}
+
+	if err := c.Login(src.Username, src.Password); err != nil {
+		c.Logout()
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// IMAPFolders return selectable folders, all or ones set on source
+func IMAPFolders(c *client.Client, src IMAPSource) ([]*imap.MailboxInfo, error) {
+
+	ch := make(chan *imap.MailboxInfo, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.List("", "*", ch)
+	}()
+
+	selected := make(map[string]bool)
+	for _, f := range src.Folders {
+		selected[f] = true
+	}
+
+	var folders []*imap.MailboxInfo
+
+	for info := range ch {
+
+		noselect := false
+		for _, attr := range info.Attributes {
+			if strings.EqualFold(attr, imap.NoSelectAttr) {
+				noselect = true
+			}
+		}
+
+		if noselect || (len(selected) != 0 && !selected[info.Name]) {
+			continue
+		}
+
+		folders = append(folders, info)
+
+	}
+
+	return folders, <-done
+}
+
+// IMAPFetchEnvelopes return envelopes & flags of folder messages from UID
+func IMAPFetchEnvelopes(c *client.Client, from uint32) ([]*imap.Message, error) {
+
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(from, 0)
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, imap.FetchEnvelope, imap.FetchFlags, imap.FetchInternalDate}, ch)
+	}()
+
+	var msgs []*imap.Message
+
+	for msg := range ch {
+
+		// from:* return last message also when from is bigger than last UID
+		if msg.Uid >= from {
+			msgs = append(msgs, msg)
+		}
+
+	}
+
+	sort.Slice(msgs, func(i, j int) bool { return msgs[i].Uid < msgs[j].Uid })
+
+	return msgs, <-done
+}
+
+// IMAPFetchBodies return full source of messages by UID, messages are not marked seen
+func IMAPFetchBodies(c *client.Client, uids []uint32) (map[uint32][]byte, error) {
+
+	bodies := make(map[uint32][]byte)
+
+	if len(uids) == 0 {
+		return bodies, nil
+	}
+
+	seqset := new(imap.SeqSet)
+	seqset.AddNum(uids...)
+
+	section := &imap.BodySectionName{Peek: true}
+
+	ch := make(chan *imap.Message, 10)
+	done := make(chan error, 1)
+
+	go func() {
+		done <- c.UidFetch(seqset, []imap.FetchItem{imap.FetchUid, section.FetchItem()}, ch)
+	}()
+
+	var rerr error
+
+	for msg := range ch {
+
+		literal := msg.GetBody(section)
+		if literal == nil {
+			continue
+		}
+
+		raw, err := ioutil.ReadAll(literal)
+		if err != nil {
+			rerr = err
+			continue
+		}
+
+		bodies[msg.Uid] = raw
+
+	}
+
+	if err := <-done; err != nil {
+		return bodies, err
+	}
+
+	return bodies, rerr
+}
+
+// GetIMAPFolder return sync state of folder
+func GetIMAPFolder(owner, account, name string) IMAPFolder {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetIMAPFolder",
+	}
+
+	defer SaveLog(proc)
+
+	folder := IMAPFolder{
+		Owner:   owner,
+		Account: account,
+		Name:    name,
+	}
+
+	DB := MongoSession()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("imapFolders")
+	defer DB.Close()
+
+	err := DBC.Find(bson.M{"owner": owner, "account": account, "name": name}).One(&folder)
+	if err != nil && err != mgo.ErrNotFound {
+		HandleError(proc, "get imap folder", err, true)
+	}
+
+	return folder
+}
+
+// CRUDIMAPFolder save sync state of folder
+func CRUDIMAPFolder(folder IMAPFolder) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "CRUDIMAPFolder",
+	}
+
+	defer SaveLog(proc)
+
+	MS := MongoSession()
+	mongoC := MS.DB(os.Getenv("MONGO_DB")).C("imapFolders")
+	defer MS.Close()
+
+	queryCheck := bson.M{"owner": folder.Owner, "account": folder.Account, "name": folder.Name}
+
+	folder.Synced = time.Now()
+
+	actRes := IMAPFolder{}
+	err := mongoC.Find(queryCheck).Select(bson.M{"_id": 1}).One(&actRes)
+
+	if err != nil {
+
+		err = mongoC.Insert(folder)
+		if err != nil {
+			HandleError(proc, "error while inserting row", err, true)
+			return
+		}
+		return
+
+	}
+
+	change := bson.M{"$set": bson.M{
+		"labelID":     folder.LabelID,
+		"uidValidity": folder.UIDValidity,
+		"uidNext":     folder.UIDNext,
+		"synced":      folder.Synced,
+	}}
+	err = mongoC.Update(queryCheck, change)
+	if err != nil {
+		HandleError(proc, "error while updateing row", err, true)
+		return
+	}
+
+	return
+
+}
+
+// ResetIMAPFolder remove folder label & UIDs from messages when UIDVALIDITY changed
+func ResetIMAPFolder(folder IMAPFolder) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "ResetIMAPFolder",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	query := bson.M{"owner": folder.Owner, "imap": bson.M{"$elemMatch": bson.M{"account": folder.Account, "folder": folder.Name}}}
+
+	var tIDs []string
+	err := DBM.Find(query).Distinct("threadID", &tIDs)
+	if err != nil {
+		HandleError(proc, "get folder threads", err, true)
+		return
+	}
+
+	_, err = DBM.UpdateAll(query, bson.M{"$pull": bson.M{
+		"imap":   bson.M{"account": folder.Account, "folder": folder.Name},
+		"labels": folder.LabelID,
+	}})
+	if err != nil {
+		HandleError(proc, "reset folder messages", err, true)
+		return
+	}
+
+	SaveThreads(ImportThreads(folder.Owner, tIDs))
+
+}
+
+// MergeThreads move messages of thread to other thread
+func MergeThreads(owner, from, to string) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "MergeThreads",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	for _, c := range []string{"messages", "messagesRaw", "attachments"} {
+
+		_, err := DB.DB(os.Getenv("MONGO_DB")).C(c).UpdateAll(bson.M{"owner": owner, "threadID": from}, bson.M{"$set": bson.M{"threadID": to}})
+		if err != nil {
+			HandleError(proc, "merge "+c, err, true)
+		}
+
+	}
+
+	_, err := DB.DB(os.Getenv("MONGO_DB")).C("threads").RemoveAll(bson.M{"owner": owner, "threadID": from})
+	if err != nil {
+		HandleError(proc, "remove thread", err, true)
+	}
+
+	if err := searchBackend.DeleteThreads(owner, []string{from}); err != nil {
+		HandleError(proc, "remove thread from search", err, true)
+	}
+
+	var msgs []Message
+	err = DB.DB(os.Getenv("MONGO_DB")).C("messages").Find(bson.M{"owner": owner, "threadID": to}).All(&msgs)
+	if err != nil {
+		HandleError(proc, "get thread messages", err, true)
+		return
+	}
+
+	IndexSearchMessages(msgs)
+
+}
+
+// IMAPThreadID set thread of message by References & In-Reply-To
+// threads joined by message are merged to oldest thread ID
+func IMAPThreadID(owner string, msg *Message, batch []Message) {
+
+	threadIDs := make(map[string]bool)
+
+	refs := make(map[string]bool)
+	for _, r := range msg.References {
+		refs[r] = true
+	}
+
+	for _, b := range batch {
+
+		if refs[b.MessageID] {
+			threadIDs[b.ThreadID] = true
+		}
+
+		for _, r := range b.References {
+			if r == msg.MessageID && r != "" {
+				threadIDs[b.ThreadID] = true
+			}
+		}
+
+	}
+
+	var or []bson.M
+
+	if len(msg.References) != 0 {
+		or = append(or, bson.M{"messageID": bson.M{"$in": msg.References}})
+	}
+
+	if msg.MessageID != "" {
+		or = append(or, bson.M{"references": msg.MessageID})
+	}
+
+	if len(or) != 0 {
+
+		DB := MongoSession()
+
+		var tIDs []string
+		err := DB.DB(os.Getenv("MONGO_DB")).C("messages").Find(bson.M{"owner": owner, "$or": or}).Distinct("threadID", &tIDs)
+		if err == nil {
+			for _, t := range tIDs {
+				threadIDs[t] = true
+			}
+		}
+
+		DB.Close()
+
+	}
+
+	if len(threadIDs) == 0 {
+		msg.ThreadID = msg.MsgID
+		return
+	}
+
+	var tIDs []string
+	for t := range threadIDs {
+		tIDs = append(tIDs, t)
+	}
+
+	sort.Strings(tIDs)
+
+	msg.ThreadID = tIDs[0]
+
+	for _, t := range tIDs[1:] {
+
+		MergeThreads(owner, t, msg.ThreadID)
+
+		for k := range batch {
+			if batch[k].ThreadID == t {
+				batch[k].ThreadID = msg.ThreadID
+			}
+		}
+
+	}
+
+}
+
+// AddIMAPLocation add folder label & UID to already saved message
+func AddIMAPLocation(owner, msgID, labelID string, uid IMAPUID) (Message, error) {
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	var msg Message
+
+	_, err := DBM.Find(bson.M{"owner": owner, "msgID": msgID}).Apply(mgo.Change{
+		Update: bson.M{"$addToSet": bson.M{
+			"labels": labelID,
+			"imap":   uid,
+		}},
+		ReturnNew: true,
+	}, &msg)
+
+	return msg, err
+}
+
+// SyncIMAPFolder save new messages of folder from last synced UID
+func SyncIMAPFolder(c *client.Client, src IMAPSource, user User, info *imap.MailboxInfo) (int, error) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "SyncIMAPFolder",
+	}
+
+	defer SaveLog(proc)
+
+	account := src.Account()
+
+	status, err := c.Select(info.Name, true)
+	if err != nil {
+		return 0, err
+	}
+
+	folder := GetIMAPFolder(user.Email, account, info.Name)
+	folder.LabelID = IMAPLabelID(account, info.Name)
+
+	name := info.Name
+	if info.Delimiter != "" && info.Delimiter != "/" {
+		name = strings.Replace(name, info.Delimiter, "/", -1)
+	}
+
+	CRUDLabel(Label{
+		LabelID: folder.LabelID,
+		Owner:   user.Email,
+		Name:    account + "/" + name,
+		Type:    "user",
+	})
+
+	if folder.UIDValidity != status.UidValidity {
+
+		// UIDs of old validity are not valid anymore, folder is synced again
+		if folder.UIDValidity != 0 {
+			ResetIMAPFolder(folder)
+		}
+
+		folder.UIDValidity = status.UidValidity
+		folder.UIDNext = 1
+
+	}
+
+	if folder.UIDNext == 0 {
+		folder.UIDNext = 1
+	}
+
+	if status.Messages == 0 || (status.UidNext != 0 && folder.UIDNext >= status.UidNext) {
+		CRUDIMAPFolder(folder)
+		return 0, nil
+	}
+
+	envelopes, err := IMAPFetchEnvelopes(c, folder.UIDNext)
+	if err != nil {
+		return 0, err
+	}
+
+	count := 0
+
+	for len(envelopes) != 0 {
+
+		batch := envelopes
+		if len(batch) > importBatch {
+			batch = batch[:importBatch]
+		}
+		envelopes = envelopes[len(batch):]
+
+		var uids []uint32
+		var updated []Message
+
+		threadIDs := make(map[string]bool)
+		locations := make(map[uint32]IMAPUID)
+		flags := make(map[uint32][]string)
+		dates := make(map[uint32]time.Time)
+
+		for _, e := range batch {
+
+			uid := IMAPUID{
+				Account:     account,
+				Folder:      info.Name,
+				UIDValidity: status.UidValidity,
+				UID:         e.Uid,
+			}
+
+			messageID := ""
+			if e.Envelope != nil {
+				messageID = strings.Trim(strings.TrimSpace(e.Envelope.MessageId), "<>")
+			}
+
+			key := info.Name + "/" + strconv.FormatUint(uint64(status.UidValidity), 10) + "/" + strconv.FormatUint(uint64(e.Uid), 10)
+
+			// message in other folder or synced before is only labeled
+			msg, err := AddIMAPLocation(user.Email, IMAPMessageID(account, messageID, key), folder.LabelID, uid)
+			if err == nil {
+				updated = append(updated, msg)
+				threadIDs[msg.ThreadID] = true
+				continue
+			}
+
+			uids = append(uids, e.Uid)
+			locations[e.Uid] = uid
+			flags[e.Uid] = e.Flags
+			dates[e.Uid] = e.InternalDate
+
+		}
+
+		bodies, err := IMAPFetchBodies(c, uids)
+		if err != nil {
+			HandleError(proc, "fetch messages of "+info.Name, err, true)
+		}
+
+		var gmsgs []*gmail.Message
+		var messages []Message
+		var raws [][]byte
+
+		for _, uid := range uids {
+
+			raw, ok := bodies[uid]
+			if !ok {
+				continue
+			}
+
+			msg := ParseMboxMessage("", raw, nil)
+
+			messageID := ""
+			if ids := ParseMessageIDs(GetPartHeader(msg.Payload.Headers, "Message-ID")); len(ids) != 0 {
+				messageID = ids[0]
+			}
+
+			loc := locations[uid]
+			msg.Id = IMAPMessageID(account, messageID, loc.Folder+"/"+strconv.FormatUint(uint64(loc.UIDValidity), 10)+"/"+strconv.FormatUint(uint64(loc.UID), 10))
+			msg.LabelIds = []string{folder.LabelID}
+
+			if !dates[uid].IsZero() {
+				msg.InternalDate = dates[uid].Unix() * 1000
+			}
+
+			seen := false
+			for _, f := range flags[uid] {
+				switch f {
+				case imap.SeenFlag:
+					seen = true
+				case imap.FlaggedFlag:
+					msg.LabelIds = append(msg.LabelIds, "STARRED")
+				}
+			}
+
+			if !seen {
+				msg.LabelIds = append(msg.LabelIds, "UNREAD")
+			}
+
+			message := ProccessMessage(msg, user)
+			message.Snippet = ImportSnippet(message)
+			message.MessageID = messageID
+			message.IMAP = []IMAPUID{loc}
+
+			// References may be cut, parent is always in In-Reply-To
+			refs := ParseMessageIDs(GetPartHeader(msg.Payload.Headers, "References") + " " + GetPartHeader(msg.Payload.Headers, "In-Reply-To"))
+			for _, r := range refs {
+				if r != messageID {
+					message.References = append(message.References, r)
+				}
+			}
+
+			IMAPThreadID(user.Email, &message, messages)
+
+			msg.Snippet = message.Snippet
+
+			gmsgs = append(gmsgs, msg)
+			messages = append(messages, message)
+			raws = append(raws, raw)
+
+		}
+
+		var rawMessages []RawMessage
+		var attachments []MessageAttachment
+
+		// thread IDs are final after whole batch is threaded
+		for k := range messages {
+
+			gmsgs[k].ThreadId = messages[k].ThreadID
+
+			for a := range messages[k].Attachments {
+				messages[k].Attachments[a].ThreadID = messages[k].ThreadID
+			}
+
+			rawMessages = append(rawMessages, ImportRawMessage(gmsgs[k], messages[k], user, raws[k]))
+			attachments = append(attachments, messages[k].Attachments...)
+
+		}
+
+		SaveImported(user, messages, rawMessages, attachments)
+
+		if len(updated) != 0 {
+
+			IndexSearchMessages(updated)
+
+			var tIDs []string
+			for t := range threadIDs {
+				tIDs = append(tIDs, t)
+			}
+
+			SaveThreads(ImportThreads(user.Email, tIDs))
+
+		}
+
+		count = count + len(messages)
+
+		// fetched messages are saved, UIDs without body are fetched again by next sync
+		// saved ones are then only labeled
+		if err != nil {
+			return count, err
+		}
+
+		// next sync continue after last saved UID
+		folder.UIDNext = batch[len(batch)-1].Uid + 1
+		CRUDIMAPFolder(folder)
+
+	}
+
+	if status.UidNext > folder.UIDNext {
+		folder.UIDNext = status.UidNext
+	}
+
+	CRUDIMAPFolder(folder)
+
+	return count, nil
+}
+
+// SyncIMAP use syncer struct to sync folders of IMAP account
+func SyncIMAP(syncer Syncer) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "SyncIMAP",
+	}
+
+	defer SaveLog(proc)
+
+	user := GetUserByEmail(syncer.Owner)
+
+	syncer.Status = "start"
+	CRUDSyncer(syncer)
+
+	// system syncers read account of user syncer, password is not copied
+	src := syncer.IMAP
+	if src == nil && bson.IsObjectIdHex(syncer.Type) {
+		src = GetSyncer(syncer.Type).IMAP
+	}
+
+	if src == nil {
+		syncer.Status = "error:" + errors.New("missing imap account").Error()
+		CRUDSyncer(syncer)
+		return
+	}
+
+	c, err := IMAPDial(*src)
+	if err != nil {
+		HandleError(proc, "connect imap "+src.Account(), err, true)
+		syncer.Status = "error:" + err.Error()
+		CRUDSyncer(syncer)
+		return
+	}
+	defer c.Logout()
+
+	folders, err := IMAPFolders(c, *src)
+	if err != nil {
+		HandleError(proc, "list imap folders", err, true)
+		syncer.Status = "error:" + err.Error()
+		CRUDSyncer(syncer)
+		return
+	}
+
+	for _, info := range folders {
+
+		syncer.Status = "start folder " + info.Name
+		CRUDSyncer(syncer)
+
+		count, err := SyncIMAPFolder(c, *src, user, info)
+
+		syncer.Count = syncer.Count + count
+
+		if err != nil {
+			HandleError(proc, "sync imap folder "+info.Name, err, true)
+			syncer.Status = "error:" + err.Error()
+			CRUDSyncer(syncer)
+			return
+		}
+
+	}
+
+	syncer.End = time.Now()
+	syncer.Status = "end"
+	CRUDSyncer(syncer)
+
+	// Alert saved searches
+	CheckSavedSearches(syncer.Owner)
+
+}
+
+// EnsureIMAPIndexes create indexes used to thread IMAP messages
+func EnsureIMAPIndexes() {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "EnsureIMAPIndexes",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	for _, key := range [][]string{{"owner", "messageID"}, {"owner", "references"}} {
+
+		err := DBM.EnsureIndex(mgo.Index{Key: key, Background: true})
+		if err != nil {
+			HandleError(proc, "ensure messages index", err, true)
+		}
+
+	}
+
+}
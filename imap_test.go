@@ -0,0 +1,449 @@
+package main
+
+import (
+	"bytes"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-imap"
+	"github.com/emersion/go-imap/backend"
+	"github.com/emersion/go-imap/backend/memory"
+	"github.com/emersion/go-imap/client"
+	"github.com/emersion/go-imap/server"
+	"github.com/globalsign/mgo/bson"
+)
+
+// testIMAPOwner owner of messages synced by tests
+const testIMAPOwner = "owner@example.com"
+
+// testIMAPBackend memory backend with UIDVALIDITY set by test
+type testIMAPBackend struct {
+	backend.Backend
+	validity *uint32
+}
+
+type testIMAPUser struct {
+	backend.User
+	validity *uint32
+}
+
+type testIMAPMailbox struct {
+	backend.Mailbox
+	validity *uint32
+}
+
+func (be testIMAPBackend) Login(info *imap.ConnInfo, username, password string) (backend.User, error) {
+
+	u, err := be.Backend.Login(info, username, password)
+	if err != nil {
+		return nil, err
+	}
+
+	return testIMAPUser{u, be.validity}, nil
+}
+
+func (u testIMAPUser) ListMailboxes(subscribed bool) ([]backend.Mailbox, error) {
+
+	list, err := u.User.ListMailboxes(subscribed)
+	for k := range list {
+		list[k] = testIMAPMailbox{list[k], u.validity}
+	}
+
+	return list, err
+}
+
+func (u testIMAPUser) GetMailbox(name string) (backend.Mailbox, error) {
+
+	mbox, err := u.User.GetMailbox(name)
+	if err != nil {
+		return nil, err
+	}
+
+	return testIMAPMailbox{mbox, u.validity}, nil
+}
+
+func (mbox testIMAPMailbox) Status(items []imap.StatusItem) (*imap.MailboxStatus, error) {
+
+	status, err := mbox.Mailbox.Status(items)
+	if err == nil && status.UidValidity != 0 {
+		status.UidValidity = *mbox.validity
+	}
+
+	return status, err
+}
+
+// testIMAPServer in-process IMAP server with empty INBOX & Archive folders
+type testIMAPServer struct {
+	t        *testing.T
+	user     backend.User
+	validity uint32
+	src      IMAPSource
+	server   *server.Server
+	clients  []*client.Client
+}
+
+// newTestIMAPServer start server on free local port
+func newTestIMAPServer(t *testing.T) *testIMAPServer {
+
+	ts := &testIMAPServer{t: t, validity: 1}
+
+	be := memory.New()
+
+	u, err := be.Login(nil, "username", "password")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts.user = u
+
+	// memory backend start with one message in INBOX
+	inbox, err := u.GetMailbox("INBOX")
+	if err != nil {
+		t.Fatal(err)
+	}
+	seqset := new(imap.SeqSet)
+	seqset.AddRange(1, 0)
+	if err := inbox.UpdateMessagesFlags(true, seqset, imap.AddFlags, []string{imap.DeletedFlag}); err != nil {
+		t.Fatal(err)
+	}
+	if err := inbox.Expunge(); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := u.CreateMailbox("Archive"); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ts.server = server.New(testIMAPBackend{be, &ts.validity})
+	ts.server.AllowInsecureAuth = true
+
+	go ts.server.Serve(l)
+
+	ts.src = IMAPSource{
+		Host:     "127.0.0.1",
+		Port:     l.Addr().(*net.TCPAddr).Port,
+		Username: "username",
+		Password: "password",
+		Security: "none",
+	}
+
+	return ts
+}
+
+// Add append message to folder
+func (ts *testIMAPServer) Add(folder, messageID, headers, body string) {
+
+	raw := "From: Sender <sender@example.org>\r\n" +
+		"To: " + testIMAPOwner + "\r\n" +
+		"Subject: message " + messageID + "\r\n" +
+		"Date: Mon, 02 Mar 2020 10:00:00 +0000\r\n" +
+		"Message-ID: <" + messageID + ">\r\n" +
+		headers +
+		"Content-Type: text/plain\r\n" +
+		"\r\n" +
+		body + "\r\n"
+
+	mbox, err := ts.user.GetMailbox(folder)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	if err := mbox.CreateMessage(nil, time.Now(), bytes.NewBufferString(raw)); err != nil {
+		ts.t.Fatal(err)
+	}
+
+}
+
+// Close logout clients & stop server
+func (ts *testIMAPServer) Close() {
+
+	for _, c := range ts.clients {
+		c.Logout()
+	}
+
+	ts.server.Close()
+}
+
+// Dial return logged in client, it is closed with server
+func (ts *testIMAPServer) Dial() *client.Client {
+
+	c, err := IMAPDial(ts.src)
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	ts.clients = append(ts.clients, c)
+
+	return c
+}
+
+// Sync sync folder of test server
+func (ts *testIMAPServer) Sync(folder string) int {
+
+	c := ts.Dial()
+
+	folders, err := IMAPFolders(c, IMAPSource{Folders: []string{folder}})
+	if err != nil || len(folders) != 1 {
+		ts.t.Fatalf("folder %s: %v %v", folder, folders, err)
+	}
+
+	count, err := SyncIMAPFolder(c, ts.src, User{Email: testIMAPOwner}, folders[0])
+	if err != nil {
+		ts.t.Fatal(err)
+	}
+
+	return count
+}
+
+// testMessages return synced messages of owner
+func testMessages(t *testing.T) []Message {
+
+	var msgs []Message
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	err := DB.DB(os.Getenv("MONGO_DB")).C("messages").Find(bson.M{"owner": testIMAPOwner}).Sort("messageID").All(&msgs)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return msgs
+}
+
+func TestIMAPFetch(t *testing.T) {
+
+	ts := newTestIMAPServer(t)
+	defer ts.Close()
+	ts.Add("INBOX", "a@example.org", "", "first")
+	ts.Add("INBOX", "b@example.org", "", "second")
+
+	c := ts.Dial()
+
+	if _, err := c.Select("INBOX", true); err != nil {
+		t.Fatal(err)
+	}
+
+	envelopes, err := IMAPFetchEnvelopes(c, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(envelopes) != 2 || envelopes[0].Envelope.MessageId != "<a@example.org>" {
+		t.Fatalf("envelopes %v", envelopes)
+	}
+
+	// from after last UID return nothing
+	last, err := IMAPFetchEnvelopes(c, envelopes[1].Uid+1)
+	if err != nil || len(last) != 0 {
+		t.Fatalf("envelopes after last %v %v", last, err)
+	}
+
+	bodies, err := IMAPFetchBodies(c, []uint32{envelopes[1].Uid})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Contains(bodies[envelopes[1].Uid], []byte("second")) {
+		t.Fatalf("body %q", bodies[envelopes[1].Uid])
+	}
+
+}
+
+func TestIMAPIncrementalSyncUIDValidity(t *testing.T) {
+
+	defer testMongo(t)()
+
+	ts := newTestIMAPServer(t)
+	defer ts.Close()
+	ts.Add("INBOX", "a@example.org", "", "first")
+	ts.Add("INBOX", "b@example.org", "", "second")
+
+	if n := ts.Sync("INBOX"); n != 2 {
+		t.Fatalf("first sync saved %d messages", n)
+	}
+
+	// nothing new
+	if n := ts.Sync("INBOX"); n != 0 {
+		t.Fatalf("sync without changes saved %d messages", n)
+	}
+
+	// only new message is fetched
+	ts.Add("INBOX", "c@example.org", "", "third")
+
+	if n := ts.Sync("INBOX"); n != 1 {
+		t.Fatalf("incremental sync saved %d messages", n)
+	}
+
+	account := ts.src.Account()
+
+	folder := GetIMAPFolder(testIMAPOwner, account, "INBOX")
+	if folder.UIDValidity != 1 || folder.UIDNext != 4 {
+		t.Fatalf("folder state %+v", folder)
+	}
+
+	// new UIDVALIDITY, folder is synced again & saved messages are only labeled
+	ts.validity = 7
+
+	if n := ts.Sync("INBOX"); n != 0 {
+		t.Fatalf("sync after uidvalidity change saved %d messages", n)
+	}
+
+	folder = GetIMAPFolder(testIMAPOwner, account, "INBOX")
+	if folder.UIDValidity != 7 || folder.UIDNext != 4 {
+		t.Fatalf("folder state after uidvalidity change %+v", folder)
+	}
+
+	msgs := testMessages(t)
+	if len(msgs) != 3 {
+		t.Fatalf("saved %d messages", len(msgs))
+	}
+
+	for _, m := range msgs {
+
+		if len(m.IMAP) != 1 || m.IMAP[0].UIDValidity != 7 {
+			t.Fatalf("message %s locations %+v", m.MessageID, m.IMAP)
+		}
+
+		labeled := false
+		for _, l := range m.Labels {
+			labeled = labeled || l == folder.LabelID
+		}
+		if !labeled {
+			t.Fatalf("message %s labels %v", m.MessageID, m.Labels)
+		}
+
+	}
+
+}
+
+func TestIMAPMessageInSecondFolder(t *testing.T) {
+
+	defer testMongo(t)()
+
+	ts := newTestIMAPServer(t)
+	defer ts.Close()
+	ts.Add("INBOX", "a@example.org", "", "first")
+	ts.Add("Archive", "a@example.org", "", "first")
+	ts.Add("Archive", "b@example.org", "", "second")
+
+	if n := ts.Sync("INBOX"); n != 1 {
+		t.Fatalf("inbox sync saved %d messages", n)
+	}
+
+	// message of inbox is only labeled
+	if n := ts.Sync("Archive"); n != 1 {
+		t.Fatalf("archive sync saved %d messages", n)
+	}
+
+	account := ts.src.Account()
+	inbox := IMAPLabelID(account, "INBOX")
+	archive := IMAPLabelID(account, "Archive")
+
+	msgs := testMessages(t)
+	if len(msgs) != 2 {
+		t.Fatalf("saved %d messages", len(msgs))
+	}
+
+	labels := map[string]bool{}
+	for _, l := range msgs[0].Labels {
+		labels[l] = true
+	}
+
+	if msgs[0].MessageID != "a@example.org" || !labels[inbox] || !labels[archive] || len(msgs[0].IMAP) != 2 {
+		t.Fatalf("message in both folders %s labels %v locations %+v", msgs[0].MessageID, msgs[0].Labels, msgs[0].IMAP)
+	}
+
+	for _, l := range msgs[1].Labels {
+		if l == inbox {
+			t.Fatalf("archive message has inbox label %v", msgs[1].Labels)
+		}
+	}
+
+}
+
+func TestIMAPThreading(t *testing.T) {
+
+	defer testMongo(t)()
+
+	ts := newTestIMAPServer(t)
+	defer ts.Close()
+
+	// reply & unrelated message are synced before parent
+	ts.Add("INBOX", "b@example.org", "In-Reply-To: <a@example.org>\r\n", "reply")
+	ts.Add("INBOX", "c@example.org", "", "other")
+	ts.Add("INBOX", "z@example.org", "", "alone")
+
+	if n := ts.Sync("INBOX"); n != 3 {
+		t.Fatalf("inbox sync saved %d messages", n)
+	}
+
+	msgs := testMessages(t)
+	if msgs[0].ThreadID == msgs[1].ThreadID {
+		t.Fatalf("unrelated messages in same thread %s", msgs[0].ThreadID)
+	}
+
+	merged := []string{msgs[0].ThreadID, msgs[1].ThreadID}
+
+	// parent join reply, later message reference parent & other message, threads are merged
+	ts.Add("Archive", "a@example.org", "", "parent")
+	ts.Add("Archive", "d@example.org", "References: <a@example.org> <c@example.org>\r\n", "join")
+
+	if n := ts.Sync("Archive"); n != 2 {
+		t.Fatalf("archive sync saved %d messages", n)
+	}
+
+	msgs = testMessages(t)
+	if len(msgs) != 5 {
+		t.Fatalf("saved %d messages", len(msgs))
+	}
+
+	threadID := ""
+	for _, m := range msgs {
+
+		if m.MessageID == "z@example.org" {
+			continue
+		}
+
+		if threadID == "" {
+			threadID = m.ThreadID
+		}
+
+		if m.ThreadID != threadID {
+			t.Fatalf("message %s in thread %s, expected %s", m.MessageID, m.ThreadID, threadID)
+		}
+
+	}
+
+	if msgs[4].ThreadID == threadID {
+		t.Fatalf("unrelated message merged to thread %s", threadID)
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	for _, tID := range merged {
+
+		count, err := DB.DB(os.Getenv("MONGO_DB")).C("threads").Find(bson.M{"owner": testIMAPOwner, "threadID": tID}).Count()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if want := 0; tID == threadID {
+			want = 1
+			if count != want {
+				t.Fatalf("thread %s count %d", tID, count)
+			}
+		} else if count != want {
+			t.Fatalf("merged thread %s not removed", tID)
+		}
+
+	}
+
+}
@@ -0,0 +1,792 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/mail"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+	gmail "google.golang.org/api/gmail/v1"
+)
+
+// maxImportSource original source of bigger messages is not saved
+const maxImportSource = 10000000
+
+// importBatch messages saved at once while importing
+const importBatch = 100
+
+// importLabels system label IDs by Takeout label name
+var importLabels = map[string]string{
+	"Inbox":               "INBOX",
+	"Sent":                "SENT",
+	"Important":           "IMPORTANT",
+	"Starred":             "STARRED",
+	"Spam":                "SPAM",
+	"Trash":               "TRASH",
+	"Draft":               "DRAFT",
+	"Drafts":              "DRAFT",
+	"Unread":              "UNREAD",
+	"Chat":                "CHAT",
+	"Category Personal":   "CATEGORY_PERSONAL",
+	"Category Social":     "CATEGORY_SOCIAL",
+	"Category Promotions": "CATEGORY_PROMOTIONS",
+	"Category Updates":    "CATEGORY_UPDATES",
+	"Category Forums":     "CATEGORY_FORUMS",
+	"Opened":              "",
+	"Archived":            "",
+}
+
+// mboxSeparator From line with sender & date, expl. From sender@example.com Sat Jan 03 01:05:34 +0000 2015
+var mboxSeparator = regexp.MustCompile(`^From \S+ +\S.*\d\d?:\d\d.*\d{4}\s*$`)
+
+// MboxReader read messages from mbox file
+// blank is set when last read line is empty, messages are separated by empty line
+type MboxReader struct {
+	r     *bufio.Reader
+	from  string
+	blank bool
+}
+
+// NewMboxReader return mbox reader
+func NewMboxReader(r io.Reader) *MboxReader {
+
+	return &MboxReader{r: bufio.NewReaderSize(r, 1<<20)}
+}
+
+// Next return From line & source of next message, io.EOF at end of file
+func (m *MboxReader) Next() (string, []byte, error) {
+
+	var buf bytes.Buffer
+
+	for {
+
+		line, err := m.r.ReadBytes('\n')
+
+		// From line in body without empty line before or sender & date is not separator
+		if bytes.HasPrefix(line, []byte("From ")) && (m.from == "" || m.blank) && mboxSeparator.Match(line) {
+
+			from := m.from
+			m.from = strings.TrimSpace(string(line))
+			m.blank = false
+
+			if from != "" {
+				return from, MboxSource(buf.Bytes()), nil
+			}
+
+			line = nil
+
+		}
+
+		if m.from != "" && len(line) != 0 {
+
+			// lines quoted in mboxrd & mboxo format
+			if quoted := bytes.TrimLeft(line, ">"); len(quoted) != len(line) && bytes.HasPrefix(quoted, []byte("From ")) {
+				line = line[1:]
+			}
+
+			buf.Write(line)
+
+		}
+
+		if line != nil {
+			m.blank = len(bytes.TrimRight(line, "\r\n")) == 0
+		}
+
+		if err == io.EOF {
+
+			if m.from == "" {
+				return "", nil, io.EOF
+			}
+
+			from := m.from
+			m.from = ""
+
+			return from, MboxSource(buf.Bytes()), nil
+
+		}
+
+		if err != nil {
+			return "", nil, err
+		}
+
+	}
+
+}
+
+// MboxSource remove empty line which separate messages
+func MboxSource(raw []byte) []byte {
+
+	if bytes.HasSuffix(raw, []byte("\r\n\r\n")) {
+		return raw[:len(raw)-2]
+	}
+
+	if bytes.HasSuffix(raw, []byte("\n\n")) {
+		return raw[:len(raw)-1]
+	}
+
+	return raw
+}
+
+// ParseMboxHeaders return ordered unfolded headers & body of message or part
+func ParseMboxHeaders(raw []byte) ([]*gmail.MessagePartHeader, []byte) {
+
+	var headers []*gmail.MessagePartHeader
+
+	rest := raw
+
+	for len(rest) != 0 {
+
+		line := rest
+		next := []byte{}
+
+		if i := bytes.IndexByte(rest, '\n'); i != -1 {
+			line = rest[:i]
+			next = rest[i+1:]
+		}
+
+		line = bytes.TrimRight(line, "\r")
+
+		if len(line) == 0 {
+			return headers, next
+		}
+
+		rest = next
+
+		// folded header continue on lines starting with space
+		if (line[0] == ' ' || line[0] == '\t') && len(headers) != 0 {
+			h := headers[len(headers)-1]
+			h.Value = h.Value + " " + strings.TrimSpace(string(line))
+			continue
+		}
+
+		i := bytes.IndexByte(line, ':')
+		if i == -1 {
+			continue
+		}
+
+		headers = append(headers, &gmail.MessagePartHeader{
+			Name:  strings.TrimSpace(string(line[:i])),
+			Value: strings.TrimSpace(string(line[i+1:])),
+		})
+
+	}
+
+	return headers, rest
+}
+
+// SplitMultipart return parts of multipart body
+func SplitMultipart(body []byte, boundary string) [][]byte {
+
+	var parts [][]byte
+
+	delimiter := "--" + boundary
+
+	start := -1
+	pos := 0
+
+	for pos < len(body) {
+
+		end := len(body)
+		if i := bytes.IndexByte(body[pos:], '\n'); i != -1 {
+			end = pos + i + 1
+		}
+
+		line := strings.TrimRight(string(body[pos:end]), " \t\r\n")
+
+		if line == delimiter || line == delimiter+"--" {
+
+			if start != -1 {
+				parts = append(parts, MimePartContent(body[start:pos]))
+			}
+
+			if line != delimiter {
+				return parts
+			}
+
+			start = end
+
+		}
+
+		pos = end
+
+	}
+
+	// part without closing delimiter
+	if start != -1 && start < len(body) {
+		parts = append(parts, MimePartContent(body[start:]))
+	}
+
+	return parts
+}
+
+// MimePartContent remove line break which belongs to delimiter
+func MimePartContent(part []byte) []byte {
+
+	if bytes.HasSuffix(part, []byte("\r\n")) {
+		return part[:len(part)-2]
+	}
+
+	return bytes.TrimSuffix(part, []byte("\n"))
+}
+
+// DecodeMboxBody remove content transfer encoding of part body
+func DecodeMboxBody(body []byte, encoding string) []byte {
+
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "base64":
+
+		clean := strings.Join(strings.Fields(string(body)), "")
+
+		decoded, err := base64.StdEncoding.DecodeString(clean)
+		if err != nil {
+			decoded, err = base64.RawStdEncoding.DecodeString(strings.TrimRight(clean, "="))
+		}
+
+		if err == nil {
+			return decoded
+		}
+
+	case "quoted-printable":
+
+		decoded, err := ioutil.ReadAll(quotedprintable.NewReader(bytes.NewReader(body)))
+		if err == nil {
+			return decoded
+		}
+
+	}
+
+	return body
+}
+
+// ParseMboxPart return gmail api style part, bodies are decoded & base64url encoded
+func ParseMboxPart(raw []byte, partID string) *gmail.MessagePart {
+
+	headers, body := ParseMboxHeaders(raw)
+
+	mimeType, params, err := mime.ParseMediaType(GetPartHeader(headers, "Content-Type"))
+	if err != nil || mimeType == "" {
+		mimeType = "text/plain"
+	}
+
+	p := &gmail.MessagePart{
+		PartId:   partID,
+		MimeType: mimeType,
+		Headers:  headers,
+		Filename: params["name"],
+		Body:     &gmail.MessagePartBody{},
+	}
+
+	if _, dparams, err := mime.ParseMediaType(GetPartHeader(headers, "Content-Disposition")); err == nil && dparams["filename"] != "" {
+		p.Filename = dparams["filename"]
+	}
+
+	childID := func(k int) string {
+		if partID == "" {
+			return strconv.Itoa(k)
+		}
+		return partID + "." + strconv.Itoa(k)
+	}
+
+	switch {
+	case strings.HasPrefix(mimeType, "multipart/") && params["boundary"] != "":
+
+		for k, part := range SplitMultipart(body, params["boundary"]) {
+			p.Parts = append(p.Parts, ParseMboxPart(part, childID(k)))
+		}
+
+	case mimeType == "message/rfc822":
+
+		p.Body.Size = int64(len(body))
+		p.Parts = append(p.Parts, ParseMboxPart(body, childID(0)))
+
+	default:
+
+		data := DecodeMboxBody(body, GetPartHeader(headers, "Content-Transfer-Encoding"))
+
+		p.Body.Size = int64(len(data))
+		p.Body.Data = base64.URLEncoding.EncodeToString(data)
+
+	}
+
+	return p
+}
+
+// ParseMboxMessage return gmail api style message from Takeout mbox message
+// message & thread IDs are read from From line & X-GM-THRID, both are decimal in Takeout
+func ParseMboxMessage(from string, raw []byte, labelIDs map[string]string) *gmail.Message {
+
+	payload := ParseMboxPart(raw, "")
+
+	msg := &gmail.Message{
+		Payload:      payload,
+		SizeEstimate: int64(len(raw)),
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(from, "From "))
+
+	if len(fields) != 0 {
+
+		if id, err := strconv.ParseUint(strings.SplitN(fields[0], "@", 2)[0], 10, 64); err == nil {
+			msg.Id = strconv.FormatUint(id, 16)
+		}
+
+	}
+
+	if msg.Id == "" {
+
+		source := []byte(GetPartHeader(payload.Headers, "Message-ID"))
+		if len(source) == 0 {
+			source = raw
+		}
+
+		sum := sha1.Sum(source)
+		msg.Id = "mbox" + hex.EncodeToString(sum[:8])
+
+	}
+
+	msg.ThreadId = msg.Id
+	if id, err := strconv.ParseUint(GetPartHeader(payload.Headers, "X-GM-THRID"), 10, 64); err == nil {
+		msg.ThreadId = strconv.FormatUint(id, 16)
+	}
+
+	date, err := mail.ParseDate(GetPartHeader(payload.Headers, "Date"))
+	if err != nil && len(fields) > 1 {
+
+		// From line date, Mon Jan 2 15:04:05 -0700 2006
+		date, err = time.Parse("Mon Jan 2 15:04:05 -0700 2006", strings.Join(fields[1:], " "))
+		if err != nil {
+			date, err = time.Parse(time.ANSIC, strings.Join(fields[1:], " "))
+		}
+
+	}
+	if err != nil {
+		date = time.Now()
+	}
+
+	msg.InternalDate = date.Unix() * 1000
+
+	for _, name := range SplitMboxLabels(DecodeHeader(GetPartHeader(payload.Headers, "X-Gmail-Labels"))) {
+
+		if id, ok := labelIDs[name]; ok && id != "" {
+			msg.LabelIds = append(msg.LabelIds, id)
+		}
+
+	}
+
+	return msg
+}
+
+// SplitMboxLabels return label names of X-Gmail-Labels, quoted names can contain commas
+func SplitMboxLabels(value string) []string {
+
+	var labels []string
+	var label strings.Builder
+
+	quoted := false
+
+	add := func() {
+		if name := strings.TrimSpace(label.String()); name != "" {
+			labels = append(labels, name)
+		}
+		label.Reset()
+	}
+
+	for _, r := range value {
+
+		switch {
+		case r == '"':
+			quoted = !quoted
+		case r == ',' && !quoted:
+			add()
+		default:
+			label.WriteRune(r)
+		}
+
+	}
+
+	add()
+
+	return labels
+}
+
+// ImportLabelIDs add IDs of message labels to map, user labels missing in db are created
+func ImportLabelIDs(user User, raw []byte, labelIDs map[string]string) {
+
+	headers, _ := ParseMboxHeaders(raw)
+
+	for _, name := range SplitMboxLabels(DecodeHeader(GetPartHeader(headers, "X-Gmail-Labels"))) {
+
+		if _, ok := labelIDs[name]; ok {
+			continue
+		}
+
+		label := Label{
+			LabelID: "Takeout_" + name,
+			Owner:   user.Email,
+			Name:    name,
+			Type:    "user",
+		}
+
+		CRUDLabel(label)
+
+		labelIDs[name] = label.LabelID
+
+	}
+
+}
+
+// ImportedMessage check if message was already synced or imported
+// Message-ID is checked only for messages without gmail ID
+func ImportedMessage(owner string, msg *gmail.Message) bool {
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	count, err := DBC.Find(bson.M{"owner": owner, "msgID": msg.Id}).Count()
+	if err == nil && count != 0 {
+		return true
+	}
+
+	messageID := GetPartHeader(msg.Payload.Headers, "Message-ID")
+	if !strings.HasPrefix(msg.Id, "mbox") || messageID == "" {
+		return false
+	}
+
+	count, err = DBC.Find(bson.M{"owner": owner, "headers": bson.M{"$elemMatch": bson.M{
+		"name":  bson.M{"$in": []string{"Message-ID", "Message-Id", "Message-id", "MESSAGE-ID"}},
+		"value": messageID,
+	}}}).Count()
+
+	return err == nil && count != 0
+}
+
+// ImportRawMessage return raw message with source, attachments data is removed from payload
+func ImportRawMessage(msg *gmail.Message, message Message, user User, raw []byte) RawMessage {
+
+	attachIDs := make(map[string]bool)
+	for _, a := range message.Attachments {
+		attachIDs[a.AttacID] = true
+	}
+
+	var strip func(p *gmail.MessagePart)
+	strip = func(p *gmail.MessagePart) {
+
+		id := "inline-" + msg.Id + "-" + p.PartId
+		if attachIDs[id] {
+			p.Body = &gmail.MessagePartBody{AttachmentId: id, Size: p.Body.Size}
+		}
+
+		for _, part := range p.Parts {
+			strip(part)
+		}
+
+	}
+
+	strip(msg.Payload)
+
+	rawMsg := RawMessageProccess(msg, user)
+
+	if len(raw) < maxImportSource {
+		rawMsg.Source = raw
+	}
+
+	return rawMsg
+}
+
+// ImportSnippet return short text of message like gmail snippet
+func ImportSnippet(message Message) string {
+
+	text := message.Text
+	if strings.TrimSpace(text) == "" {
+		text = message.HTMLText
+	}
+
+	text = strings.Join(strings.Fields(text), " ")
+
+	if len(text) > 200 {
+		text = text[:runeStart(text, 200)]
+	}
+
+	return text
+}
+
+// ImportThreads rebuild threads from all saved messages of thread
+func ImportThreads(owner string, threadIDs []string) []Thread {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "ImportThreads",
+	}
+
+	defer SaveLog(proc)
+
+	var threads []Thread
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	for _, threadID := range threadIDs {
+
+		var msgs []Message
+
+		err := DBC.Find(bson.M{"owner": owner, "threadID": threadID}).Select(bson.M{
+			"text":           0,
+			"html":           0,
+			"htmlText":       0,
+			"attachmentText": 0,
+			"embedded":       0,
+			"mime":           0,
+			"headers":        0,
+		}).Sort("internalDate").All(&msgs)
+		if err != nil {
+			HandleError(proc, "get thread messages "+threadID, err, true)
+			continue
+		}
+
+		if len(msgs) == 0 {
+			continue
+		}
+
+		first := msgs[0]
+		last := msgs[len(msgs)-1]
+
+		t := Thread{
+			Owner:        owner,
+			ThreadID:     threadID,
+			Snippet:      last.Snippet,
+			MsgCount:     len(msgs),
+			FirstMsgDate: first.Date,
+			LastMsgDate:  last.Date,
+			InternalDate: last.InternalDate,
+			Subject:      last.Subject,
+			From:         last.From,
+			To:           last.To,
+			CC:           last.CC,
+			BCC:          last.BCC,
+			Date:         last.Date,
+			Time:         last.Time,
+			Year:         last.Year,
+			Month:        last.Month,
+			Day:          last.Day,
+			Hours:        last.Hours,
+			Minutes:      last.Minutes,
+			Seconds:      last.Seconds,
+		}
+
+		labels := make(map[string]bool)
+
+		for _, m := range msgs {
+
+			t.AttchCount = t.AttchCount + len(m.Attachments)
+
+			for _, l := range m.Labels {
+				labels[l] = true
+			}
+
+		}
+
+		for l := range labels {
+			t.Labels = append(t.Labels, l)
+		}
+
+		sort.Strings(t.Labels)
+
+		threads = append(threads, t)
+
+	}
+
+	return threads
+}
+
+// SaveImported save batch of imported messages like synced ones
+func SaveImported(user User, messages []Message, rawMessages []RawMessage, attachmentsList []MessageAttachment) {
+
+	SaveMessages(messages)
+
+	SaveRawMessages(rawMessages)
+
+	// inline attachments have data, service is not used
+	attachments := ProccessAttachments(nil, user, attachmentsList)
+
+	SaveAttachments(attachments)
+
+	ExtractAttachments(attachments)
+
+	threadIDs := make(map[string]bool)
+	for _, m := range messages {
+		threadIDs[m.ThreadID] = true
+	}
+
+	var tIDs []string
+	for tID := range threadIDs {
+		tIDs = append(tIDs, tID)
+	}
+
+	SaveThreads(ImportThreads(user.Email, tIDs))
+
+}
+
+// importUpload name pattern of uploaded files, they are not importable by path
+const importUpload = "gapp-import-*.mbox"
+
+// ImportDir return import directory of owner, IMPORT_PATH/owner or system temp/owner
+// users can import only files from own directory
+func ImportDir(owner string) (string, error) {
+
+	base := os.Getenv("IMPORT_PATH")
+	if base == "" {
+		base = os.TempDir()
+	}
+
+	dir := filepath.Join(base, filepath.Base(filepath.Clean("/"+owner)))
+
+	return dir, os.MkdirAll(dir, 0700)
+}
+
+// ImportFile return path of file in owner import directory
+// uploads of other imports are rejected
+func ImportFile(owner, name string) (string, error) {
+
+	dir, err := ImportDir(owner)
+	if err != nil {
+		return "", err
+	}
+
+	name = filepath.Clean("/" + name)
+
+	if ok, _ := filepath.Match(importUpload, filepath.Base(name)); ok || name == "/" {
+		return "", errors.New("file can't be imported")
+	}
+
+	return filepath.Join(dir, name), nil
+}
+
+// ImportMbox import Google Takeout mbox file, already synced messages are skipped
+// file is removed at end when remove is set
+func ImportMbox(syncer Syncer, filename string, remove bool) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "ImportMbox",
+	}
+
+	defer SaveLog(proc)
+
+	if remove {
+		defer os.Remove(filename)
+	}
+
+	user := GetUserByEmail(syncer.Owner)
+
+	syncer.Status = "start"
+	CRUDSyncer(syncer)
+
+	f, err := os.Open(filename)
+	if err != nil {
+		HandleError(proc, "open mbox", err, true)
+		syncer.Status = "error:" + err.Error()
+		CRUDSyncer(syncer)
+		return
+	}
+	defer f.Close()
+
+	labelIDs := make(map[string]string)
+	for name, id := range importLabels {
+		labelIDs[name] = id
+	}
+	for _, l := range GetLabels(user) {
+		labelIDs[l.Name] = l.LabelID
+	}
+
+	var messages []Message
+	var rawMessages []RawMessage
+	var attachments []MessageAttachment
+
+	skipped := 0
+	seen := make(map[string]bool)
+
+	mbox := NewMboxReader(f)
+
+	for {
+
+		from, raw, err := mbox.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			HandleError(proc, "read mbox", err, true)
+			syncer.Status = "error:" + err.Error()
+			break
+		}
+
+		ImportLabelIDs(user, raw, labelIDs)
+
+		msg := ParseMboxMessage(from, raw, labelIDs)
+
+		if seen[msg.Id] || ImportedMessage(user.Email, msg) {
+			skipped++
+			continue
+		}
+
+		seen[msg.Id] = true
+
+		message := ProccessMessage(msg, user)
+		message.Snippet = ImportSnippet(message)
+		msg.Snippet = message.Snippet
+
+		messages = append(messages, message)
+		rawMessages = append(rawMessages, ImportRawMessage(msg, message, user, raw))
+		attachments = append(attachments, message.Attachments...)
+
+		if len(messages) == importBatch {
+
+			SaveImported(user, messages, rawMessages, attachments)
+
+			syncer.Count = syncer.Count + len(messages)
+			syncer.Status = "imported " + strconv.Itoa(syncer.Count) + ", skipped " + strconv.Itoa(skipped)
+			CRUDSyncer(syncer)
+
+			messages = nil
+			rawMessages = nil
+			attachments = nil
+
+		}
+
+	}
+
+	SaveImported(user, messages, rawMessages, attachments)
+
+	syncer.Count = syncer.Count + len(messages)
+
+	if !strings.HasPrefix(syncer.Status, "error") {
+		syncer.Status = "end"
+	}
+
+	syncer.End = time.Now()
+	CRUDSyncer(syncer)
+
+	// Alert saved searches
+	CheckSavedSearches(syncer.Owner)
+
+}
@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"net/http"
+	"os"
 
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
@@ -15,12 +16,37 @@ func init() {
 
 	systemSession = SystemMongoSession()
 
+	InitSearchBackend()
+
+	EnsureIMAPIndexes()
+
+	EnsureTimelineIndexes()
+
+	go FillMessageAddresses()
+
+	// commands don't run background jobs
+	if len(os.Args) > 1 && (os.Args[1] == "import-bundle" || os.Args[1] == "rebuild-index") {
+		return
+	}
+
 	go DailySync()
 
+	go DailyPurge()
+
 }
 
 func main() {
 
+	if len(os.Args) > 1 && os.Args[1] == "import-bundle" {
+		ImportBundleCommand(os.Args[2:])
+		return
+	}
+
+	if len(os.Args) > 1 && os.Args[1] == "rebuild-index" {
+		RebuildIndexCommand(os.Args[2:])
+		return
+	}
+
 	StartApp()
 
 }
@@ -38,12 +64,25 @@ func StartApp() {
 	muxRouter.Handle("/token/", TokenController).Methods("GET", "POST")
 
 	muxRouter.Handle("/syncers/", SyncController).Methods("GET", "POST")
+	muxRouter.Handle("/retention/", RetentionController).Methods("GET", "POST")
+	muxRouter.Handle("/exports/", ExportsController).Methods("GET", "POST")
+	muxRouter.Handle("/export/{exportID}", ExportController).Methods("GET")
 
 	muxRouter.Handle("/contacts/", ContactsController).Methods("GET", "POST")
+	muxRouter.Handle("/contacts/edit/{contactID}", ContactEditController).Methods("GET", "POST")
+	muxRouter.Handle("/contact/{contactID}", ContactController).Methods("GET")
+	muxRouter.Handle("/contact/{contactID}/photo", ContactPhotoController).Methods("GET")
+	muxRouter.Handle("/contacts/duplicates/", DuplicatesController).Methods("GET", "POST")
+	muxRouter.Handle("/correspondents/", CorrespondentsController).Methods("GET")
+	muxRouter.Handle("/organizations/", OrganizationsController).Methods("GET", "POST")
+	muxRouter.Handle("/organization/{organizationID}", OrganizationController).Methods("GET")
 	muxRouter.Handle("/emails", MailsController).Methods("GET", "POST")
 	muxRouter.Handle("/email/{treadID}", MailController).Methods("GET")
 	muxRouter.Handle("/attachment/{attachID}", AttachController).Methods("GET")
 
+	muxRouter.Handle("/api/facets", FacetsController).Methods("GET")
+	muxRouter.Handle("/api/contacts/{contactID}/timeline", ContactTimelineController).Methods("GET")
+
 	// add static file prefix
 	muxRouter.PathPrefix("/").Handler(http.StripPrefix("/static", http.FileServer(http.Dir("static/"))))
 
@@ -1,9 +1,11 @@
 package main
 
 import (
-	"encoding/base64"
 	"html/template"
+	"mime"
+	"net/mail"
 	"os"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -15,45 +17,72 @@ import (
 
 // Message simplify msg struct from gmail
 type Message struct {
-	ID           bson.ObjectId       `json:"id" bson:"_id,omitempty"`
-	Owner        string              `json:"owner" bson:"owner,omitempty"`
-	MsgID        string              `json:"msgID" bson:"msgID,omitempty"`
-	HistoryID    uint64              `json:"historyID" bson:"historyID,omitempty"`
-	ThreadID     string              `json:"threadID" bson:"threadID,omitempty"`
-	Headers      map[string]string   `json:"headers" bson:"headers,omitempty"`
-	Date         string              `json:"date" bson:"date,omitempty"`
-	Year         string              `json:"year" bson:"year,omitempty"`
-	Month        string              `json:"month" bson:"month,omitempty"`
-	Day          string              `json:"day" bson:"day,omitempty"`
-	Time         string              `json:"time" bson:"time,omitempty"`
-	Hours        string              `json:"hours" bson:"hours,omitempty"`
-	Minutes      string              `json:"minutes" bson:"minutes,omitempty"`
-	Seconds      string              `json:"seconds" bson:"seconds,omitempty"`
-	From         string              `json:"from" bson:"from,omitempty"`
-	FromEmails   string              `json:"fromEmails" bson:"fromEmails,omitempty"`
-	To           string              `json:"to" bson:"to,omitempty"`
-	ToEmails     string              `json:"toEmails" bson:"toEmails,omitempty"`
-	CC           string              `json:"cc" bson:"cc,omitempty"`
-	CCEmails     string              `json:"ccEmails" bson:"ccEmails,omitempty"`
-	BCC          string              `json:"bcc" bson:"bcc,omitempty"`
-	BCCEmails    string              `json:"bccEmails" bson:"bccEmails,omitempty"`
-	Subject      string              `json:"subject" bson:"subject,omitempty"`
-	Snippet      string              `json:"snippet" bson:"snippet,omitempty"`
-	Labels       []string            `json:"labels" bson:"labels,omitempty"`
-	Text         string              `json:"text" bson:"text,omitempty"`
-	HTML         template.HTML       `json:"html" bson:"html,omitempty"`
-	Attachments  []MessageAttachment `json:"attachments" bson:"attachments,omitempty"`
-	InternalDate time.Time           `json:"internalDate" bson:"internalDate,omitempty"`
+	ID             bson.ObjectId       `json:"id" bson:"_id,omitempty"`
+	Owner          string              `json:"owner" bson:"owner,omitempty"`
+	MsgID          string              `json:"msgID" bson:"msgID,omitempty"`
+	HistoryID      uint64              `json:"historyID" bson:"historyID,omitempty"`
+	ThreadID       string              `json:"threadID" bson:"threadID,omitempty"`
+	Headers        MessageHeaders      `json:"headers" bson:"headers,omitempty"`
+	Date           string              `json:"date" bson:"date,omitempty"`
+	Year           string              `json:"year" bson:"year,omitempty"`
+	Month          string              `json:"month" bson:"month,omitempty"`
+	Day            string              `json:"day" bson:"day,omitempty"`
+	Time           string              `json:"time" bson:"time,omitempty"`
+	Hours          string              `json:"hours" bson:"hours,omitempty"`
+	Minutes        string              `json:"minutes" bson:"minutes,omitempty"`
+	Seconds        string              `json:"seconds" bson:"seconds,omitempty"`
+	From           string              `json:"from" bson:"from,omitempty"`
+	FromEmails     string              `json:"fromEmails" bson:"fromEmails,omitempty"`
+	To             string              `json:"to" bson:"to,omitempty"`
+	ToEmails       string              `json:"toEmails" bson:"toEmails,omitempty"`
+	CC             string              `json:"cc" bson:"cc,omitempty"`
+	CCEmails       string              `json:"ccEmails" bson:"ccEmails,omitempty"`
+	BCC            string              `json:"bcc" bson:"bcc,omitempty"`
+	BCCEmails      string              `json:"bccEmails" bson:"bccEmails,omitempty"`
+	FromAddresses  []string            `json:"fromAddresses" bson:"fromAddresses,omitempty"`
+	ToAddresses    []string            `json:"toAddresses" bson:"toAddresses,omitempty"`
+	CCAddresses    []string            `json:"ccAddresses" bson:"ccAddresses,omitempty"`
+	Subject        string              `json:"subject" bson:"subject,omitempty"`
+	Snippet        string              `json:"snippet" bson:"snippet,omitempty"`
+	Labels         []string            `json:"labels" bson:"labels,omitempty"`
+	Text           string              `json:"text" bson:"text,omitempty"`
+	HTML           template.HTML       `json:"html" bson:"html,omitempty"`
+	HTMLText       string              `json:"htmlText" bson:"htmlText,omitempty"`
+	BodyParts      []MessageBodyPart   `json:"bodyParts" bson:"bodyParts,omitempty"`
+	MIME           *MessageMIMEPart    `json:"mime" bson:"mime,omitempty"`
+	Embedded       []Message           `json:"embedded" bson:"embedded,omitempty"`
+	Attachments    []MessageAttachment `json:"attachments" bson:"attachments,omitempty"`
+	AttachmentText string              `json:"attachmentText" bson:"attachmentText,omitempty"`
+	SizeEstimate   int64               `json:"sizeEstimate" bson:"sizeEstimate,omitempty"`
+	InternalDate   time.Time           `json:"internalDate" bson:"internalDate,omitempty"`
+	MessageID      string              `json:"messageID" bson:"messageID,omitempty"`
+	References     []string            `json:"references" bson:"references,omitempty"`
+	IMAP           []IMAPUID           `json:"imap" bson:"imap,omitempty"`
 }
 
 // MessageAttachment short attachment struct
+// Data, Size are set only for small attachments sent inline by gmail
 type MessageAttachment struct {
-	MsgID    string            `json:"msgID" bson:"msgID,omitempty"`
-	ThreadID string            `json:"threadID" bson:"threadID,omitempty"`
-	AttacID  string            `json:"attachID" bson:"attachID,omitempty"`
-	Filename string            `json:"filename" bson:"filename,omitempty"`
-	MimeType string            `json:"mimeType" bson:"mimeType,omitempty"`
-	Headers  map[string]string `json:"headers" bson:"headers,omitempty"`
+	MsgID     string         `json:"msgID" bson:"msgID,omitempty"`
+	ThreadID  string         `json:"threadID" bson:"threadID,omitempty"`
+	AttacID   string         `json:"attachID" bson:"attachID,omitempty"`
+	Filename  string         `json:"filename" bson:"filename,omitempty"`
+	MimeType  string         `json:"mimeType" bson:"mimeType,omitempty"`
+	ContentID string         `json:"contentID" bson:"contentID,omitempty"`
+	Headers   MessageHeaders `json:"headers" bson:"headers,omitempty"`
+	Data      string         `json:"-" bson:"-"`
+	Size      int64          `json:"-" bson:"-"`
+}
+
+// MessageMIMEPart mime tree node of message, without body data
+type MessageMIMEPart struct {
+	PartID      string            `json:"partID" bson:"partID,omitempty"`
+	MimeType    string            `json:"mimeType" bson:"mimeType,omitempty"`
+	Filename    string            `json:"filename" bson:"filename,omitempty"`
+	Disposition string            `json:"disposition" bson:"disposition,omitempty"`
+	ContentID   string            `json:"contentID" bson:"contentID,omitempty"`
+	Size        int64             `json:"size" bson:"size,omitempty"`
+	Parts       []MessageMIMEPart `json:"parts" bson:"parts,omitempty"`
 }
 
 // SaveMessages save messages
@@ -76,6 +105,7 @@ func SaveMessages(messages []Message) {
 			go CRUDThreadMessage(m, &wgMessages)
 		}
 		wgMessages.Wait()
+		IndexSearchMessages(messages)
 		return
 	}
 	return
@@ -139,6 +169,7 @@ type RawMessage struct {
 	Payload         *gmail.MessagePart `json:"payload" bson:"payload,omitempty"`
 	InternalDateRaw int64              `json:"internalDateRaw" bson:"internalDateRaw,omitempty"`
 	InternalDate    time.Time          `json:"internalDate" bson:"internalDate,omitempty"`
+	Source          []byte             `json:"-" bson:"source,omitempty"`
 }
 
 // SaveRawMessages save raw messages
@@ -291,82 +322,11 @@ func ProccessMessage(msg *gmail.Message, user User) Message {
 		Hours:        internalDate.Format("15"),
 		Minutes:      internalDate.Format("04"),
 		Seconds:      internalDate.Format("05"),
+		SizeEstimate: msg.SizeEstimate,
 		InternalDate: internalDate,
 	}
 
-	if len(msg.Payload.Headers) != 0 {
-
-		for _, h := range msg.Payload.Headers {
-
-			switch h.Name {
-			case "Subject":
-
-				mtread.Subject = h.Value
-
-				break
-
-			case "From":
-
-				mtread.From = h.Value
-
-				emails := emailaddress.Find([]byte(h.Value), false)
-				if len(emails) != 0 {
-					var emls []string
-					for _, e := range emails {
-						emls = append(emls, strings.ToLower(e.String()))
-					}
-					mtread.FromEmails = strings.Join(emls, ",")
-				}
-
-				break
-			case "To":
-
-				mtread.To = h.Value
-				emails := emailaddress.Find([]byte(h.Value), false)
-
-				if len(emails) != 0 {
-					var emls []string
-					for _, e := range emails {
-						emls = append(emls, strings.ToLower(e.String()))
-					}
-					mtread.ToEmails = strings.Join(emls, ",")
-				}
-
-				break
-
-			case "Cc":
-
-				mtread.CC = h.Value
-
-				emails := emailaddress.Find([]byte(h.Value), false)
-				if len(emails) != 0 {
-					var emls []string
-					for _, e := range emails {
-						emls = append(emls, strings.ToLower(e.String()))
-					}
-					mtread.CCEmails = strings.Join(emls, ",")
-				}
-
-			case "Bcc":
-
-				mtread.BCC = h.Value
-				emails := emailaddress.Find([]byte(h.Value), false)
-
-				if len(emails) != 0 {
-					var emls []string
-					for _, e := range emails {
-						emls = append(emls, strings.ToLower(e.String()))
-					}
-					mtread.BCCEmails = strings.Join(emls, ",")
-				}
-
-				break
-
-			}
-
-		}
-
-	}
+	mtread = ProcessHeaders(msg.Payload.Headers, mtread)
 
 	mtread = ProcessPayload(msg.Payload, mtread)
 
@@ -418,6 +378,88 @@ func ProccessMessages(t gmail.Thread, user User) (Message, []Message, []RawMessa
 
 }
 
+// ProcessHeaders set subject & addresses from headers
+func ProcessHeaders(headers []*gmail.MessagePartHeader, mtread Message) Message {
+
+	if len(headers) != 0 {
+
+		for _, h := range headers {
+
+			switch h.Name {
+			case "Subject":
+
+				mtread.Subject = DecodeHeader(h.Value)
+
+				break
+
+			case "From":
+
+				mtread.From = DecodeHeader(h.Value)
+				mtread.FromEmails = FindEmails(h.Value)
+				mtread.FromAddresses = EmailList(mtread.FromEmails)
+
+				break
+			case "To":
+
+				mtread.To = DecodeHeader(h.Value)
+				mtread.ToEmails = FindEmails(h.Value)
+				mtread.ToAddresses = EmailList(mtread.ToEmails)
+
+				break
+
+			case "Cc":
+
+				mtread.CC = DecodeHeader(h.Value)
+				mtread.CCEmails = FindEmails(h.Value)
+				mtread.CCAddresses = EmailList(mtread.CCEmails)
+
+				break
+
+			case "Bcc":
+
+				mtread.BCC = DecodeHeader(h.Value)
+				mtread.BCCEmails = FindEmails(h.Value)
+
+				break
+
+			}
+
+		}
+
+	}
+
+	return mtread
+}
+
+// FindEmails return lowercase comma separated emails from header value
+func FindEmails(value string) string {
+
+	emails := emailaddress.Find([]byte(value), false)
+	if len(emails) != 0 {
+		var emls []string
+		for _, e := range emails {
+			emls = append(emls, strings.ToLower(e.String()))
+		}
+		return strings.Join(emls, ",")
+	}
+
+	return ""
+}
+
+// EmailList return emails of comma separated list, used for indexed address queries
+func EmailList(emails string) []string {
+
+	var list []string
+
+	for _, e := range strings.Split(emails, ",") {
+		if e != "" {
+			list = append(list, e)
+		}
+	}
+
+	return list
+}
+
 // ProcessPayload proccess trough levels of message part
 func ProcessPayload(p *gmail.MessagePart, mtread Message) Message {
 
@@ -430,74 +472,286 @@ func ProcessPayload(p *gmail.MessagePart, mtread Message) Message {
 
 	defer SaveLog(proc)
 
-	//base64.StdEncoding.DecodeString(p.Body.Data)
-	//base64.RawURLEncoding.DecodeString(p.Body.Data)
-	switch p.MimeType {
-	case "text/plain":
+	structure := ProcessMIMEStructure(p)
+	mtread.MIME = &structure
 
-		decoded, err := base64.URLEncoding.DecodeString(p.Body.Data)
-		if err != nil {
-			mtread.Text = mtread.Text + err.Error()
-		} else {
-			mtread.Text = mtread.Text + string(decoded)
+	return ProcessPart(p, mtread)
+
+}
+
+// ProcessPart proccess single mime part depends on type
+func ProcessPart(p *gmail.MessagePart, mtread Message) Message {
+
+	mimeType := strings.ToLower(p.MimeType)
+
+	switch {
+	case mimeType == "multipart/alternative":
+
+		return ProcessAlternative(p, mtread)
+
+	case mimeType == "message/rfc822" && len(p.Parts) != 0:
+
+		return ProcessEmbedded(p, mtread)
+
+	case strings.HasPrefix(mimeType, "multipart/"):
+
+		for _, part := range p.Parts {
+			mtread = ProcessPart(part, mtread)
 		}
 
-		break
-	case "text/html":
+		return mtread
 
-		decoded, err := base64.URLEncoding.DecodeString(p.Body.Data)
-		if err != nil {
-			mtread.HTML = mtread.HTML + template.HTML(err.Error())
+	case (mimeType == "text/plain" || mimeType == "text/html") && !IsAttachmentPart(p):
+
+		text, part := DecodePartBody(p)
+		mtread.BodyParts = append(mtread.BodyParts, part)
+
+		if mimeType == "text/html" {
+			mtread.HTML = mtread.HTML + template.HTML(text)
+			mtread.HTMLText = strings.TrimSpace(mtread.HTMLText + " " + StripHTML(text))
 		} else {
-			mtread.HTML = mtread.HTML + template.HTML(string(decoded))
+			mtread.Text = mtread.Text + text
 		}
 
-		break
+		return mtread
 
-	default:
+	}
 
-		if p.Body.AttachmentId != "" {
+	return ProcessPartAttachment(p, mtread)
 
-			am := MessageAttachment{
-				ThreadID: mtread.ThreadID,
-				MsgID:    mtread.MsgID,
-				AttacID:  p.Body.AttachmentId,
-				Filename: p.Filename,
-				MimeType: p.MimeType,
-				Headers:  ParseMessageHeaders(p.Headers),
-			}
+}
+
+// ProcessAlternative use best alternative for body, plain text alternative for text
+func ProcessAlternative(p *gmail.MessagePart, mtread Message) Message {
+
+	// alternatives are ordered from least to most preferred
+	best := -1
+	plain := -1
+
+	for k, part := range p.Parts {
 
-			mtread.Attachments = append(mtread.Attachments, am)
+		mimeType := strings.ToLower(part.MimeType)
 
+		if mimeType == "text/plain" {
+			plain = k
+		}
+
+		if mimeType == "text/plain" || mimeType == "text/html" || strings.HasPrefix(mimeType, "multipart/") {
+			best = k
 		}
 
-		break
 	}
 
-	if len(p.Parts) != 0 {
+	if best == -1 {
+
+		for _, part := range p.Parts {
+			mtread = ProcessPart(part, mtread)
+		}
+
+		return mtread
+	}
+
+	mtread = ProcessPart(p.Parts[best], mtread)
+
+	if plain != -1 && plain != best {
+
+		text, part := DecodePartBody(p.Parts[plain])
+		mtread.BodyParts = append(mtread.BodyParts, part)
+
+		mtread.Text = mtread.Text + text
+
+	}
+
+	return mtread
 
-		for _, p := range p.Parts {
+}
 
-			mtread = ProcessPayload(p, mtread)
+// ProcessEmbedded proccess forwarded message as sub message
+func ProcessEmbedded(p *gmail.MessagePart, mtread Message) Message {
+
+	inner := p.Parts[0]
+
+	sub := Message{
+		Owner:    mtread.Owner,
+		MsgID:    mtread.MsgID,
+		ThreadID: mtread.ThreadID,
+		Headers:  ParseMessageHeaders(inner.Headers),
+	}
 
+	sub = ProcessHeaders(inner.Headers, sub)
+
+	if date := GetPartHeader(inner.Headers, "Date"); date != "" {
+
+		if d, err := mail.ParseDate(date); err == nil {
+			sub.InternalDate = d
+			sub.Date = d.Format("2006-01-02")
+			sub.Time = d.Format("15:04:05")
 		}
 
 	}
 
+	sub = ProcessPart(inner, sub)
+
+	// attachments of forwarded message are saved with parent message
+	mtread.Attachments = append(mtread.Attachments, sub.Attachments...)
+	mtread.Embedded = append(mtread.Embedded, sub)
+
 	return mtread
 
 }
 
-// ParseMessageHeaders return header map
-func ParseMessageHeaders(headers []*gmail.MessagePartHeader) map[string]string {
+// IsAttachmentPart check if part is attached file
+func IsAttachmentPart(p *gmail.MessagePart) bool {
+
+	if p.Filename != "" {
+		return true
+	}
+
+	disposition, _, _ := mime.ParseMediaType(GetPartHeader(p.Headers, "Content-Disposition"))
+
+	return disposition == "attachment"
+}
+
+// ProcessPartAttachment add part as attachment, data of small attachments is inline
+func ProcessPartAttachment(p *gmail.MessagePart, mtread Message) Message {
+
+	if p.Body == nil || (p.Body.AttachmentId == "" && p.Body.Data == "") {
+		return mtread
+	}
+
+	headers := ParseMessageHeaders(p.Headers)
+
+	am := MessageAttachment{
+		ThreadID:  mtread.ThreadID,
+		MsgID:     mtread.MsgID,
+		AttacID:   p.Body.AttachmentId,
+		Filename:  DecodeFilename(p.Filename, headers),
+		MimeType:  p.MimeType,
+		ContentID: strings.Trim(headers.Get("Content-ID"), "<>"),
+		Headers:   headers,
+	}
+
+	if p.Body.AttachmentId == "" {
+
+		// inline data has no attachment ID on gmail
+		am.AttacID = "inline-" + mtread.MsgID + "-" + p.PartId
+		am.Data = p.Body.Data
+		am.Size = p.Body.Size
+
+	}
+
+	mtread.Attachments = append(mtread.Attachments, am)
+
+	return mtread
+
+}
+
+// ProcessMIMEStructure return mime tree of message part without bodies
+func ProcessMIMEStructure(p *gmail.MessagePart) MessageMIMEPart {
+
+	disposition, _, _ := mime.ParseMediaType(GetPartHeader(p.Headers, "Content-Disposition"))
+
+	mp := MessageMIMEPart{
+		PartID:      p.PartId,
+		MimeType:    p.MimeType,
+		Filename:    DecodeFilename(p.Filename, ParseMessageHeaders(p.Headers)),
+		Disposition: disposition,
+		ContentID:   strings.Trim(GetPartHeader(p.Headers, "Content-ID"), "<>"),
+	}
+
+	if p.Body != nil {
+		mp.Size = p.Body.Size
+	}
+
+	if len(p.Parts) != 0 {
+
+		for _, part := range p.Parts {
+			mp.Parts = append(mp.Parts, ProcessMIMEStructure(part))
+		}
+
+	}
+
+	return mp
+
+}
+
+// MessageHeader single header of message
+type MessageHeader struct {
+	Name  string `json:"name" bson:"name"`
+	Value string `json:"value" bson:"value"`
+}
+
+// MessageHeaders ordered headers, same header can repeat
+type MessageHeaders []MessageHeader
+
+// Get return first value of header, name is case insensitive
+func (h MessageHeaders) Get(name string) string {
+
+	for _, hv := range h {
+		if strings.EqualFold(hv.Name, name) {
+			return hv.Value
+		}
+	}
+
+	return ""
+}
+
+// Values return all values of header in order, name is case insensitive
+func (h MessageHeaders) Values(name string) []string {
+
+	var values []string
+
+	for _, hv := range h {
+		if strings.EqualFold(hv.Name, name) {
+			values = append(values, hv.Value)
+		}
+	}
+
+	return values
+}
+
+// SetBSON read headers, also from old documents where headers were saved as map
+func (h *MessageHeaders) SetBSON(raw bson.Raw) error {
+
+	var list []MessageHeader
+	if err := raw.Unmarshal(&list); err == nil {
+		*h = list
+		return nil
+	}
+
+	var m map[string]string
+	if err := raw.Unmarshal(&m); err != nil {
+		return err
+	}
+
+	var names []string
+	for name := range m {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	list = nil
+	for _, name := range names {
+		list = append(list, MessageHeader{Name: name, Value: m[name]})
+	}
+
+	*h = list
+	return nil
+}
+
+// ParseMessageHeaders return ordered headers
+func ParseMessageHeaders(headers []*gmail.MessagePartHeader) MessageHeaders {
 
-	h := make(map[string]string)
+	var h MessageHeaders
 
 	if len(headers) != 0 {
 
 		for _, hv := range headers {
 
-			h[hv.Name] = hv.Value
+			h = append(h, MessageHeader{
+				Name:  hv.Name,
+				Value: hv.Value,
+			})
 
 		}
 
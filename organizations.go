@@ -0,0 +1,605 @@
+package main
+
+import (
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// Organization company of owner derived from email domains of messages & company of contacts
+// contacts with company & without company email are grouped by company name
+type Organization struct {
+	ID           bson.ObjectId            `json:"id" bson:"_id,omitempty"`
+	Owner        string                   `json:"owner" bson:"owner,omitempty"`
+	Key          string                   `json:"key" bson:"key,omitempty"`
+	Domain       string                   `json:"domain" bson:"domain,omitempty"`
+	Name         string                   `json:"name" bson:"name,omitempty"`
+	Names        []string                 `json:"names" bson:"names,omitempty"`
+	FreeMail     bool                     `json:"freeMail" bson:"freeMail"`
+	Excluded     bool                     `json:"excluded" bson:"excluded,omitempty"`
+	People       []OrganizationPerson     `json:"people" bson:"people,omitempty"`
+	PeopleCount  int                      `json:"peopleCount" bson:"peopleCount"`
+	Messages     int                      `json:"messages" bson:"messages"`
+	Threads      int                      `json:"threads" bson:"threads"`
+	Volume       []OrganizationVolume     `json:"volume" bson:"volume,omitempty"`
+	Attachments  []OrganizationAttachment `json:"attachments" bson:"attachments,omitempty"`
+	FirstContact time.Time                `json:"firstContact" bson:"firstContact,omitempty"`
+	LastContact  time.Time                `json:"lastContact" bson:"lastContact,omitempty"`
+	Derived      time.Time                `json:"derived" bson:"derived,omitempty"`
+}
+
+// OrganizationPerson person of organization, email is empty for contact without company email
+type OrganizationPerson struct {
+	Email     string        `json:"email" bson:"email,omitempty"`
+	Name      string        `json:"name" bson:"name,omitempty"`
+	Title     string        `json:"title" bson:"title,omitempty"`
+	ContactID bson.ObjectId `json:"contactID" bson:"contactID,omitempty"`
+	Received  int           `json:"received" bson:"received"`
+	Sent      int           `json:"sent" bson:"sent"`
+	LastSeen  time.Time     `json:"lastSeen" bson:"lastSeen,omitempty"`
+}
+
+// OrganizationVolume messages & threads of organization in month (YYYY-MM)
+type OrganizationVolume struct {
+	Month    string `json:"month" bson:"month"`
+	Messages int    `json:"messages" bson:"messages"`
+	Threads  int    `json:"threads" bson:"threads"`
+}
+
+// OrganizationAttachment attachment exchanged with organization, counted by filename
+// attachID & threadID are of latest message with attachment
+type OrganizationAttachment struct {
+	Filename string    `json:"filename" bson:"filename,omitempty"`
+	MimeType string    `json:"mimeType" bson:"mimeType,omitempty"`
+	Count    int       `json:"count" bson:"count"`
+	AttachID string    `json:"attachID" bson:"attachID,omitempty"`
+	ThreadID string    `json:"threadID" bson:"threadID,omitempty"`
+	Last     time.Time `json:"last" bson:"last,omitempty"`
+}
+
+// maxOrganizationPeople max people saved per organization, most active first
+const maxOrganizationPeople = 200
+
+// maxOrganizationAttachments top attachments saved per organization
+const maxOrganizationAttachments = 10
+
+// freeMailDomains public email providers, organizations of these domains are hidden by default
+// more domains can be set comma separated in FREEMAIL_DOMAINS
+var freeMailDomains = []string{
+	"gmail.com", "googlemail.com", "yahoo.com", "ymail.com", "hotmail.com", "outlook.com", "live.com", "msn.com",
+	"icloud.com", "me.com", "mac.com", "aol.com", "gmx.com", "gmx.net", "gmx.de", "web.de", "mail.com",
+	"protonmail.com", "proton.me", "zoho.com", "yandex.com", "yandex.ru", "mail.ru", "qq.com", "163.com",
+	"t-online.de", "libero.it", "orange.fr", "free.fr", "hotmail.co.uk", "yahoo.co.uk", "net.hr", "inet.hr",
+}
+
+// FreeMailDomain check if domain is public email provider
+func FreeMailDomain(domain string) bool {
+
+	domain = strings.ToLower(domain)
+
+	for _, d := range append(freeMailDomains, strings.Split(os.Getenv("FREEMAIL_DOMAINS"), ",")...) {
+		if d = strings.ToLower(strings.TrimSpace(d)); d != "" && d == domain {
+			return true
+		}
+	}
+
+	return false
+}
+
+// EmailDomain return lowercase domain of email
+func EmailDomain(email string) string {
+
+	if i := strings.LastIndex(email, "@"); i != -1 {
+		return strings.ToLower(strings.TrimSpace(email[i+1:]))
+	}
+
+	return ""
+}
+
+// organizationBuild organization with sets used while deriving
+type organizationBuild struct {
+	org         *Organization
+	people      map[string]*OrganizationPerson
+	threads     map[string]bool
+	months      map[string]*OrganizationVolume
+	monthThread map[string]bool
+	attachments map[string]*OrganizationAttachment
+	names       map[string]int
+}
+
+// DeriveOrganizations build organizations of owner from email domains of from, to & cc headers and company of contacts
+// organizations are rebuilt, excluded flag is kept
+func DeriveOrganizations(syncer Syncer) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "DeriveOrganizations",
+	}
+
+	defer SaveLog(proc)
+
+	syncer.Status = "start"
+	CRUDSyncer(syncer)
+
+	start := time.Now()
+	owner := strings.ToLower(syncer.Owner)
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	orgs := make(map[string]*organizationBuild)
+
+	get := func(key, domain string) *organizationBuild {
+
+		b, ok := orgs[key]
+		if !ok {
+			b = &organizationBuild{
+				org:         &Organization{Owner: syncer.Owner, Key: key, Domain: domain, FreeMail: domain != "" && FreeMailDomain(domain)},
+				people:      make(map[string]*OrganizationPerson),
+				threads:     make(map[string]bool),
+				months:      make(map[string]*OrganizationVolume),
+				monthThread: make(map[string]bool),
+				attachments: make(map[string]*OrganizationAttachment),
+				names:       make(map[string]int),
+			}
+			orgs[key] = b
+		}
+
+		return b
+	}
+
+	var msg Message
+	iter := db.C("messages").Find(bson.M{"owner": syncer.Owner}).Select(bson.M{
+		"threadID":     1,
+		"internalDate": 1,
+		"labels":       1,
+		"from":         1,
+		"fromEmails":   1,
+		"to":           1,
+		"toEmails":     1,
+		"cc":           1,
+		"ccEmails":     1,
+		"attachments":  1,
+	}).Iter()
+
+	for iter.Next(&msg) {
+
+		from := HeaderAddresses(msg.From, msg.FromEmails)
+
+		_, outgoing := from[owner]
+		for _, l := range msg.Labels {
+			if l == "SENT" {
+				outgoing = true
+			}
+		}
+
+		// domains & recipients of message, each is counted once
+		domains := map[string]bool{}
+		sentTo := map[string]bool{}
+
+		add := func(email, name string, received bool) {
+
+			domain := EmailDomain(email)
+			if email == owner || domain == "" {
+				return
+			}
+
+			b := get(domain, domain)
+
+			p, ok := b.people[email]
+			if !ok {
+				p = &OrganizationPerson{Email: email}
+				b.people[email] = p
+			}
+
+			if p.Name == "" {
+				p.Name = strings.TrimSpace(strings.Trim(name, `"' `))
+			}
+
+			if received {
+				p.Received++
+			} else if outgoing && !sentTo[email] {
+				p.Sent++
+				sentTo[email] = true
+			}
+
+			if msg.InternalDate.After(p.LastSeen) {
+				p.LastSeen = msg.InternalDate
+			}
+
+			domains[domain] = true
+
+		}
+
+		for email, name := range from {
+			add(email, name, !outgoing)
+		}
+
+		for _, header := range [][2]string{{msg.To, msg.ToEmails}, {msg.CC, msg.CCEmails}} {
+			for email, name := range HeaderAddresses(header[0], header[1]) {
+				add(email, name, false)
+			}
+		}
+
+		month := ""
+		if !msg.InternalDate.IsZero() {
+			month = msg.InternalDate.Format("2006-01")
+		}
+
+		for domain := range domains {
+
+			b := orgs[domain]
+			org := b.org
+
+			org.Messages++
+			b.threads[msg.ThreadID] = true
+
+			if !msg.InternalDate.IsZero() {
+
+				if org.FirstContact.IsZero() || msg.InternalDate.Before(org.FirstContact) {
+					org.FirstContact = msg.InternalDate
+				}
+
+				if msg.InternalDate.After(org.LastContact) {
+					org.LastContact = msg.InternalDate
+				}
+
+				v, ok := b.months[month]
+				if !ok {
+					v = &OrganizationVolume{Month: month}
+					b.months[month] = v
+				}
+
+				v.Messages++
+				if !b.monthThread[month+" "+msg.ThreadID] {
+					b.monthThread[month+" "+msg.ThreadID] = true
+					v.Threads++
+				}
+
+			}
+
+			for _, a := range msg.Attachments {
+
+				// inline images are not attachments
+				if a.Filename == "" || a.ContentID != "" {
+					continue
+				}
+
+				key := strings.ToLower(a.Filename)
+
+				oa, ok := b.attachments[key]
+				if !ok {
+					oa = &OrganizationAttachment{Filename: a.Filename, MimeType: a.MimeType}
+					b.attachments[key] = oa
+				}
+
+				oa.Count++
+				if !msg.InternalDate.Before(oa.Last) {
+					oa.Last = msg.InternalDate
+					oa.AttachID = a.AttacID
+					oa.ThreadID = msg.ThreadID
+				}
+
+			}
+
+		}
+
+		syncer.Count++
+		msg = Message{}
+
+		if syncer.Count%1000 == 0 {
+			syncer.Status = "messages " + strconv.Itoa(syncer.Count) + ", organizations " + strconv.Itoa(len(orgs))
+			CRUDSyncer(syncer)
+		}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "iterate messages", err, true)
+		syncer.Status = "error:" + err.Error()
+		CRUDSyncer(syncer)
+		return
+	}
+
+	OrganizationContacts(db, syncer.Owner, get)
+
+	DBC := db.C("organizations")
+
+	// excluded flag is set by user, it is kept
+	var excluded []Organization
+	err := DBC.Find(bson.M{"owner": syncer.Owner, "excluded": true}).Select(bson.M{"key": 1}).All(&excluded)
+	if err != nil {
+		HandleError(proc, "get excluded organizations", err, true)
+	}
+
+	keep := map[string]bool{}
+	for _, org := range excluded {
+		keep[org.Key] = true
+	}
+
+	for key, b := range orgs {
+
+		org := FinishOrganization(b)
+		org.Excluded = keep[key]
+		org.Derived = start
+
+		_, err := DBC.Upsert(bson.M{"owner": syncer.Owner, "key": key}, org)
+		if err != nil {
+			HandleError(proc, "save organization "+key, err, true)
+		}
+
+	}
+
+	_, err = DBC.RemoveAll(bson.M{"owner": syncer.Owner, "derived": bson.M{"$lt": start}})
+	if err != nil {
+		HandleError(proc, "remove organizations", err, true)
+	}
+
+	syncer.End = time.Now()
+	syncer.Status = "end"
+	CRUDSyncer(syncer)
+
+}
+
+// OrganizationContacts add contacts to organizations of their email domains
+// contact without email of company domain is added to organization by company name
+func OrganizationContacts(db *mgo.Database, owner string, get func(key, domain string) *organizationBuild) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "OrganizationContacts",
+	}
+
+	defer SaveLog(proc)
+
+	var c Contact
+	iter := db.C("contacts").Find(bson.M{
+		"owner":      owner,
+		"deleted":    bson.M{"$exists": false},
+		"mergedInto": bson.M{"$exists": false},
+	}).Select(bson.M{"firstName": 1, "lastName": 1, "company": 1, "title": 1, "email": 1, "emails": 1, "source": 1}).Sort("source").Iter()
+
+	for iter.Next(&c) {
+
+		company := strings.TrimSpace(c.Company)
+		added := false
+
+		for _, email := range TimelineEmails(c) {
+
+			domain := EmailDomain(email)
+			if domain == "" || (FreeMailDomain(domain) && company != "") {
+				continue
+			}
+
+			b := get(domain, domain)
+			ContactOrganizationPerson(b, c, email)
+			added = true
+
+		}
+
+		if !added && company != "" {
+			ContactOrganizationPerson(get("company:"+strings.ToLower(company), ""), c, "")
+		}
+
+		c = Contact{}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "iterate contacts", err, true)
+	}
+
+}
+
+// ContactOrganizationPerson set contact of person & count company name of contact
+func ContactOrganizationPerson(b *organizationBuild, c Contact, email string) {
+
+	key := email
+	if key == "" {
+		key = c.ID.Hex()
+	}
+
+	p, ok := b.people[key]
+	if !ok {
+		p = &OrganizationPerson{Email: email}
+		b.people[key] = p
+	}
+
+	// connections are sorted before other contacts
+	if p.ContactID == "" {
+		p.ContactID = c.ID
+		p.Title = c.Title
+		if name := c.FullName(); name != "" {
+			p.Name = name
+		}
+	}
+
+	if company := strings.TrimSpace(c.Company); company != "" {
+		b.names[company]++
+	}
+
+}
+
+// FinishOrganization set people, threads, volume, attachments & name of derived organization
+func FinishOrganization(b *organizationBuild) Organization {
+
+	org := *b.org
+	org.Threads = len(b.threads)
+
+	for _, p := range b.people {
+		org.People = append(org.People, *p)
+	}
+
+	sort.Slice(org.People, func(i, j int) bool {
+		pi, pj := org.People[i], org.People[j]
+		if pi.Received+pi.Sent != pj.Received+pj.Sent {
+			return pi.Received+pi.Sent > pj.Received+pj.Sent
+		}
+		return pi.LastSeen.After(pj.LastSeen)
+	})
+
+	org.PeopleCount = len(org.People)
+	if len(org.People) > maxOrganizationPeople {
+		org.People = org.People[:maxOrganizationPeople]
+	}
+
+	for _, v := range b.months {
+		org.Volume = append(org.Volume, *v)
+	}
+
+	sort.Slice(org.Volume, func(i, j int) bool { return org.Volume[i].Month < org.Volume[j].Month })
+
+	for _, a := range b.attachments {
+		org.Attachments = append(org.Attachments, *a)
+	}
+
+	sort.Slice(org.Attachments, func(i, j int) bool {
+		if org.Attachments[i].Count != org.Attachments[j].Count {
+			return org.Attachments[i].Count > org.Attachments[j].Count
+		}
+		return org.Attachments[i].Last.After(org.Attachments[j].Last)
+	})
+
+	if len(org.Attachments) > maxOrganizationAttachments {
+		org.Attachments = org.Attachments[:maxOrganizationAttachments]
+	}
+
+	// most used company name of contacts, domain without contacts
+	org.Name = org.Domain
+	count := 0
+	for name, n := range b.names {
+		org.Names = append(org.Names, name)
+		if n > count || (n == count && name < org.Name) {
+			org.Name, count = name, n
+		}
+	}
+
+	sort.Strings(org.Names)
+
+	return org
+}
+
+// SearchOrganizations return organizations of user matching query by name, domain or person, last contacted first
+// free mail & excluded organizations are returned only with all
+func SearchOrganizations(user User, query string, all bool) []Organization {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "SearchOrganizations",
+	}
+
+	defer SaveLog(proc)
+
+	var orgs []Organization
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	mquery := bson.M{"owner": user.Email}
+
+	if query = strings.TrimSpace(query); query != "" {
+
+		contains := bson.RegEx{Pattern: regexp.QuoteMeta(query), Options: "i"}
+
+		mquery["$or"] = []bson.M{
+			{"domain": contains},
+			{"names": contains},
+			{"people.email": contains},
+			{"people.name": contains},
+		}
+
+	}
+
+	if !all {
+		mquery["freeMail"] = false
+		mquery["excluded"] = bson.M{"$exists": false}
+	}
+
+	err := DB.DB(os.Getenv("MONGO_DB")).C("organizations").Find(mquery).Select(bson.M{"people": 0, "volume": 0, "attachments": 0}).Sort("-lastContact").Limit(500).All(&orgs)
+	if err != nil {
+		HandleError(proc, "get organizations", err, true)
+		return orgs
+	}
+
+	return orgs
+}
+
+// GetOrganization return organization of owner by id
+func GetOrganization(owner, id string) (Organization, error) {
+
+	var org Organization
+
+	if !bson.IsObjectIdHex(id) {
+		return org, mgo.ErrNotFound
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	err := DB.DB(os.Getenv("MONGO_DB")).C("organizations").Find(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner}).One(&org)
+
+	return org, err
+}
+
+// ExcludeOrganization hide or show organization on organizations page, flag is kept when organizations are derived again
+func ExcludeOrganization(owner, id string, excluded bool) error {
+
+	if !bson.IsObjectIdHex(id) {
+		return mgo.ErrNotFound
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	update := bson.M{"$set": bson.M{"excluded": true}}
+	if !excluded {
+		update = bson.M{"$unset": bson.M{"excluded": ""}}
+	}
+
+	return DB.DB(os.Getenv("MONGO_DB")).C("organizations").Update(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner}, update)
+}
+
+// RecentVolume return volume of last months, months without messages are included
+func (org Organization) RecentVolume(months int) []OrganizationVolume {
+
+	byMonth := map[string]OrganizationVolume{}
+	for _, v := range org.Volume {
+		byMonth[v.Month] = v
+	}
+
+	last := org.LastContact
+	if last.IsZero() {
+		return nil
+	}
+
+	var volume []OrganizationVolume
+
+	first := time.Date(last.Year(), last.Month(), 1, 0, 0, 0, 0, last.Location()).AddDate(0, -months+1, 0)
+	for m := first; !m.After(last); m = m.AddDate(0, 1, 0) {
+
+		month := m.Format("2006-01")
+
+		v, ok := byMonth[month]
+		if !ok {
+			v = OrganizationVolume{Month: month}
+		}
+
+		volume = append(volume, v)
+
+	}
+
+	return volume
+}
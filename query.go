@@ -0,0 +1,578 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// SearchNode node of parsed gmail style query
+// Op is one of and, or, not, term
+type SearchNode struct {
+	Op       string       `json:"op" bson:"op,omitempty"`
+	Field    string       `json:"field" bson:"field,omitempty"`
+	Value    string       `json:"value" bson:"value,omitempty"`
+	Children []SearchNode `json:"children" bson:"children,omitempty"`
+}
+
+// SearchToken single token of query
+type SearchToken struct {
+	Kind  string
+	Field string
+	Value string
+}
+
+// searchFields operators supported in query
+var searchFields = map[string]bool{
+	"from":       true,
+	"to":         true,
+	"cc":         true,
+	"bcc":        true,
+	"subject":    true,
+	"label":      true,
+	"in":         true,
+	"has":        true,
+	"filename":   true,
+	"mimetype":   true,
+	"larger":     true,
+	"smaller":    true,
+	"size":       true,
+	"after":      true,
+	"before":     true,
+	"older":      true,
+	"newer":      true,
+	"older_than": true,
+	"newer_than": true,
+	"is":         true,
+}
+
+// searchLabels system labels used by is: & in:
+var searchLabels = map[string]string{
+	"unread":    "UNREAD",
+	"starred":   "STARRED",
+	"important": "IMPORTANT",
+	"inbox":     "INBOX",
+	"sent":      "SENT",
+	"draft":     "DRAFT",
+	"drafts":    "DRAFT",
+	"spam":      "SPAM",
+	"trash":     "TRASH",
+	"chat":      "CHAT",
+}
+
+// relativeDate value of older_than, newer_than
+var relativeDate = regexp.MustCompile(`^(\d+)([dmy])$`)
+
+// sizeValue value of larger, smaller
+var sizeValue = regexp.MustCompile(`^(\d+)([kKmM]?)$`)
+
+// LexSearchQuery split query to tokens
+func LexSearchQuery(query string) ([]SearchToken, error) {
+
+	var tokens []SearchToken
+
+	readQuoted := func(i int) (string, int, error) {
+
+		end := strings.Index(query[i+1:], `"`)
+		if end == -1 {
+			return "", i, errors.New("missing closing quote")
+		}
+
+		return query[i+1 : i+1+end], i + end + 2, nil
+	}
+
+	i := 0
+	for i < len(query) {
+
+		c := query[i]
+
+		switch {
+		case c == ' ' || c == '\t' || c == '\n' || c == '\r':
+
+			i++
+
+		case c == '(':
+
+			tokens = append(tokens, SearchToken{Kind: "("})
+			i++
+
+		case c == ')':
+
+			tokens = append(tokens, SearchToken{Kind: ")"})
+			i++
+
+		case c == '-' && i+1 < len(query) && query[i+1] != ' ':
+
+			tokens = append(tokens, SearchToken{Kind: "not"})
+			i++
+
+		case c == '"':
+
+			phrase, next, err := readQuoted(i)
+			if err != nil {
+				return nil, err
+			}
+
+			tokens = append(tokens, SearchToken{Kind: "term", Value: phrase})
+			i = next
+
+		default:
+
+			start := i
+			for i < len(query) && !strings.ContainsRune(" \t\r\n()\"", rune(query[i])) {
+				i++
+			}
+
+			word := query[start:i]
+
+			if word == "OR" || word == "|" {
+				tokens = append(tokens, SearchToken{Kind: "or"})
+				continue
+			}
+
+			if word == "AND" {
+				continue
+			}
+
+			idx := strings.Index(word, ":")
+			if idx <= 0 || !searchFields[strings.ToLower(word[:idx])] {
+				tokens = append(tokens, SearchToken{Kind: "term", Value: word})
+				continue
+			}
+
+			field := strings.ToLower(word[:idx])
+			value := word[idx+1:]
+
+			if value == "" && i < len(query) && query[i] == '"' {
+
+				phrase, next, err := readQuoted(i)
+				if err != nil {
+					return nil, err
+				}
+
+				tokens = append(tokens, SearchToken{Kind: "term", Field: field, Value: phrase})
+				i = next
+				continue
+			}
+
+			if value == "" && i < len(query) && query[i] == '(' {
+
+				tokens = append(tokens, SearchToken{Kind: "group", Field: field})
+				i++
+				continue
+			}
+
+			if value == "" {
+				return nil, errors.New("missing value for " + field + ":")
+			}
+
+			tokens = append(tokens, SearchToken{Kind: "term", Field: field, Value: value})
+
+		}
+
+	}
+
+	return tokens, nil
+}
+
+// ParseSearchQuery parse gmail style query to tree
+// as in gmail, OR binds tighter than space: a b OR c is a AND (b OR c)
+func ParseSearchQuery(query string) (SearchNode, error) {
+
+	tokens, err := LexSearchQuery(query)
+	if err != nil {
+		return SearchNode{}, err
+	}
+
+	if len(tokens) == 0 {
+		return SearchNode{}, errors.New("empty query")
+	}
+
+	pos := 0
+	node, err := parseSearchAnd(tokens, &pos, "")
+	if err != nil {
+		return node, err
+	}
+
+	if pos < len(tokens) {
+		return node, errors.New("unexpected )")
+	}
+
+	return node, nil
+}
+
+// parseSearchAnd parse terms joined with space
+func parseSearchAnd(tokens []SearchToken, pos *int, field string) (SearchNode, error) {
+
+	var children []SearchNode
+
+	for *pos < len(tokens) && tokens[*pos].Kind != ")" {
+
+		node, err := parseSearchOr(tokens, pos, field)
+		if err != nil {
+			return node, err
+		}
+
+		children = append(children, node)
+
+	}
+
+	if len(children) == 0 {
+		return SearchNode{}, errors.New("missing search term")
+	}
+
+	if len(children) == 1 {
+		return children[0], nil
+	}
+
+	return SearchNode{Op: "and", Children: children}, nil
+}
+
+// parseSearchOr parse terms joined with OR
+func parseSearchOr(tokens []SearchToken, pos *int, field string) (SearchNode, error) {
+
+	if tokens[*pos].Kind == "or" {
+		return SearchNode{}, errors.New("missing term before OR")
+	}
+
+	node, err := parseSearchUnary(tokens, pos, field)
+	if err != nil {
+		return node, err
+	}
+
+	children := []SearchNode{node}
+
+	for *pos < len(tokens) && tokens[*pos].Kind == "or" {
+
+		*pos++
+
+		if *pos >= len(tokens) || tokens[*pos].Kind == ")" || tokens[*pos].Kind == "or" {
+			return node, errors.New("missing term after OR")
+		}
+
+		next, err := parseSearchUnary(tokens, pos, field)
+		if err != nil {
+			return next, err
+		}
+
+		children = append(children, next)
+
+	}
+
+	if len(children) == 1 {
+		return node, nil
+	}
+
+	return SearchNode{Op: "or", Children: children}, nil
+}
+
+// parseSearchUnary parse negation, group or single term
+func parseSearchUnary(tokens []SearchToken, pos *int, field string) (SearchNode, error) {
+
+	t := tokens[*pos]
+	*pos++
+
+	switch t.Kind {
+	case "not":
+
+		// negated empty term would match everything
+		if *pos >= len(tokens) || tokens[*pos].Kind == ")" || tokens[*pos].Kind == "or" {
+			return SearchNode{}, errors.New("missing term after -")
+		}
+
+		node, err := parseSearchUnary(tokens, pos, field)
+		if err != nil {
+			return node, err
+		}
+
+		return SearchNode{Op: "not", Children: []SearchNode{node}}, nil
+
+	case "(", "group":
+
+		if t.Kind == "group" {
+			field = t.Field
+		}
+
+		node, err := parseSearchAnd(tokens, pos, field)
+		if err != nil {
+			return node, err
+		}
+
+		if *pos >= len(tokens) || tokens[*pos].Kind != ")" {
+			return node, errors.New("missing )")
+		}
+
+		*pos++
+
+		return node, nil
+
+	}
+
+	if t.Field == "" {
+		t.Field = field
+	}
+
+	return SearchNode{Op: "term", Field: t.Field, Value: t.Value}, nil
+}
+
+// SearchCompiler compile query tree to messages query of owner
+type SearchCompiler struct {
+	Owner  string
+	DB     *mgo.Database
+	labels map[string]string
+}
+
+// Compile return mongo query on messages collection
+func (c *SearchCompiler) Compile(node SearchNode) (bson.M, error) {
+
+	switch node.Op {
+	case "and", "or":
+
+		var children []bson.M
+
+		for _, child := range node.Children {
+
+			q, err := c.Compile(child)
+			if err != nil {
+				return nil, err
+			}
+
+			children = append(children, q)
+
+		}
+
+		return bson.M{"$" + node.Op: children}, nil
+
+	case "not":
+
+		q, err := c.Compile(node.Children[0])
+		if err != nil {
+			return nil, err
+		}
+
+		return bson.M{"$nor": []bson.M{q}}, nil
+
+	}
+
+	return c.CompileTerm(node.Field, node.Value)
+}
+
+// CompileTerm return messages query for single term
+func (c *SearchCompiler) CompileTerm(field, value string) (bson.M, error) {
+
+	contains := bson.RegEx{Pattern: regexp.QuoteMeta(value), Options: "i"}
+
+	switch field {
+	case "":
+
+		return bson.M{"$or": []bson.M{
+			bson.M{"subject": contains},
+			bson.M{"from": contains},
+			bson.M{"to": contains},
+			bson.M{"snippet": contains},
+			bson.M{"text": contains},
+			bson.M{"html": contains},
+			bson.M{"attachmentText": contains},
+		}}, nil
+
+	case "from", "to", "cc", "bcc":
+
+		if strings.ToLower(value) == "me" {
+			contains = bson.RegEx{Pattern: regexp.QuoteMeta(c.Owner), Options: "i"}
+		}
+
+		return bson.M{field: contains}, nil
+
+	case "subject":
+
+		return bson.M{field: contains}, nil
+
+	case "label", "in":
+
+		if strings.ToLower(value) == "anywhere" {
+			return bson.M{}, nil
+		}
+
+		return bson.M{"labels": c.LabelID(value)}, nil
+
+	case "is":
+
+		switch strings.ToLower(value) {
+		case "read":
+			return bson.M{"labels": bson.M{"$ne": "UNREAD"}}, nil
+		}
+
+		if labelID, ok := searchLabels[strings.ToLower(value)]; ok {
+			return bson.M{"labels": labelID}, nil
+		}
+
+	case "has":
+
+		switch strings.ToLower(value) {
+		case "attachment":
+			return bson.M{"attachments.0": bson.M{"$exists": true}}, nil
+		}
+
+	case "filename":
+
+		var msgIDs []string
+
+		err := c.DB.C("attachments").Find(bson.M{
+			"owner": c.Owner,
+			"$or": []bson.M{
+				bson.M{"filename": contains},
+				bson.M{"mimeType": contains},
+			},
+		}).Distinct("msgID", &msgIDs)
+		if err != nil {
+			return nil, err
+		}
+
+		return bson.M{"msgID": bson.M{"$in": msgIDs}}, nil
+
+	case "mimetype":
+
+		return bson.M{"attachments.mimeType": bson.RegEx{Pattern: "^" + regexp.QuoteMeta(value) + "$", Options: "i"}}, nil
+
+	case "larger", "size", "smaller":
+
+		size, err := ParseSearchSize(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if field == "smaller" {
+			return bson.M{"sizeEstimate": bson.M{"$lt": size}}, nil
+		}
+
+		return bson.M{"sizeEstimate": bson.M{"$gt": size}}, nil
+
+	case "after", "newer", "before", "older":
+
+		date, err := ParseSearchDate(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if field == "after" || field == "newer" {
+			return bson.M{"internalDate": bson.M{"$gte": date}}, nil
+		}
+
+		return bson.M{"internalDate": bson.M{"$lt": date}}, nil
+
+	case "older_than", "newer_than":
+
+		date, err := ParseRelativeDate(value)
+		if err != nil {
+			return nil, err
+		}
+
+		if field == "newer_than" {
+			return bson.M{"internalDate": bson.M{"$gte": date}}, nil
+		}
+
+		return bson.M{"internalDate": bson.M{"$lt": date}}, nil
+
+	}
+
+	return nil, errors.New("unsupported search " + field + ":" + value)
+}
+
+// LabelID return label ID by gmail search name, ex. my-label for "My Label"
+func (c *SearchCompiler) LabelID(name string) string {
+
+	if labelID, ok := searchLabels[strings.ToLower(name)]; ok {
+		return labelID
+	}
+
+	if c.labels == nil {
+
+		c.labels = make(map[string]string)
+
+		var labels []Label
+		err := c.DB.C("labels").Find(bson.M{"owner": c.Owner}).Select(bson.M{"labelID": 1, "name": 1}).All(&labels)
+		if err == nil {
+
+			for _, l := range labels {
+				c.labels[SearchLabelName(l.Name)] = l.LabelID
+			}
+
+		}
+
+	}
+
+	if labelID, ok := c.labels[SearchLabelName(name)]; ok {
+		return labelID
+	}
+
+	return name
+}
+
+// SearchLabelName normalize label name as gmail search does
+func SearchLabelName(name string) string {
+
+	return strings.ToLower(strings.NewReplacer(" ", "-", "/", "-", "&", "-").Replace(name))
+}
+
+// ParseSearchSize return bytes from 10M, 500K, 1000
+func ParseSearchSize(value string) (int64, error) {
+
+	m := sizeValue.FindStringSubmatch(value)
+	if m == nil {
+		return 0, errors.New("invalid size " + value)
+	}
+
+	size, _ := strconv.ParseInt(m[1], 10, 64)
+
+	switch strings.ToLower(m[2]) {
+	case "k":
+		size = size * 1024
+	case "m":
+		size = size * 1024 * 1024
+	}
+
+	return size, nil
+}
+
+// ParseSearchDate return date from 2006/01/02, 2006-01-02 or unix seconds
+func ParseSearchDate(value string) (time.Time, error) {
+
+	for _, layout := range []string{"2006/01/02", "2006-01-02", "2006/1/2", "2006-1-2"} {
+
+		if date, err := time.ParseInLocation(layout, value, time.Local); err == nil {
+			return date, nil
+		}
+
+	}
+
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+
+	return time.Time{}, errors.New("invalid date " + value)
+}
+
+// ParseRelativeDate return date before now from 3d, 2m, 1y
+func ParseRelativeDate(value string) (time.Time, error) {
+
+	m := relativeDate.FindStringSubmatch(strings.ToLower(value))
+	if m == nil {
+		return time.Time{}, errors.New("invalid period " + value)
+	}
+
+	n, _ := strconv.Atoi(m[1])
+
+	switch m[2] {
+	case "d":
+		return time.Now().AddDate(0, 0, -n), nil
+	case "m":
+		return time.Now().AddDate(0, -n, 0), nil
+	}
+
+	return time.Now().AddDate(-n, 0, 0), nil
+}
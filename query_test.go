@@ -0,0 +1,22 @@
+package main
+
+import "testing"
+
+func TestParseSearchQueryNot(t *testing.T) {
+
+	for _, query := range []string{"(a -)", "from:(a -)", "a -OR b", "a -| b"} {
+		if _, err := ParseSearchQuery(query); err == nil {
+			t.Errorf("%s: parsed without error", query)
+		}
+	}
+
+	node, err := ParseSearchQuery("a -(b OR c)")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if node.Op != "and" || node.Children[1].Op != "not" || node.Children[1].Children[0].Op != "or" {
+		t.Fatalf("node %+v", node)
+	}
+
+}
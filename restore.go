@@ -0,0 +1,406 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+	gmail "google.golang.org/api/gmail/v1"
+	"google.golang.org/api/googleapi"
+)
+
+// RestoreSelection messages of restore syncer, by threads, label, saved search or date range
+type RestoreSelection struct {
+	Target      string   `json:"target" bson:"target,omitempty"`
+	ThreadIDs   []string `json:"threadIDs" bson:"threadIDs,omitempty"`
+	Label       string   `json:"label" bson:"label,omitempty"`
+	SavedSearch string   `json:"savedSearch" bson:"savedSearch,omitempty"`
+	After       string   `json:"after" bson:"after,omitempty"`
+	Before      string   `json:"before" bson:"before,omitempty"`
+	Skipped     int      `json:"skipped" bson:"skipped,omitempty"`
+	Failed      int      `json:"failed" bson:"failed,omitempty"`
+}
+
+// Restored message imported to gmail, repeated restore skip it
+type Restored struct {
+	ID       bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner    string        `json:"owner" bson:"owner,omitempty"`
+	Target   string        `json:"target" bson:"target,omitempty"`
+	MsgID    string        `json:"msgID" bson:"msgID,omitempty"`
+	GmailID  string        `json:"gmailID" bson:"gmailID,omitempty"`
+	Restored time.Time     `json:"restored" bson:"restored,omitempty"`
+}
+
+// restoreSystemLabels system labels which can be set on imported message
+var restoreSystemLabels = map[string]bool{
+	"INBOX":     true,
+	"SENT":      true,
+	"IMPORTANT": true,
+	"STARRED":   true,
+	"UNREAD":    true,
+	"SPAM":      true,
+	"TRASH":     true,
+}
+
+// IsEmpty check if nothing is selected
+func (s RestoreSelection) IsEmpty() bool {
+
+	return len(s.ThreadIDs) == 0 && s.Label == "" && s.SavedSearch == "" && s.After == "" && s.Before == ""
+}
+
+// RestoreTargets return accounts user can restore to, own account & ones set for user
+// in RESTORE_TARGETS as comma separated owner=target pairs
+func RestoreTargets(user User) []string {
+
+	targets := []string{user.Email}
+
+	for _, pair := range strings.Split(os.Getenv("RESTORE_TARGETS"), ",") {
+
+		parts := strings.SplitN(pair, "=", 2)
+		if len(parts) != 2 || !strings.EqualFold(strings.TrimSpace(parts[0]), user.Email) {
+			continue
+		}
+
+		if target := strings.TrimSpace(parts[1]); target != "" && !strings.EqualFold(target, user.Email) {
+			targets = append(targets, target)
+		}
+
+	}
+
+	return targets
+}
+
+// RestoreTarget check if user can restore to account
+func RestoreTarget(user User, target string) bool {
+
+	for _, t := range RestoreTargets(user) {
+		if strings.EqualFold(t, target) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// RestoreQuery return messages query of selection
+func RestoreQuery(DB *mgo.Session, user User, sel RestoreSelection) (bson.M, error) {
+
+	label, s := ExportSearch(Export{
+		Owner:       user.Email,
+		Label:       sel.Label,
+		SavedSearch: sel.SavedSearch,
+		After:       sel.After,
+		Before:      sel.Before,
+	})
+
+	// text index exists only with mongo backend
+	_, text := searchBackend.(MongoSearchBackend)
+
+	mquery, _, _, err := SearchMessagesQuery(DB, user, label, s, text)
+	if err != nil {
+		return mquery, err
+	}
+
+	if len(sel.ThreadIDs) != 0 {
+		mquery["threadID"] = bson.M{"$in": sel.ThreadIDs}
+	}
+
+	return mquery, nil
+}
+
+// RestoreLabels map archive labels to labels of target account, missing labels are created
+type RestoreLabels struct {
+	svc    *gmail.Service
+	target string
+	names  map[string]string
+	byName map[string]string
+}
+
+// NewRestoreLabels return label mapper with labels of target account
+func NewRestoreLabels(svc *gmail.Service, owner, target string) (*RestoreLabels, error) {
+
+	_, names := GetLabelsList(User{Email: owner})
+
+	rl := &RestoreLabels{
+		svc:    svc,
+		target: target,
+		names:  names,
+		byName: make(map[string]string),
+	}
+
+	labels, err := svc.Users.Labels.List(target).Do()
+	if err != nil {
+		return rl, err
+	}
+
+	for _, l := range labels.Labels {
+		rl.byName[l.Name] = l.Id
+	}
+
+	return rl, nil
+}
+
+// LabelIDs return target label IDs of archived message labels
+func (rl *RestoreLabels) LabelIDs(labels []string) ([]string, error) {
+
+	var ids []string
+	added := make(map[string]bool)
+
+	for _, l := range labels {
+
+		id := ""
+
+		switch {
+		case restoreSystemLabels[l] || strings.HasPrefix(l, "CATEGORY_"):
+
+			id = l
+
+		case rl.names[l] != "" && rl.names[l] != l:
+
+			name := rl.names[l]
+
+			id = rl.byName[name]
+			if id == "" {
+
+				created, err := rl.svc.Users.Labels.Create(rl.target, &gmail.Label{
+					Name:                  name,
+					LabelListVisibility:   "labelShow",
+					MessageListVisibility: "show",
+				}).Do()
+				if err != nil {
+					return ids, err
+				}
+
+				id = created.Id
+				rl.byName[name] = id
+
+			}
+
+		}
+
+		if id != "" && !added[id] {
+			ids = append(ids, id)
+			added[id] = true
+		}
+
+	}
+
+	return ids, nil
+}
+
+// RestoreSource return message source with Date header, gmail set internal date from it
+func RestoreSource(source []byte, internalDate time.Time) []byte {
+
+	headers, _ := ParseMboxHeaders(source)
+	if GetPartHeader(headers, "Date") != "" || internalDate.IsZero() {
+		return source
+	}
+
+	return append([]byte("Date: "+internalDate.Format(time.RFC1123Z)+"\r\n"), source...)
+}
+
+// RestoredMessage return gmail ID of message restored before or still existing in target account
+func RestoredMessage(DB *mgo.Session, svc *gmail.Service, owner, target string, msg Message) string {
+
+	var restored Restored
+	err := DB.DB(os.Getenv("MONGO_DB")).C("restored").Find(bson.M{"owner": owner, "target": target, "msgID": msg.MsgID}).One(&restored)
+	if err == nil {
+		return restored.GmailID
+	}
+
+	messageID := strings.TrimSpace(msg.Headers.Get("Message-ID"))
+	if messageID == "" {
+		return ""
+	}
+
+	res, err := svc.Users.Messages.List(target).Q("rfc822msgid:" + strings.Trim(messageID, "<>")).IncludeSpamTrash(true).Do()
+	if err != nil || len(res.Messages) == 0 {
+		return ""
+	}
+
+	return res.Messages[0].Id
+}
+
+// SaveRestored save gmail ID of restored message
+func SaveRestored(DB *mgo.Session, restored Restored) error {
+
+	restored.Restored = time.Now()
+
+	_, err := DB.DB(os.Getenv("MONGO_DB")).C("restored").Upsert(bson.M{
+		"owner":  restored.Owner,
+		"target": restored.Target,
+		"msgID":  restored.MsgID,
+	}, restored)
+
+	return err
+}
+
+// ImportGmailMessage import message source to gmail, internal date is read from Date header
+func ImportGmailMessage(svc *gmail.Service, target string, source []byte, labelIDs []string) (*gmail.Message, error) {
+
+	imported, err := svc.Users.Messages.Import(target, &gmail.Message{LabelIds: labelIDs}).
+		InternalDateSource("dateHeader").
+		NeverMarkSpam(true).
+		ProcessForCalendar(false).
+		Media(bytes.NewReader(source), googleapi.ContentType("message/rfc822")).
+		Do()
+
+	if err != nil && strings.Contains(err.Error(), "rateLimitExceeded") {
+
+		time.Sleep(1 * time.Second)
+
+		imported, err = svc.Users.Messages.Import(target, &gmail.Message{LabelIds: labelIDs}).
+			InternalDateSource("dateHeader").
+			NeverMarkSpam(true).
+			ProcessForCalendar(false).
+			Media(bytes.NewReader(source), googleapi.ContentType("message/rfc822")).
+			Do()
+
+	}
+
+	return imported, err
+}
+
+// RestoreMessages import selected archived messages back to gmail account
+// messages restored before or still in gmail are skipped
+func RestoreMessages(syncer Syncer) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "RestoreMessages",
+	}
+
+	defer SaveLog(proc)
+
+	syncer.Status = "start"
+	CRUDSyncer(syncer)
+
+	sel := syncer.Restore
+
+	user := GetUserByEmail(syncer.Owner)
+	if !RestoreTarget(user, sel.Target) {
+		syncer.Status = "error:gmail account " + sel.Target + " can't be used"
+		CRUDSyncer(syncer)
+		return
+	}
+
+	target := GetUserByEmail(sel.Target)
+
+	if target.Token == nil {
+		syncer.Status = "error:gmail account " + sel.Target + " is not connected"
+		CRUDSyncer(syncer)
+		return
+	}
+
+	svc := GetGmailService(target)
+	if svc == nil {
+		syncer.Status = "error:unable to create gmail service"
+		CRUDSyncer(syncer)
+		return
+	}
+
+	labels, err := NewRestoreLabels(svc, syncer.Owner, target.Email)
+	if err != nil {
+		HandleError(proc, "get target labels", err, true)
+		syncer.Status = "error:" + err.Error()
+		CRUDSyncer(syncer)
+		return
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	mquery, err := RestoreQuery(DB, user, *sel)
+	if err != nil {
+		HandleError(proc, "restore query", err, true)
+		syncer.Status = "error:" + err.Error()
+		CRUDSyncer(syncer)
+		return
+	}
+
+	var msg Message
+	iter := db.C("messages").Find(mquery).Select(bson.M{
+		"owner":        1,
+		"msgID":        1,
+		"threadID":     1,
+		"labels":       1,
+		"headers":      1,
+		"internalDate": 1,
+	}).Sort("internalDate").Iter()
+
+	for iter.Next(&msg) {
+
+		if gmailID := RestoredMessage(DB, svc, syncer.Owner, target.Email, msg); gmailID != "" {
+
+			// message imported by earlier run is recorded again
+			SaveRestored(DB, Restored{Owner: syncer.Owner, Target: target.Email, MsgID: msg.MsgID, GmailID: gmailID})
+
+			sel.Skipped++
+			msg = Message{}
+			continue
+
+		}
+
+		err := RestoreMessage(DB, svc, labels, target.Email, msg)
+		if err != nil {
+			HandleError(proc, "restore message "+msg.MsgID, err, true)
+			sel.Failed++
+		} else {
+			syncer.Count++
+		}
+
+		msg = Message{}
+
+		if (syncer.Count+sel.Failed)%20 == 0 {
+			syncer.Status = "restored " + strconv.Itoa(syncer.Count) + ", skipped " + strconv.Itoa(sel.Skipped) + ", failed " + strconv.Itoa(sel.Failed)
+			CRUDSyncer(syncer)
+		}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "get messages", err, true)
+		syncer.Status = "error:" + err.Error()
+		CRUDSyncer(syncer)
+		return
+	}
+
+	syncer.End = time.Now()
+	syncer.Status = "end"
+	CRUDSyncer(syncer)
+
+}
+
+// RestoreMessage rebuild message source & import it with labels to gmail
+func RestoreMessage(DB *mgo.Session, svc *gmail.Service, labels *RestoreLabels, target string, msg Message) error {
+
+	var raw RawMessage
+	err := DB.DB(os.Getenv("MONGO_DB")).C("messagesRaw").Find(bson.M{"owner": msg.Owner, "msgID": msg.MsgID}).One(&raw)
+	if err != nil {
+		return err
+	}
+
+	source, err := BuildRFC822(DB, raw)
+	if err != nil {
+		return err
+	}
+
+	labelIDs, err := labels.LabelIDs(msg.Labels)
+	if err != nil {
+		return err
+	}
+
+	imported, err := ImportGmailMessage(svc, target, RestoreSource(source, msg.InternalDate), labelIDs)
+	if err != nil {
+		return err
+	}
+
+	return SaveRestored(DB, Restored{Owner: msg.Owner, Target: target, MsgID: msg.MsgID, GmailID: imported.Id})
+}
@@ -0,0 +1,541 @@
+package main
+
+import (
+	"os"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// RetentionPolicy rule for purging archived emails
+// Label, Domain are optional filters, Days is required age of thread
+type RetentionPolicy struct {
+	ID       bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner    string        `json:"owner" bson:"owner,omitempty"`
+	Name     string        `json:"name" bson:"name,omitempty"`
+	Label    string        `json:"label" bson:"label,omitempty"`
+	Domain   string        `json:"domain" bson:"domain,omitempty"`
+	Days     int           `json:"days" bson:"days,omitempty"`
+	Created  time.Time     `json:"created" bson:"created,omitempty"`
+	Modified time.Time     `json:"modified" bson:"modified,omitempty"`
+}
+
+// LegalHold label excluded from all retention policies
+type LegalHold struct {
+	ID      bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner   string        `json:"owner" bson:"owner,omitempty"`
+	LabelID string        `json:"labelID" bson:"labelID,omitempty"`
+	Reason  string        `json:"reason" bson:"reason,omitempty"`
+	Created time.Time     `json:"created" bson:"created,omitempty"`
+}
+
+// RetentionPurge audit record of single policy purge
+type RetentionPurge struct {
+	ID          bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner       string        `json:"owner" bson:"owner,omitempty"`
+	PolicyID    bson.ObjectId `json:"policyID" bson:"policyID,omitempty"`
+	PolicyName  string        `json:"policyName" bson:"policyName,omitempty"`
+	Label       string        `json:"label" bson:"label,omitempty"`
+	Domain      string        `json:"domain" bson:"domain,omitempty"`
+	Days        int           `json:"days" bson:"days,omitempty"`
+	Before      time.Time     `json:"before" bson:"before,omitempty"`
+	ThreadIDs   []string      `json:"threadIDs" bson:"threadIDs,omitempty"`
+	Threads     int           `json:"threads" bson:"threads,omitempty"`
+	Messages    int           `json:"messages" bson:"messages,omitempty"`
+	RawMessages int           `json:"rawMessages" bson:"rawMessages,omitempty"`
+	Attachments int           `json:"attachments" bson:"attachments,omitempty"`
+	Start       time.Time     `json:"start" bson:"start,omitempty"`
+	End         time.Time     `json:"end" bson:"end,omitempty"`
+	Duration    string        `json:"duration" bson:"duration,omitempty"`
+	Status      string        `json:"status" bson:"status,omitempty"`
+}
+
+// CRUDRetentionPolicy save retention policy
+func CRUDRetentionPolicy(policy RetentionPolicy) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "CRUDRetentionPolicy",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	mongoC := DB.DB(os.Getenv("MONGO_DB")).C("retentionPolicies")
+
+	policy.Domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(policy.Domain), "@"))
+	policy.Modified = time.Now()
+
+	if policy.ID.Hex() == "" {
+
+		policy.Created = time.Now()
+
+		err := mongoC.Insert(policy)
+		if err != nil {
+			HandleError(proc, "error while inserting row", err, true)
+			return
+		}
+
+		return
+
+	}
+
+	queryCheck := bson.M{"_id": policy.ID, "owner": policy.Owner}
+
+	change := bson.M{"$set": policy}
+	err := mongoC.Update(queryCheck, change)
+	if err != nil {
+		HandleError(proc, "error while updateing row", err, true)
+		return
+	}
+	return
+
+}
+
+// DeleteRetentionPolicy remove retention policy of user
+func DeleteRetentionPolicy(user User, ID string) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "DeleteRetentionPolicy",
+	}
+
+	defer SaveLog(proc)
+
+	if !bson.IsObjectIdHex(ID) {
+		return
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+	mongoC := DB.DB(os.Getenv("MONGO_DB")).C("retentionPolicies")
+
+	err := mongoC.Remove(bson.M{"_id": bson.ObjectIdHex(ID), "owner": user.Email})
+	if err != nil {
+		HandleError(proc, "remove retention policy "+ID, err, true)
+		return
+	}
+
+}
+
+// GetRetentionPolicies return all retention policies by user
+func GetRetentionPolicies(user User) []RetentionPolicy {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetRetentionPolicies",
+	}
+
+	defer SaveLog(proc)
+
+	var gdata []RetentionPolicy
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("retentionPolicies")
+
+	err := DBC.Find(bson.M{"owner": user.Email}).Sort("-created").All(&gdata)
+	if err != nil {
+		HandleError(proc, "get retention policies", err, true)
+		return gdata
+	}
+
+	return gdata
+
+}
+
+// GetAllRetentionPolicies return retention policies of all users
+func GetAllRetentionPolicies() []RetentionPolicy {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetAllRetentionPolicies",
+	}
+
+	defer SaveLog(proc)
+
+	var gdata []RetentionPolicy
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("retentionPolicies")
+
+	err := DBC.Find(bson.M{"days": bson.M{"$gt": 0}}).All(&gdata)
+	if err != nil {
+		HandleError(proc, "get retention policies", err, true)
+		return gdata
+	}
+
+	return gdata
+
+}
+
+// CRUDLegalHold put label under legal hold
+func CRUDLegalHold(hold LegalHold) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "CRUDLegalHold",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	mongoC := DB.DB(os.Getenv("MONGO_DB")).C("legalHolds")
+
+	queryCheck := bson.M{"owner": hold.Owner, "labelID": hold.LabelID}
+
+	actRes := LegalHold{}
+	err := mongoC.Find(queryCheck).One(&actRes)
+
+	if err != nil {
+
+		hold.Created = time.Now()
+
+		err = mongoC.Insert(hold)
+		if err != nil {
+			HandleError(proc, "error while inserting row", err, true)
+			return
+		}
+
+		return
+
+	}
+
+	change := bson.M{"$set": bson.M{"reason": hold.Reason}}
+	err = mongoC.Update(queryCheck, change)
+	if err != nil {
+		HandleError(proc, "error while updateing row", err, true)
+		return
+	}
+	return
+
+}
+
+// DeleteLegalHold release label from legal hold
+func DeleteLegalHold(user User, labelID string) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "DeleteLegalHold",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	mongoC := DB.DB(os.Getenv("MONGO_DB")).C("legalHolds")
+
+	err := mongoC.Remove(bson.M{"owner": user.Email, "labelID": labelID})
+	if err != nil {
+		HandleError(proc, "remove legal hold "+labelID, err, true)
+		return
+	}
+
+}
+
+// GetLegalHolds return all legal holds of owner
+func GetLegalHolds(owner string) []LegalHold {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetLegalHolds",
+	}
+
+	defer SaveLog(proc)
+
+	var gdata []LegalHold
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("legalHolds")
+
+	err := DBC.Find(bson.M{"owner": owner}).All(&gdata)
+	if err != nil {
+		HandleError(proc, "get legal holds", err, true)
+		return gdata
+	}
+
+	return gdata
+
+}
+
+// GetRetentionPurges return last purges audit records by user
+func GetRetentionPurges(user User) []RetentionPurge {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetRetentionPurges",
+	}
+
+	defer SaveLog(proc)
+
+	var gdata []RetentionPurge
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("retentionPurges")
+
+	err := DBC.Find(bson.M{"owner": user.Email}).Select(bson.M{"threadIDs": 0}).Sort("-start").Limit(50).All(&gdata)
+	if err != nil {
+		HandleError(proc, "get retention purges", err, true)
+		return gdata
+	}
+
+	return gdata
+
+}
+
+// DailyPurge run retention policies of all users
+func DailyPurge() {
+
+	for {
+
+		policies := GetAllRetentionPolicies()
+
+		if len(policies) != 0 {
+
+			for _, policy := range policies {
+
+				PurgeRetentionPolicy(policy)
+
+			}
+
+		}
+
+		time.Sleep(24 * time.Hour)
+
+	}
+
+}
+
+// PurgeRetentionPolicy delete threads matching policy & save audit record
+func PurgeRetentionPolicy(policy RetentionPolicy) RetentionPurge {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "PurgeRetentionPolicy",
+	}
+
+	defer SaveLog(proc)
+
+	purge := RetentionPurge{
+		Owner:      policy.Owner,
+		PolicyID:   policy.ID,
+		PolicyName: policy.Name,
+		Label:      policy.Label,
+		Domain:     policy.Domain,
+		Days:       policy.Days,
+		Before:     time.Now().AddDate(0, 0, -policy.Days),
+		Start:      time.Now(),
+		Status:     "start",
+	}
+
+	if policy.Days <= 0 {
+		return purge
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	threadIDs, err := GetRetentionThreadIDs(DB, policy, purge.Before)
+	if err != nil {
+		HandleError(proc, "get threads for policy "+policy.ID.Hex(), err, true)
+		purge.Status = "error:" + err.Error()
+	}
+
+	if err == nil && len(threadIDs) != 0 {
+
+		purge.ThreadIDs = threadIDs
+
+		err = PurgeThreads(DB, policy.Owner, threadIDs, &purge)
+		if err != nil {
+			HandleError(proc, "purge threads for policy "+policy.ID.Hex(), err, true)
+			purge.Status = "error:" + err.Error()
+		}
+
+	}
+
+	if err == nil {
+		purge.Status = "end"
+	}
+
+	purge.End = time.Now()
+	purge.Duration = purge.End.Sub(purge.Start).String()
+
+	err = DB.DB(os.Getenv("MONGO_DB")).C("retentionPurges").Insert(purge)
+	if err != nil {
+		HandleError(proc, "insert retention purge", err, true)
+	}
+
+	return purge
+
+}
+
+// GetRetentionThreadIDs return threadIDs matching policy, without threads under legal hold
+func GetRetentionThreadIDs(DB *mgo.Session, policy RetentionPolicy, before time.Time) ([]string, error) {
+
+	var threadIDs []string
+
+	DBT := DB.DB(os.Getenv("MONGO_DB")).C("threads")
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	query := bson.M{
+		"owner":        policy.Owner,
+		"internalDate": bson.M{"$lt": before},
+	}
+
+	if policy.Label != "" {
+		query["labels"] = policy.Label
+	}
+
+	if policy.Domain != "" {
+
+		var domainThreads []string
+
+		err := DBM.Find(bson.M{
+			"owner":      policy.Owner,
+			"fromEmails": bson.M{"$regex": "@" + strings.Replace(policy.Domain, ".", "\\.", -1) + "(,|$)"},
+		}).Distinct("threadID", &domainThreads)
+		if err != nil {
+			return threadIDs, err
+		}
+
+		if len(domainThreads) == 0 {
+			return threadIDs, nil
+		}
+
+		query["threadID"] = bson.M{"$in": domainThreads}
+
+	}
+
+	err := DBT.Find(query).Distinct("threadID", &threadIDs)
+	if err != nil {
+		return threadIDs, err
+	}
+
+	holds := GetLegalHolds(policy.Owner)
+
+	if len(holds) == 0 || len(threadIDs) == 0 {
+		return threadIDs, nil
+	}
+
+	var holdLabels []string
+	for _, h := range holds {
+		holdLabels = append(holdLabels, h.LabelID)
+	}
+
+	// any message of thread under legal hold keeps whole thread
+	var heldThreads []string
+	err = DBM.Find(bson.M{
+		"owner":    policy.Owner,
+		"threadID": bson.M{"$in": threadIDs},
+		"labels":   bson.M{"$in": holdLabels},
+	}).Distinct("threadID", &heldThreads)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, tID := range threadIDs {
+		if exist, _ := InArray(tID, heldThreads); !exist {
+			ids = append(ids, tID)
+		}
+	}
+
+	return ids, nil
+
+}
+
+// PurgeThreads delete threads with messages, raw messages & attachments
+func PurgeThreads(DB *mgo.Session, owner string, threadIDs []string, purge *RetentionPurge) error {
+
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	query := bson.M{"owner": owner, "threadID": bson.M{"$in": threadIDs}}
+
+	var attachments []Attachment
+	err := db.C("attachments").Find(query).Select(bson.M{"_id": 1, "gridID": 1}).All(&attachments)
+	if err != nil {
+		return err
+	}
+
+	for _, a := range attachments {
+
+		if a.GridID.Hex() != "" {
+
+			// blob could be shared by attachment of other thread
+			shared, err := db.C("attachments").Find(bson.M{
+				"gridID": a.GridID,
+				"_id":    bson.M{"$ne": a.ID},
+			}).Count()
+			if err != nil {
+				return err
+			}
+
+			if shared == 0 {
+				err = db.GridFS("attachments").RemoveId(a.GridID)
+				if err != nil && err != mgo.ErrNotFound {
+					return err
+				}
+			}
+
+		}
+
+		err = db.C("attachments").RemoveId(a.ID)
+		if err != nil {
+			return err
+		}
+
+		purge.Attachments++
+
+	}
+
+	info, err := db.C("messagesRaw").RemoveAll(query)
+	if err != nil {
+		return err
+	}
+	purge.RawMessages = info.Removed
+
+	info, err = db.C("messages").RemoveAll(query)
+	if err != nil {
+		return err
+	}
+	purge.Messages = info.Removed
+
+	info, err = db.C("threads").RemoveAll(query)
+	if err != nil {
+		return err
+	}
+	purge.Threads = info.Removed
+
+	err = searchBackend.DeleteThreads(owner, threadIDs)
+	if err != nil {
+		return err
+	}
+
+	return nil
+
+}
@@ -0,0 +1,299 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/globalsign/mgo/bson"
+)
+
+// SavedSearch named search with label filter, shown in sidebar
+type SavedSearch struct {
+	ID       bson.ObjectId `json:"id" bson:"_id,omitempty"`
+	Owner    string        `json:"owner" bson:"owner,omitempty"`
+	Name     string        `json:"name" bson:"name,omitempty"`
+	Label    string        `json:"label" bson:"label,omitempty"`
+	Search   ESearch       `json:"search" bson:"search,omitempty"`
+	Alert    bool          `json:"alert" bson:"alert"`
+	NewCount int           `json:"newCount" bson:"newCount"`
+	Checked  time.Time     `json:"checked" bson:"checked,omitempty"`
+	Created  time.Time     `json:"created" bson:"created,omitempty"`
+	Modified time.Time     `json:"modified" bson:"modified,omitempty"`
+	Count    int           `json:"count" bson:"-"`
+	URL      string        `json:"url" bson:"-"`
+}
+
+// CRUDSavedSearch create or update saved search by owner & name
+func CRUDSavedSearch(search SavedSearch) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "CRUDSavedSearch",
+	}
+
+	defer SaveLog(proc)
+
+	MS := MongoSession()
+	mongoC := MS.DB(os.Getenv("MONGO_DB")).C("savedSearches")
+	defer MS.Close()
+
+	queryCheck := bson.M{"owner": search.Owner, "name": search.Name}
+
+	actRes := SavedSearch{}
+	err := mongoC.Find(queryCheck).Select(bson.M{"_id": 1}).One(&actRes)
+
+	search.Modified = time.Now()
+	search.Checked = time.Now()
+
+	if err != nil {
+
+		search.Created = time.Now()
+
+		err = mongoC.Insert(search)
+		if err != nil {
+			HandleError(proc, "error while inserting row", err, true)
+			return
+		}
+		return
+
+	}
+
+	change := bson.M{"$set": bson.M{
+		"label":    search.Label,
+		"search":   search.Search,
+		"alert":    search.Alert,
+		"newCount": 0,
+		"checked":  search.Checked,
+		"modified": search.Modified,
+	}}
+	err = mongoC.Update(queryCheck, change)
+	if err != nil {
+		HandleError(proc, "error while updateing row", err, true)
+		return
+	}
+
+	return
+
+}
+
+// DeleteSavedSearch remove saved search of owner
+func DeleteSavedSearch(id, owner string) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "DeleteSavedSearch",
+	}
+
+	defer SaveLog(proc)
+
+	if !bson.IsObjectIdHex(id) {
+		return
+	}
+
+	MS := MongoSession()
+	mongoC := MS.DB(os.Getenv("MONGO_DB")).C("savedSearches")
+	defer MS.Close()
+
+	err := mongoC.Remove(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner})
+	if err != nil {
+		HandleError(proc, "delete saved search", err, true)
+	}
+
+}
+
+// GetSavedSearch return saved search of owner by ID
+func GetSavedSearch(id, owner string) (SavedSearch, bool) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetSavedSearch",
+	}
+
+	defer SaveLog(proc)
+
+	var search SavedSearch
+
+	if !bson.IsObjectIdHex(id) {
+		return search, false
+	}
+
+	DB := MongoSession()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("savedSearches")
+	defer DB.Close()
+
+	err := DBC.Find(bson.M{"_id": bson.ObjectIdHex(id), "owner": owner}).One(&search)
+	if err != nil {
+		HandleError(proc, "get saved search", err, false)
+		return search, false
+	}
+
+	return search, true
+}
+
+// GetSavedSearches return saved searches of user with live thread count
+func GetSavedSearches(user User) []SavedSearch {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetSavedSearches",
+	}
+
+	defer SaveLog(proc)
+
+	var searches []SavedSearch
+
+	DB := MongoSession()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("savedSearches")
+	defer DB.Close()
+
+	err := DBC.Find(bson.M{"owner": user.Email}).Sort("name").All(&searches)
+	if err != nil {
+		HandleError(proc, "get saved searches", err, true)
+		return searches
+	}
+
+	for k, s := range searches {
+
+		count, err := CountThreads(user, s.Label, s.Search, time.Time{})
+		if err != nil {
+			HandleError(proc, "count saved search "+s.Name, err, false)
+		}
+
+		searches[k].Count = count
+		searches[k].URL = SearchURL(s.Label, s.Search) + "&saved=" + s.ID.Hex()
+
+	}
+
+	return searches
+}
+
+// SeenSavedSearch reset new threads count of saved search
+func SeenSavedSearch(id bson.ObjectId) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "SeenSavedSearch",
+	}
+
+	defer SaveLog(proc)
+
+	MS := MongoSession()
+	mongoC := MS.DB(os.Getenv("MONGO_DB")).C("savedSearches")
+	defer MS.Close()
+
+	err := mongoC.UpdateId(id, bson.M{"$set": bson.M{"newCount": 0}})
+	if err != nil {
+		HandleError(proc, "update saved search", err, true)
+	}
+
+}
+
+// CountThreads return count of threads matching label & search
+// with since set only threads with first message saved after are counted
+func CountThreads(user User, label string, s ESearch, since time.Time) (int, error) {
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	if s.IsEmpty() && since.IsZero() {
+		return DB.DB(os.Getenv("MONGO_DB")).C("threads").Find(bson.M{"owner": user.Email, "labels": label}).Count()
+	}
+
+	// text index exists only with mongo backend
+	_, text := searchBackend.(MongoSearchBackend)
+
+	mquery, _, _, err := SearchMessagesQuery(DB, user, label, s, text)
+	if err != nil {
+		return 0, err
+	}
+
+	// messages of new thread are all saved after since, imported messages keep old dates
+	if !since.IsZero() {
+		and, _ := mquery["$and"].([]bson.M)
+		mquery["$and"] = append(and, bson.M{"_id": bson.M{"$gt": bson.NewObjectIdWithTime(since)}})
+	}
+
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	var tIDs []string
+
+	err = DBM.Find(mquery).Distinct("threadID", &tIDs)
+	if err != nil {
+		return 0, err
+	}
+
+	if since.IsZero() || len(tIDs) == 0 {
+		return len(tIDs), nil
+	}
+
+	// threads with earlier message are replies to old threads
+	var old []string
+
+	err = DBM.Find(bson.M{
+		"owner":    user.Email,
+		"threadID": bson.M{"$in": tIDs},
+		"_id":      bson.M{"$lte": bson.NewObjectIdWithTime(since)},
+	}).Distinct("threadID", &old)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(tIDs) - len(old), nil
+}
+
+// CheckSavedSearches count new threads of saved searches with alert after sync
+func CheckSavedSearches(owner string) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "CheckSavedSearches",
+	}
+
+	defer SaveLog(proc)
+
+	user := GetUserByEmail(owner)
+
+	DB := MongoSession()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("savedSearches")
+	defer DB.Close()
+
+	var searches []SavedSearch
+	err := DBC.Find(bson.M{"owner": owner, "alert": true}).All(&searches)
+	if err != nil {
+		HandleError(proc, "get saved searches", err, true)
+		return
+	}
+
+	for _, s := range searches {
+
+		checked := time.Now()
+
+		count, err := CountThreads(user, s.Label, s.Search, s.Checked)
+		if err != nil {
+			HandleError(proc, "count saved search "+s.Name, err, true)
+			continue
+		}
+
+		err = DBC.UpdateId(s.ID, bson.M{
+			"$set": bson.M{"checked": checked},
+			"$inc": bson.M{"newCount": count},
+		})
+		if err != nil {
+			HandleError(proc, "update saved search "+s.Name, err, true)
+		}
+
+	}
+
+}
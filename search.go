@@ -0,0 +1,651 @@
+package main
+
+import (
+	"html"
+	"html/template"
+	"log"
+	"os"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// htmlScripts script & style blocks removed before tags
+var htmlScripts = regexp.MustCompile(`(?is)<(script|style|head)[^>]*>.*?</(script|style|head)>`)
+
+// htmlTags any html tag or comment
+var htmlTags = regexp.MustCompile(`(?s)<!--.*?-->|<[^>]*>`)
+
+// htmlSpaces repeated whitespace
+var htmlSpaces = regexp.MustCompile(`[ \t\r\n]+`)
+
+// SearchBackend index & search of messages, selected by SEARCH_BACKEND
+type SearchBackend interface {
+	IndexMessages(messages []Message) error
+	DeleteThreads(owner string, threadIDs []string) error
+	SearchThreads(user User, label string, page int, s ESearch) (SearchResult, error)
+	Rebuild(owner string) (int, error)
+}
+
+// SearchResult page of threads found by search backend
+type SearchResult struct {
+	Total   int
+	Threads []Thread
+	Facets  map[string][]SearchFacet
+}
+
+// SearchFacet count of messages by field value
+type SearchFacet struct {
+	Term  string `json:"term" bson:"term,omitempty"`
+	Count int    `json:"count" bson:"count,omitempty"`
+}
+
+// searchBackend used by GetThreads & message saving
+var searchBackend SearchBackend = MongoSearchBackend{}
+
+// InitSearchBackend set search backend from SEARCH_BACKEND, mongo or bleve
+func InitSearchBackend() {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "InitSearchBackend",
+	}
+
+	defer SaveLog(proc)
+
+	switch os.Getenv("SEARCH_BACKEND") {
+	case "bleve":
+
+		path := os.Getenv("SEARCH_INDEX_PATH")
+		if path == "" {
+			path = "search"
+		}
+
+		searchBackend = NewBleveSearchBackend(path)
+
+	default:
+
+		searchBackend = MongoSearchBackend{}
+
+		EnsureSearchIndexes()
+
+	}
+
+}
+
+// IndexSearchMessages add saved messages to search backend
+func IndexSearchMessages(messages []Message) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "IndexSearchMessages",
+	}
+
+	defer SaveLog(proc)
+
+	if len(messages) != 0 {
+		if err := searchBackend.IndexMessages(messages); err != nil {
+			HandleError(proc, "index messages", err, true)
+		}
+	}
+
+}
+
+// MongoSearchBackend search messages collection with text index
+type MongoSearchBackend struct{}
+
+// IndexMessages nothing to do, messages collection is indexed by mongo
+func (b MongoSearchBackend) IndexMessages(messages []Message) error {
+
+	return nil
+}
+
+// DeleteThreads nothing to do, messages are removed from collection
+func (b MongoSearchBackend) DeleteThreads(owner string, threadIDs []string) error {
+
+	return nil
+}
+
+// SearchThreads return threads with messages matching query
+func (b MongoSearchBackend) SearchThreads(user User, label string, page int, s ESearch) (SearchResult, error) {
+
+	var result SearchResult
+
+	DB := MongoSession()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("threads")
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+	defer DB.Close()
+
+	mquery, textSearch, terms, err := SearchMessagesQuery(DB, user, label, s, true)
+	if err != nil {
+		return result, err
+	}
+
+	var tIDs []string
+
+	err = DBM.Find(mquery).Distinct("threadID", &tIDs)
+	if err != nil {
+		return result, err
+	}
+
+	if len(tIDs) == 0 {
+		return result, nil
+	}
+
+	result.Total = len(tIDs)
+
+	if textSearch != "" && s.Sort != "date" {
+
+		result.Threads, err = SearchThreadsByRelevance(DB, user.Email, mquery, page)
+		if err != nil {
+			return result, err
+		}
+
+	} else {
+
+		query := bson.M{
+			"threadID": bson.M{"$in": tIDs},
+			"owner":    user.Email,
+		}
+
+		err = DBC.Find(query).Skip(page * 50).Limit(50).Sort("-internalDate").All(&result.Threads)
+		if err != nil {
+			return result, err
+		}
+
+	}
+
+	AddThreadHighlights(DB, mquery, result.Threads, terms)
+
+	return result, nil
+}
+
+// SearchMessagesQuery return messages query of search, text search string & terms for highlighting
+// without text index free text terms are matched by regex
+func SearchMessagesQuery(DB *mgo.Session, user User, label string, s ESearch, text bool) (bson.M, string, []string, error) {
+
+	mquery := bson.M{"owner": user.Email}
+
+	var and []bson.M
+
+	if label != "" {
+		and = append(and, bson.M{"labels": label})
+	}
+
+	textSearch := ""
+	var terms []string
+
+	if !s.IsEmpty() {
+
+		node, err := ParseSearchQuery(s.QueryString())
+		if err != nil {
+			return mquery, "", nil, err
+		}
+
+		split, rest, words := SplitTextSearch(node)
+		terms = words
+
+		// free text use text index, rest of query is compiled
+		if text {
+			textSearch = split
+		} else {
+			rest = node
+		}
+
+		if rest.Op != "" {
+
+			compiler := SearchCompiler{
+				Owner: user.Email,
+				DB:    DB.DB(os.Getenv("MONGO_DB")),
+			}
+
+			cquery, err := compiler.Compile(rest)
+			if err != nil {
+				return mquery, "", nil, err
+			}
+
+			and = append(and, cquery)
+
+		}
+
+	}
+
+	if len(and) != 0 {
+		mquery["$and"] = and
+	}
+
+	// $text with all terms rank & stem, every term has to match
+	if textSearch != "" && len(terms) > 1 {
+
+		ids, err := TextSearchIDs(DB.DB(os.Getenv("MONGO_DB")).C("messages"), mquery, terms)
+		if err != nil {
+			return mquery, "", nil, err
+		}
+
+		mquery["_id"] = bson.M{"$in": ids}
+
+	}
+
+	if textSearch != "" {
+		mquery["$text"] = bson.M{"$search": textSearch}
+	}
+
+	return mquery, textSearch, terms, nil
+}
+
+// Rebuild fill search text of messages saved before text index
+func (b MongoSearchBackend) Rebuild(owner string) (int, error) {
+
+	count := 0
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	var msg Message
+	iter := DBM.Find(bson.M{
+		"owner":    owner,
+		"html":     bson.M{"$exists": true},
+		"htmlText": bson.M{"$exists": false},
+	}).Select(bson.M{"html": 1}).Iter()
+
+	for iter.Next(&msg) {
+
+		err := DBM.UpdateId(msg.ID, bson.M{"$set": bson.M{"htmlText": StripHTML(string(msg.HTML))}})
+		if err != nil {
+			iter.Close()
+			return count, err
+		}
+
+		count++
+		msg = Message{}
+
+	}
+
+	return count, iter.Close()
+}
+
+// EnsureSearchIndexes create text index on messages
+// SEARCH_LANGUAGE set stemming language, default english
+func EnsureSearchIndexes() {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "EnsureSearchIndexes",
+	}
+
+	defer SaveLog(proc)
+
+	language := os.Getenv("SEARCH_LANGUAGE")
+	if language == "" {
+		language = "english"
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	// from & to are indexed, free text terms match senders & recipients like regex search
+	index := mgo.Index{
+		Name:             "messages_text_attachments",
+		Key:              []string{"owner", "$text:subject", "$text:from", "$text:to", "$text:text", "$text:htmlText", "$text:attachmentText"},
+		Weights:          map[string]int{"subject": 10, "from": 5, "to": 3, "text": 2, "htmlText": 1, "attachmentText": 1},
+		DefaultLanguage:  language,
+		LanguageOverride: "searchLanguage",
+		Background:       true,
+	}
+
+	err := DBM.EnsureIndex(index)
+	if err != nil {
+
+		// collection can have only one text index, replace index without attachments
+		DBM.DropIndexName("messages_text")
+
+		err = DBM.EnsureIndex(index)
+		if err != nil {
+			HandleError(proc, "ensure messages text index", err, true)
+		}
+
+	}
+
+}
+
+// StripHTML return text content of html
+func StripHTML(body string) string {
+
+	body = htmlScripts.ReplaceAllString(body, " ")
+	body = htmlTags.ReplaceAllString(body, " ")
+	body = html.UnescapeString(body)
+
+	return strings.TrimSpace(htmlSpaces.ReplaceAllString(body, " "))
+}
+
+// SplitTextSearch move top level free text terms to mongo $text search string
+// return search string, rest of query & terms for highlighting
+func SplitTextSearch(node SearchNode) (string, SearchNode, []string) {
+
+	children := []SearchNode{node}
+	if node.Op == "and" {
+		children = node.Children
+	}
+
+	var search []string
+	var terms []string
+	var rest []SearchNode
+
+	for _, child := range children {
+
+		switch {
+		case child.Op == "term" && child.Field == "":
+
+			terms = append(terms, child.Value)
+			search = append(search, TextSearchTerm(child.Value))
+
+		case child.Op == "not" && child.Children[0].Op == "term" && child.Children[0].Field == "" && !strings.Contains(child.Children[0].Value, " "):
+
+			search = append(search, "-"+child.Children[0].Value)
+
+		default:
+
+			rest = append(rest, child)
+
+		}
+
+	}
+
+	// $text need at least one positive term
+	if len(terms) == 0 {
+		return "", node, nil
+	}
+
+	switch len(rest) {
+	case 0:
+		return strings.Join(search, " "), SearchNode{}, terms
+	case 1:
+		return strings.Join(search, " "), rest[0], terms
+	}
+
+	return strings.Join(search, " "), SearchNode{Op: "and", Children: rest}, terms
+}
+
+// TextSearchTerm return term for $text search, words are stemmed, phrases are quoted
+func TextSearchTerm(value string) string {
+
+	value = strings.Replace(value, `"`, "", -1)
+
+	if strings.Contains(value, " ") {
+		return `"` + value + `"`
+	}
+
+	return value
+}
+
+// TextSearchIDs return IDs of messages matching query & every text term
+// terms of one $text search are OR, so each term is searched alone & results are intersected
+func TextSearchIDs(DBM *mgo.Collection, query bson.M, terms []string) ([]bson.ObjectId, error) {
+
+	var ids []bson.ObjectId
+	var matched map[bson.ObjectId]bool
+
+	for _, t := range terms {
+
+		q := bson.M{"$text": bson.M{"$search": TextSearchTerm(t)}}
+		for k, v := range query {
+			q[k] = v
+		}
+
+		var found []struct {
+			ID bson.ObjectId `bson:"_id"`
+		}
+
+		err := DBM.Find(q).Select(bson.M{"_id": 1}).All(&found)
+		if err != nil {
+			return nil, err
+		}
+
+		next := make(map[bson.ObjectId]bool)
+		for _, f := range found {
+			if matched == nil || matched[f.ID] {
+				next[f.ID] = true
+			}
+		}
+		matched = next
+
+	}
+
+	for id := range matched {
+		ids = append(ids, id)
+	}
+
+	// empty $in match nothing
+	if ids == nil {
+		ids = []bson.ObjectId{}
+	}
+
+	return ids, nil
+}
+
+// SearchThreadsByRelevance return page of threads ordered by best message score
+func SearchThreadsByRelevance(DB *mgo.Session, owner string, mquery bson.M, page int) ([]Thread, error) {
+
+	var threads []Thread
+
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("threads")
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	var scores []struct {
+		ThreadID string  `bson:"_id"`
+		Score    float64 `bson:"score"`
+	}
+
+	err := DBM.Pipe([]bson.M{
+		bson.M{"$match": mquery},
+		bson.M{"$project": bson.M{
+			"threadID":     1,
+			"internalDate": 1,
+			"score":        bson.M{"$meta": "textScore"},
+		}},
+		bson.M{"$group": bson.M{
+			"_id":   "$threadID",
+			"score": bson.M{"$max": "$score"},
+			"date":  bson.M{"$max": "$internalDate"},
+		}},
+		bson.M{"$sort": bson.D{{Name: "score", Value: -1}, {Name: "date", Value: -1}}},
+		bson.M{"$skip": page * 50},
+		bson.M{"$limit": 50},
+	}).AllowDiskUse().All(&scores)
+	if err != nil {
+		return threads, err
+	}
+
+	if len(scores) == 0 {
+		return threads, nil
+	}
+
+	var tIDs []string
+	for _, s := range scores {
+		tIDs = append(tIDs, s.ThreadID)
+	}
+
+	var found []Thread
+	err = DBC.Find(bson.M{"owner": owner, "threadID": bson.M{"$in": tIDs}}).All(&found)
+	if err != nil {
+		return threads, err
+	}
+
+	byID := make(map[string]Thread)
+	for _, t := range found {
+		byID[t.ThreadID] = t
+	}
+
+	for _, tID := range tIDs {
+		if t, ok := byID[tID]; ok {
+			threads = append(threads, t)
+		}
+	}
+
+	return threads, nil
+}
+
+// AddThreadHighlights add highlighted fragments of matching messages to threads
+func AddThreadHighlights(DB *mgo.Session, mquery bson.M, threads []Thread, terms []string) {
+
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	for k, t := range threads {
+
+		q := bson.M{"threadID": t.ThreadID}
+		for key, val := range mquery {
+			q[key] = val
+		}
+
+		var msgs []Message
+		err := DBM.Find(q).Select(bson.M{"subject": 1, "text": 1, "htmlText": 1, "attachmentText": 1}).Limit(3).All(&msgs)
+		if err != nil {
+			continue
+		}
+
+		for _, m := range msgs {
+
+			body := m.Text
+			if body == "" {
+				body = m.HTMLText
+			}
+
+			if m.AttachmentText != "" {
+				body = body + " - " + m.AttachmentText
+			}
+
+			threads[k].Highlights = append(threads[k].Highlights, HighlightFragments(m.Subject+" - "+body, terms, 3-len(threads[k].Highlights))...)
+
+			if len(threads[k].Highlights) >= 3 {
+				break
+			}
+
+		}
+
+	}
+
+}
+
+// HighlightFragments return escaped fragments around terms, terms wrapped with <mark>
+func HighlightFragments(text string, terms []string, max int) []template.HTML {
+
+	var fragments []template.HTML
+
+	if max <= 0 || len(terms) == 0 {
+		return fragments
+	}
+
+	var quoted []string
+	for _, t := range terms {
+		quoted = append(quoted, regexp.QuoteMeta(t))
+	}
+
+	re, err := regexp.Compile(`(?i)` + strings.Join(quoted, "|"))
+	if err != nil {
+		return fragments
+	}
+
+	text = htmlSpaces.ReplaceAllString(text, " ")
+	matches := re.FindAllStringIndex(text, -1)
+
+	end := -1
+	for _, m := range matches {
+
+		if m[0] < end {
+			continue
+		}
+
+		start := runeStart(text, m[0]-60)
+		end = runeStart(text, m[1]+60)
+
+		fragment := text[start:end]
+		marked := re.ReplaceAllStringFunc(html.EscapeString(fragment), func(s string) string {
+			return "<mark>" + s + "</mark>"
+		})
+
+		fragments = append(fragments, template.HTML("&hellip;"+marked+"&hellip;"))
+
+		if len(fragments) >= max {
+			break
+		}
+
+	}
+
+	return fragments
+}
+
+// runeStart return closest rune start index in text bounds
+func runeStart(text string, i int) int {
+
+	if i <= 0 {
+		return 0
+	}
+
+	if i >= len(text) {
+		return len(text)
+	}
+
+	for i > 0 && text[i]&0xC0 == 0x80 {
+		i--
+	}
+
+	return i
+}
+
+// ReindexMessages rebuild search backend data of owner messages
+func ReindexMessages(syncer Syncer) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "ReindexMessages",
+	}
+
+	defer SaveLog(proc)
+
+	syncer.Status = "start"
+	CRUDSyncer(syncer)
+
+	count, err := searchBackend.Rebuild(syncer.Owner)
+	if err != nil {
+		HandleError(proc, "rebuild search", err, true)
+	}
+
+	syncer.Count = count
+	syncer.End = time.Now()
+	syncer.Status = "end"
+	CRUDSyncer(syncer)
+
+}
+
+// RebuildIndexCommand rebuild search backend data of users given by email
+func RebuildIndexCommand(args []string) {
+
+	if len(args) == 0 {
+		log.Fatal("usage: rebuild-index email [email ...]")
+	}
+
+	for _, owner := range args {
+
+		count, err := searchBackend.Rebuild(owner)
+		if err != nil {
+			log.Fatal("rebuild index of ", owner, ": ", err)
+		}
+
+		log.Println(owner, count)
+
+	}
+
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"os"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestSplitTextSearch(t *testing.T) {
+
+	node, err := ParseSearchQuery(`running "exact phrase" -spam from:a@example.org`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	search, rest, terms := SplitTextSearch(node)
+
+	// words are not quoted, so $text stem them
+	if search != `running "exact phrase" -spam` {
+		t.Fatalf("search %q", search)
+	}
+
+	if !reflect.DeepEqual(terms, []string{"running", "exact phrase"}) {
+		t.Fatalf("terms %q", terms)
+	}
+
+	if rest.Op != "term" || rest.Field != "from" {
+		t.Fatalf("rest %+v", rest)
+	}
+
+}
+
+// testSearchOwner owner of messages searched by tests
+const testSearchOwner = "search@example.com"
+
+// testMongo use empty database of MONGO_TEST_CONN, test is skipped without it
+// returned func drop database
+func testMongo(t *testing.T) func() {
+
+	conn := os.Getenv("MONGO_TEST_CONN")
+	if conn == "" {
+		t.Skip("MONGO_TEST_CONN is not set")
+	}
+
+	os.Setenv("MONGO_CONN", conn)
+	os.Setenv("MONGO_DB", "gapp_test_"+strconv.FormatInt(time.Now().UnixNano(), 36))
+
+	systemSession = SystemMongoSession()
+
+	return func() {
+		DB := MongoSession()
+		DB.DB(os.Getenv("MONGO_DB")).DropDatabase()
+		DB.Close()
+	}
+}
+
+// testSearch return sorted subjects of threads found by query
+func testSearch(t *testing.T, query string) []string {
+
+	_, threads := GetThreads(User{Email: testSearchOwner}, "", 0, ESearch{Query: query, Sort: "date"})
+
+	var subjects []string
+	for _, th := range threads {
+		subjects = append(subjects, th.Subject)
+	}
+
+	sort.Strings(subjects)
+
+	return subjects
+}
+
+func TestTextSearch(t *testing.T) {
+
+	defer testMongo(t)()
+
+	EnsureSearchIndexes()
+
+	DB := MongoSession()
+	defer DB.Close()
+	db := DB.DB(os.Getenv("MONGO_DB"))
+
+	for _, m := range []Message{
+		{Subject: "a", Text: "we run every morning"},
+		{Subject: "b", Text: "long walk in park"},
+		{Subject: "c", Text: "run or walk home"},
+	} {
+
+		m.Owner = testSearchOwner
+		m.ThreadID = m.Subject
+
+		if err := db.C("messages").Insert(m); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := db.C("threads").Insert(Thread{Owner: m.Owner, ThreadID: m.ThreadID, Subject: m.Subject}); err != nil {
+			t.Fatal(err)
+		}
+
+	}
+
+	for _, c := range []struct {
+		query string
+		want  []string
+	}{
+		// stemmed word match other forms
+		{"running", []string{"a", "c"}},
+		// every term has to match
+		{"running walks", []string{"c"}},
+		{"walk -home", []string{"b"}},
+		{`"walk home"`, []string{"c"}},
+		{"running park", nil},
+	} {
+
+		if got := testSearch(t, c.query); !reflect.DeepEqual(got, c.want) {
+			t.Errorf("%s: got %v, want %v", c.query, got, c.want)
+		}
+
+	}
+
+}
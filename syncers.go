@@ -9,21 +9,24 @@ import (
 
 // Syncer struct for sync queries
 type Syncer struct {
-	ID            bson.ObjectId `json:"id" bson:"_id,omitempty"`
-	CreatedBy     string        `json:"createdBy" bson:"createdBy,omitempty"`
-	Owner         string        `json:"owner" bson:"owner,omitempty"`
-	Query         string        `json:"query" bson:"query,omitempty"`
-	Type          string        `json:"type" bson:"type,omitempty"`
-	DeleteEmail   string        `json:"deleteEmail" bson:"deleteEmail,omitempty"`
-	Start         time.Time     `json:"start" bson:"start,omitempty"`
-	End           time.Time     `json:"end" bson:"end,omitempty"`
-	Duration      string        `json:"duration" bson:"duration,omitempty"`
-	Count         int           `json:"count" bson:"count,omitempty"`
-	LastPageToken string        `json:"lastPageToken" bson:"lastPageToken,omitempty"`
-	NextPageToken string        `json:"nextPageToken" bson:"nextPageToken,omitempty"`
-	FirstMsgDate  string        `json:"firstMsgDate" bson:"firstMsgDate,omitempty"`
-	LastMsgDate   string        `json:"lastMsgDate" bson:"lastMsgDate,omitempty"`
-	Status        string        `json:"status" bson:"status,omitempty"`
+	ID            bson.ObjectId     `json:"id" bson:"_id,omitempty"`
+	CreatedBy     string            `json:"createdBy" bson:"createdBy,omitempty"`
+	Owner         string            `json:"owner" bson:"owner,omitempty"`
+	Query         string            `json:"query" bson:"query,omitempty"`
+	Type          string            `json:"type" bson:"type,omitempty"`
+	DeleteEmail   string            `json:"deleteEmail" bson:"deleteEmail,omitempty"`
+	Start         time.Time         `json:"start" bson:"start,omitempty"`
+	End           time.Time         `json:"end" bson:"end,omitempty"`
+	Duration      string            `json:"duration" bson:"duration,omitempty"`
+	Count         int               `json:"count" bson:"count,omitempty"`
+	LastPageToken string            `json:"lastPageToken" bson:"lastPageToken,omitempty"`
+	NextPageToken string            `json:"nextPageToken" bson:"nextPageToken,omitempty"`
+	FirstMsgDate  string            `json:"firstMsgDate" bson:"firstMsgDate,omitempty"`
+	LastMsgDate   string            `json:"lastMsgDate" bson:"lastMsgDate,omitempty"`
+	Status        string            `json:"status" bson:"status,omitempty"`
+	Source        string            `json:"source" bson:"source,omitempty"`
+	IMAP          *IMAPSource       `json:"imap" bson:"imap,omitempty"`
+	Restore       *RestoreSelection `json:"restore" bson:"restore,omitempty"`
 }
 
 // GetAllSyncers return all syncers by user
@@ -137,6 +140,33 @@ func GetLastSystemSync(id string) Syncer {
 
 }
 
+// GetSyncer get syncer by id
+func GetSyncer(id string) Syncer {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetSyncer",
+	}
+
+	defer SaveLog(proc)
+
+	var s Syncer
+	DB := MongoSession()
+	defer DB.Close()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("syncers")
+
+	err := DBC.FindId(bson.ObjectIdHex(id)).One(&s)
+	if err != nil {
+		HandleError(proc, "get sync", err, true)
+		return s
+	}
+
+	return s
+
+}
+
 // CRUDSyncer save syncer
 func CRUDSyncer(sync Syncer) {
 
@@ -172,6 +202,12 @@ func CRUDSyncer(sync Syncer) {
 	}
 
 	change := bson.M{"$set": sync}
+
+	// finished or failed sync has no page to resume
+	if sync.LastPageToken == "" {
+		change["$unset"] = bson.M{"lastPageToken": ""}
+	}
+
 	err = mongoC.Update(queryCheck, change)
 	if err != nil {
 		HandleError(proc, "error while updateing row", err, true)
@@ -208,6 +244,25 @@ func DailySync() {
 
 				initSyncID := sync.ID.Hex()
 
+				// imap folders are synced from last UID
+				if sync.Source == "imap" {
+
+					s := Syncer{
+						CreatedBy: "system",
+						Owner:     sync.Owner,
+						Query:     sync.Query,
+						Type:      initSyncID,
+						Source:    sync.Source,
+						Start:     time.Now(),
+					}
+
+					CRUDSyncer(s)
+
+					go SyncIMAP(s)
+
+					continue
+				}
+
 				lastSystemSync := GetLastSystemSync(initSyncID)
 
 				if lastSystemSync.Owner != "" {
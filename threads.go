@@ -1,6 +1,7 @@
 package main
 
 import (
+	"html/template"
 	"os"
 	"strings"
 	"sync"
@@ -12,31 +13,32 @@ import (
 
 // Thread struct for threads from email
 type Thread struct {
-	ID           bson.ObjectId `json:"id" bson:"_id,omitempty"`
-	Owner        string        `json:"owner" bson:"owner,omitempty"`
-	ThreadID     string        `json:"threadID" bson:"threadID,omitempty"`
-	HistoryID    uint64        `json:"historyID" bson:"historyID,omitempty"`
-	Date         string        `json:"date" bson:"date,omitempty"`
-	Year         string        `json:"year" bson:"year,omitempty"`
-	Month        string        `json:"month" bson:"month,omitempty"`
-	Day          string        `json:"day" bson:"day,omitempty"`
-	Time         string        `json:"time" bson:"time,omitempty"`
-	Hours        string        `json:"hours" bson:"hours,omitempty"`
-	Minutes      string        `json:"minutes" bson:"minutes,omitempty"`
-	Seconds      string        `json:"seconds" bson:"seconds,omitempty"`
-	From         string        `json:"from" bson:"from,omitempty"`
-	To           string        `json:"to" bson:"to,omitempty"`
-	CC           string        `json:"cc" bson:"cc,omitempty"`
-	BCC          string        `json:"bcc" bson:"bcc,omitempty"`
-	BCCEmails    string        `json:"bccEmails" bson:"bccEmails,omitempty"`
-	Subject      string        `json:"subject" bson:"subject,omitempty"`
-	Snippet      string        `json:"snippet" bson:"snippet,omitempty"`
-	MsgCount     int           `json:"msgCount" bson:"msgCount,omitempty"`
-	FirstMsgDate string        `json:"firstMsgDate" bson:"firstMsgDate,omitempty"`
-	LastMsgDate  string        `json:"lastMsgDate" bson:"lastMsgDate,omitempty"`
-	AttchCount   int           `json:"attchCount" bson:"attchCount,omitempty"`
-	Labels       []string      `json:"labels" bson:"labels,omitempty"`
-	InternalDate time.Time     `json:"internalDate" bson:"internalDate,omitempty"`
+	ID           bson.ObjectId   `json:"id" bson:"_id,omitempty"`
+	Owner        string          `json:"owner" bson:"owner,omitempty"`
+	ThreadID     string          `json:"threadID" bson:"threadID,omitempty"`
+	HistoryID    uint64          `json:"historyID" bson:"historyID,omitempty"`
+	Date         string          `json:"date" bson:"date,omitempty"`
+	Year         string          `json:"year" bson:"year,omitempty"`
+	Month        string          `json:"month" bson:"month,omitempty"`
+	Day          string          `json:"day" bson:"day,omitempty"`
+	Time         string          `json:"time" bson:"time,omitempty"`
+	Hours        string          `json:"hours" bson:"hours,omitempty"`
+	Minutes      string          `json:"minutes" bson:"minutes,omitempty"`
+	Seconds      string          `json:"seconds" bson:"seconds,omitempty"`
+	From         string          `json:"from" bson:"from,omitempty"`
+	To           string          `json:"to" bson:"to,omitempty"`
+	CC           string          `json:"cc" bson:"cc,omitempty"`
+	BCC          string          `json:"bcc" bson:"bcc,omitempty"`
+	BCCEmails    string          `json:"bccEmails" bson:"bccEmails,omitempty"`
+	Subject      string          `json:"subject" bson:"subject,omitempty"`
+	Snippet      string          `json:"snippet" bson:"snippet,omitempty"`
+	MsgCount     int             `json:"msgCount" bson:"msgCount,omitempty"`
+	FirstMsgDate string          `json:"firstMsgDate" bson:"firstMsgDate,omitempty"`
+	LastMsgDate  string          `json:"lastMsgDate" bson:"lastMsgDate,omitempty"`
+	AttchCount   int             `json:"attchCount" bson:"attchCount,omitempty"`
+	Labels       []string        `json:"labels" bson:"labels,omitempty"`
+	InternalDate time.Time       `json:"internalDate" bson:"internalDate,omitempty"`
+	Highlights   []template.HTML `json:"highlights" bson:"-"`
 }
 
 // SaveThreads save threads
@@ -111,145 +113,84 @@ func CRUDThread(thread Thread, wgi *sync.WaitGroup) {
 
 //ESearch query builder for treads
 type ESearch struct {
-	Query   string `json:"query" bson:"query,omitempty"`
-	From    string `json:"from" bson:"from,omitempty"`
-	To      string `json:"to" bson:"to,omitempty"`
-	Subject string `json:"subject" bson:"subject,omitempty"`
-	Text    string `json:"text" bson:"text,omitempty"`
+	Query   string      `json:"query" bson:"query,omitempty"`
+	From    string      `json:"from" bson:"from,omitempty"`
+	To      string      `json:"to" bson:"to,omitempty"`
+	Subject string      `json:"subject" bson:"subject,omitempty"`
+	Text    string      `json:"text" bson:"text,omitempty"`
+	Sort    string      `json:"sort" bson:"sort,omitempty"`
+	Facets  FacetFilter `json:"facets" bson:"facets,omitempty"`
 }
 
-// GetThreads return emails from db by user
-func GetThreads(user User, label string, page int, s ESearch) (int, []Thread) {
-
-	proc := ServiceLog{
-		Start:   time.Now(),
-		Type:    "function",
-		Service: "gapp",
-		Name:    "GetThreads",
-	}
-
-	defer SaveLog(proc)
-
-	var gcount int
-	var threads []Thread
+// IsEmpty check if any search field is set
+func (s ESearch) IsEmpty() bool {
 
-	DB := MongoSession()
-	DBC := DB.DB(os.Getenv("MONGO_DB")).C("threads")
-	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
-	defer DB.Close()
+	return s.QueryString() == ""
+}
 
-	// group tredids
-	query := bson.M{"owner": user.Email, "labels": label}
+// QueryString return gmail style query from all search fields & facet filters
+func (s ESearch) QueryString() string {
 
-	if s.Query != "" || (s.From != "" ||
-		s.To != "" ||
-		s.Subject != "" ||
-		s.Text != "") {
+	var q []string
 
-		// Check msgs first & return threadIDs
+	if strings.TrimSpace(s.Query) != "" {
+		q = append(q, strings.TrimSpace(s.Query))
+	}
 
-		query = bson.M{}
+	for _, f := range []struct{ field, value string }{
+		{"from:", s.From},
+		{"to:", s.To},
+		{"subject:", s.Subject},
+		{"", s.Text},
+	} {
 
-		if s.Query != "" {
+		value := strings.TrimSpace(strings.Replace(f.value, `"`, "", -1))
+		if value != "" {
+			q = append(q, f.field+`"`+value+`"`)
+		}
 
-			query = bson.M{"$or": []bson.M{
-				bson.M{"from": bson.M{"$regex": s.Query}},
-				bson.M{"to": bson.M{"$regex": s.Query}},
-				bson.M{"snippet": bson.M{"$regex": s.Query}},
-				bson.M{"subject": bson.M{"$regex": s.Query}},
-				bson.M{"text": bson.M{"$regex": s.Query}},
-				bson.M{"html": bson.M{"$regex": s.Query}},
-			},
-				"owner": user.Email,
-			}
+	}
 
-		} else {
+	if f := s.Facets.QueryString(); f != "" {
+		q = append(q, f)
+	}
 
-			subQuery := []bson.M{}
+	return strings.Join(q, " ")
+}
 
-			if s.From != "" {
-				subQuery = append(subQuery, bson.M{"from": bson.M{"$regex": s.From}})
-			}
-			if s.To != "" {
-				subQuery = append(subQuery, bson.M{"to": bson.M{"$regex": s.To}})
-			}
+// GetThreads return emails from db by user
+// search is done by configured search backend
+func GetThreads(user User, label string, page int, s ESearch) (int, []Thread) {
 
-			if s.Subject != "" {
-				subQuery = append(subQuery, bson.M{"subject": bson.M{"$regex": s.Subject}})
-			}
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetThreads",
+	}
 
-			if s.Text != "" {
-				subQuery = append(subQuery, bson.M{"snippet": bson.M{"$regex": s.Text}})
-				subQuery = append(subQuery, bson.M{"text": bson.M{"$regex": s.Text}})
-				subQuery = append(subQuery, bson.M{"html": bson.M{"$regex": s.Text}})
-			}
+	defer SaveLog(proc)
 
-			query = bson.M{"$or": subQuery, "owner": user.Email}
+	var threads []Thread
 
-		}
+	if !s.IsEmpty() {
 
-		mcount, err := DBM.Find(query).Count()
+		result, err := searchBackend.SearchThreads(user, label, page, s)
 		if err != nil {
-			HandleError(proc, "get snippets", err, true)
+			HandleError(proc, "search threads", err, false)
 			return 0, threads
 		}
 
-		if mcount != 0 {
-
-			var tIDs []string
-			var mthreads []Message
-
-			err = DBC.Find(query).Select(bson.M{"threadID": 1}).All(&mthreads)
-			if err != nil {
-				HandleError(proc, "get snippets", err, true)
-				return 0, threads
-			}
-
-			if len(mthreads) != 0 {
-
-				for _, m := range mthreads {
-
-					tIDs = append(tIDs, m.ThreadID)
-
-				}
-
-			}
-
-			if len(tIDs) != 0 {
-
-				query = bson.M{
-					"threadID": bson.M{"$in": tIDs},
-					"owner":    user.Email,
-				}
-
-				gcount, err := DBC.Find(query).Count()
-				if err != nil {
-					HandleError(proc, "get snippets", err, true)
-					return 0, threads
-				}
-
-				if gcount != 0 {
-
-					skip := page * 50
+		return result.Total, result.Threads
 
-					err = DBC.Find(query).Skip(skip).Limit(50).Sort("-internalDate").All(&threads)
-					if err != nil {
-						HandleError(proc, "get snippets", err, true)
-						return 0, threads
-					}
-
-					return gcount, threads
-
-				}
-
-				return gcount, threads
-			}
-
-		}
+	}
 
-		return 0, threads
+	DB := MongoSession()
+	DBC := DB.DB(os.Getenv("MONGO_DB")).C("threads")
+	defer DB.Close()
 
-	}
+	// group tredids
+	query := bson.M{"owner": user.Email, "labels": label}
 
 	gcount, err := DBC.Find(query).Count()
 	if err != nil {
@@ -379,6 +320,9 @@ func SyncGMail(syncer Syncer) {
 			// Save attachemts
 			SaveAttachments(attachments)
 
+			// Extract attachments text for search
+			ExtractAttachments(attachments)
+
 			// Delete threads
 			if syncer.DeleteEmail == "true" {
 				DeleteMessages(svc, user, messages)
@@ -436,6 +380,10 @@ func SyncGMail(syncer Syncer) {
 		syncer.End = time.Now()
 		syncer.Status = "end"
 		CRUDSyncer(syncer)
+
+		// Alert saved searches
+		CheckSavedSearches(syncer.Owner)
+
 		return
 	}
 	return
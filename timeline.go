@@ -0,0 +1,345 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/globalsign/mgo"
+	"github.com/globalsign/mgo/bson"
+)
+
+// ContactTimeline threads of owner where contact is in from, to or cc, most recent first
+type ContactTimeline struct {
+	Emails          []string         `json:"emails"`
+	Threads         []TimelineThread `json:"threads"`
+	Messages        int              `json:"messages"`
+	Received        int              `json:"received"`
+	Sent            int              `json:"sent"`
+	First           time.Time        `json:"first"`
+	Last            time.Time        `json:"last"`
+	OwnerResponse   ResponseStats    `json:"ownerResponse"`
+	ContactResponse ResponseStats    `json:"contactResponse"`
+}
+
+// TimelineThread thread with messages of contact
+type TimelineThread struct {
+	ThreadID string            `json:"threadID"`
+	Subject  string            `json:"subject"`
+	First    time.Time         `json:"first"`
+	Last     time.Time         `json:"last"`
+	Messages []TimelineMessage `json:"messages"`
+}
+
+// TimelineMessage message of contact
+// direction is received (from contact), sent (from owner to contact) or cc (contact copied by someone else)
+type TimelineMessage struct {
+	MsgID        string              `json:"msgID"`
+	Date         time.Time           `json:"date"`
+	Direction    string              `json:"direction"`
+	From         string              `json:"from"`
+	Subject      string              `json:"subject"`
+	Snippet      string              `json:"snippet"`
+	Attachments  []MessageAttachment `json:"attachments"`
+	ResponseTime int64               `json:"responseSeconds,omitempty"`
+}
+
+// ResponseStats response times in seconds, response is first message in other direction after message
+type ResponseStats struct {
+	Count   int   `json:"count"`
+	Average int64 `json:"averageSeconds"`
+	Median  int64 `json:"medianSeconds"`
+}
+
+// NewResponseStats return count, average & median of response times
+func NewResponseStats(times []int64) ResponseStats {
+
+	s := ResponseStats{Count: len(times)}
+	if s.Count == 0 {
+		return s
+	}
+
+	var sum int64
+	for _, t := range times {
+		sum += t
+	}
+	s.Average = sum / int64(s.Count)
+
+	sort.Slice(times, func(i, j int) bool { return times[i] < times[j] })
+	s.Median = times[s.Count/2]
+
+	return s
+}
+
+// AverageText return average response time rounded to minutes
+func (s ResponseStats) AverageText() string {
+	return DurationText(s.Average)
+}
+
+// MedianText return median response time rounded to minutes
+func (s ResponseStats) MedianText() string {
+	return DurationText(s.Median)
+}
+
+// ResponseText return response time rounded to minutes
+func (m TimelineMessage) ResponseText() string {
+	return DurationText(m.ResponseTime)
+}
+
+// DurationText return seconds as days, hours & minutes
+func DurationText(seconds int64) string {
+
+	d := (time.Duration(seconds) * time.Second).Round(time.Minute)
+	day := 24 * time.Hour
+
+	if d < day {
+		return d.String()
+	}
+
+	if d%day == 0 {
+		return fmt.Sprintf("%dd", d/day)
+	}
+
+	return fmt.Sprintf("%dd %s", d/day, d%day)
+}
+
+// timelineEmailFields message arrays with emails of from, to & cc headers
+var timelineEmailFields = []string{"fromAddresses", "toAddresses", "ccAddresses"}
+
+// EnsureTimelineIndexes create indexes on emails of messages used by contact timeline
+func EnsureTimelineIndexes() {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "EnsureTimelineIndexes",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	for _, field := range timelineEmailFields {
+
+		err := DBM.EnsureIndex(mgo.Index{Key: []string{"owner", field}, Background: true})
+		if err != nil {
+			HandleError(proc, "ensure messages index", err, true)
+		}
+
+	}
+
+}
+
+// FillMessageAddresses set address arrays of messages saved before them
+func FillMessageAddresses() {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "proccess",
+		Service: "gapp",
+		Name:    "FillMessageAddresses",
+	}
+
+	defer SaveLog(proc)
+
+	DB := MongoSession()
+	defer DB.Close()
+	DBM := DB.DB(os.Getenv("MONGO_DB")).C("messages")
+
+	var msg Message
+	iter := DBM.Find(bson.M{"fromAddresses": bson.M{"$exists": false}, "$or": []bson.M{
+		bson.M{"fromEmails": bson.M{"$exists": true}},
+		bson.M{"toEmails": bson.M{"$exists": true}},
+		bson.M{"ccEmails": bson.M{"$exists": true}},
+	}}).Select(bson.M{"fromEmails": 1, "toEmails": 1, "ccEmails": 1}).Iter()
+
+	for iter.Next(&msg) {
+
+		err := DBM.UpdateId(msg.ID, bson.M{"$set": bson.M{
+			"fromAddresses": EmailList(msg.FromEmails),
+			"toAddresses":   EmailList(msg.ToEmails),
+			"ccAddresses":   EmailList(msg.CCEmails),
+		}})
+		if err != nil {
+			HandleError(proc, "update message "+msg.ID.Hex(), err, true)
+		}
+
+		msg = Message{}
+
+	}
+
+	if err := iter.Close(); err != nil {
+		HandleError(proc, "iterate messages", err, true)
+	}
+
+}
+
+// TimelineEmails return lowercase emails of contact with merged ones
+func TimelineEmails(c Contact) []string {
+
+	var emails []string
+	seen := map[string]bool{}
+
+	for _, e := range append([]ContactValue{{Value: c.Email}}, c.Emails...) {
+
+		email := strings.ToLower(strings.TrimSpace(e.Value))
+		if email == "" || seen[email] {
+			continue
+		}
+
+		seen[email] = true
+		emails = append(emails, email)
+
+	}
+
+	return emails
+}
+
+// EmailsContain check if list contain one of emails
+func EmailsContain(list []string, emails map[string]bool) bool {
+
+	for _, e := range list {
+		if emails[e] {
+			return true
+		}
+	}
+
+	return false
+}
+
+// GetContactTimeline return threads of owner with messages where contact emails are in from, to or cc
+func GetContactTimeline(owner string, c Contact) (ContactTimeline, error) {
+
+	proc := ServiceLog{
+		Start:   time.Now(),
+		Type:    "function",
+		Service: "gapp",
+		Name:    "GetContactTimeline",
+	}
+
+	defer SaveLog(proc)
+
+	timeline := ContactTimeline{Emails: TimelineEmails(c)}
+	if len(timeline.Emails) == 0 {
+		return timeline, nil
+	}
+
+	contact := map[string]bool{}
+	for _, e := range timeline.Emails {
+		contact[e] = true
+	}
+
+	var or []bson.M
+	for _, field := range timelineEmailFields {
+		or = append(or, bson.M{field: bson.M{"$in": timeline.Emails}})
+	}
+
+	DB := MongoSession()
+	defer DB.Close()
+
+	ownerEmail := strings.ToLower(owner)
+
+	var msgs []Message
+	err := DB.DB(os.Getenv("MONGO_DB")).C("messages").Find(bson.M{"owner": owner, "$or": or}).Select(bson.M{
+		"msgID":         1,
+		"threadID":      1,
+		"internalDate":  1,
+		"labels":        1,
+		"from":          1,
+		"fromAddresses": 1,
+		"subject":       1,
+		"snippet":       1,
+		"attachments":   1,
+	}).Sort("internalDate").All(&msgs)
+	if err != nil {
+		return timeline, err
+	}
+
+	threads := map[string]*TimelineThread{}
+
+	// last message of thread waiting for response
+	waiting := map[string]TimelineMessage{}
+	var ownerTimes, contactTimes []int64
+
+	for _, msg := range msgs {
+
+		m := TimelineMessage{
+			MsgID:       msg.MsgID,
+			Date:        msg.InternalDate,
+			From:        msg.From,
+			Subject:     msg.Subject,
+			Snippet:     msg.Snippet,
+			Attachments: msg.Attachments,
+			Direction:   "cc",
+		}
+
+		sent := EmailsContain(msg.FromAddresses, map[string]bool{ownerEmail: true})
+		for _, l := range msg.Labels {
+			if l == "SENT" {
+				sent = true
+			}
+		}
+
+		switch {
+		case EmailsContain(msg.FromAddresses, contact):
+			m.Direction = "received"
+			timeline.Received++
+		case sent:
+			m.Direction = "sent"
+			timeline.Sent++
+		}
+
+		// response is first message in other direction, cc messages don't answer
+		if last, ok := waiting[msg.ThreadID]; ok && m.Direction != "cc" && last.Direction != m.Direction && !m.Date.Before(last.Date) {
+
+			m.ResponseTime = int64(m.Date.Sub(last.Date) / time.Second)
+
+			if m.Direction == "sent" {
+				ownerTimes = append(ownerTimes, m.ResponseTime)
+			} else {
+				contactTimes = append(contactTimes, m.ResponseTime)
+			}
+
+		}
+
+		if m.Direction != "cc" {
+			if last, ok := waiting[msg.ThreadID]; !ok || last.Direction != m.Direction {
+				waiting[msg.ThreadID] = m
+			}
+		}
+
+		t, ok := threads[msg.ThreadID]
+		if !ok {
+			t = &TimelineThread{ThreadID: msg.ThreadID, Subject: msg.Subject, First: msg.InternalDate}
+			threads[msg.ThreadID] = t
+		}
+
+		t.Last = msg.InternalDate
+		t.Messages = append(t.Messages, m)
+
+		if timeline.First.IsZero() {
+			timeline.First = msg.InternalDate
+		}
+		timeline.Last = msg.InternalDate
+		timeline.Messages++
+
+	}
+
+	timeline.OwnerResponse = NewResponseStats(ownerTimes)
+	timeline.ContactResponse = NewResponseStats(contactTimes)
+
+	for _, t := range threads {
+		timeline.Threads = append(timeline.Threads, *t)
+	}
+
+	sort.Slice(timeline.Threads, func(i, j int) bool {
+		return timeline.Threads[i].Last.After(timeline.Threads[j].Last)
+	})
+
+	return timeline, nil
+}